@@ -132,12 +132,30 @@ const docTemplate = `{
                             "$ref": "#/definitions/api.ApiResponseError"
                         }
                     },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    },
                     "404": {
                         "description": "Not Found",
                         "schema": {
                             "$ref": "#/definitions/api.ApiResponseError"
                         }
                     },
+                    "429": {
+                        "description": "Too Many Requests",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        },
+                        "headers": {
+                            "Retry-After": {
+                                "type": "integer",
+                                "description": "Seconds until the next request is allowed"
+                            }
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -152,6 +170,161 @@ const docTemplate = `{
                     }
                 }
             }
+        },
+        "/{host}/host-certificate": {
+            "post": {
+                "description": "Generate and return a new SSH host certificate for the given host public key. Requires the host to be listed explicitly (not only by a wildcard entry), the enrollment secret and/or a client address allowed by the hostgroup, and a client certificate if mutual TLS is enabled.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Generate SSH host certificate",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "example": "\"example.com\"",
+                        "description": "Host",
+                        "name": "host",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Host public key and enrollment secret",
+                        "name": "body",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/api.FormHostHostCertificate"
+                        }
+                    }
+                ],
+                "responses": {
+                    "201": {
+                        "description": "Created",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseCertificate"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    }
+                }
+            }
+        },
+        "/{host}/krl": {
+            "get": {
+                "description": "Return the OpenSSH key revocation list (KRL) for all trusted user CA keys of the given host, suitable for the RevokedKeys option of sshd.",
+                "produces": [
+                    "application/octet-stream",
+                    "application/json"
+                ],
+                "summary": "Get key revocation list",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "example": "\"example.com\"",
+                        "description": "Host",
+                        "name": "host",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    }
+                }
+            }
+        },
+        "/{host}/user-ca-keys": {
+            "get": {
+                "description": "Return the trusted user CA public keys of the given host, one per line, suitable for the TrustedUserCAKeys option of sshd.",
+                "produces": [
+                    "text/plain",
+                    "application/json"
+                ],
+                "summary": "Get trusted user CA keys",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "example": "\"example.com\"",
+                        "description": "Host",
+                        "name": "host",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    },
+                    "404": {
+                        "description": "Not Found",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "$ref": "#/definitions/api.ApiResponseError"
+                        }
+                    }
+                }
+            }
         }
     },
     "definitions": {
@@ -181,7 +354,29 @@ const docTemplate = `{
                     }
                 },
                 "publickey": {
+                    "description": "The active host CA public key",
                     "type": "string"
+                },
+                "publickey_signatures": {
+                    "description": "Signatures of PublicKeys by the active key, see sshutil.SignCAKey()",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "publickeys": {
+                    "description": "All trusted host CA public keys, starting with the active one",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "retired_publickeys": {
+                    "description": "Host CA public keys that are no longer trusted",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
                 }
             }
         },
@@ -200,6 +395,21 @@ const docTemplate = `{
                 "token"
             ],
             "properties": {
+                "lifetime": {
+                    "description": "Requested validity in seconds, which is limited to the validity\nconfigured for the host. Optional.",
+                    "type": "integer",
+                    "example": 900
+                },
+                "principals": {
+                    "description": "Requested subset of the principals \"oinit\" and the username of the\nuser. Optional, defaults to both.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    },
+                    "example": [
+                        "oinit"
+                    ]
+                },
                 "publickey": {
                     "type": "string"
                 },
@@ -208,6 +418,20 @@ const docTemplate = `{
                 }
             }
         },
+        "api.FormHostHostCertificate": {
+            "type": "object",
+            "required": [
+                "publickey"
+            ],
+            "properties": {
+                "publickey": {
+                    "type": "string"
+                },
+                "secret": {
+                    "type": "string"
+                }
+            }
+        },
         "api.Provider": {
             "type": "object",
             "properties": {
@@ -1,50 +1,196 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	docs "github.com/lbrocke/oinit/api/docs"
 	"github.com/lbrocke/oinit/internal/api"
+	"github.com/lbrocke/oinit/internal/audit"
 	"github.com/lbrocke/oinit/internal/config"
+	"github.com/lbrocke/oinit/internal/ledger"
+	"github.com/lbrocke/oinit/internal/metrics"
 
 	"github.com/gin-gonic/gin"
 )
 
 const (
-	USAGE = "Usage: oinit-ca <host:port> <path/to/config>"
+	COMMAND_REVOKE = "revoke"
+
+	USAGE = "Usage:\n" +
+		"\toinit-ca <host:port> <path/to/config>\n" +
+		"\toinit-ca revoke <path/to/config> serial <serial>\n" +
+		"\toinit-ca revoke <path/to/config> key-id <oinit@host>\n" +
+		"\toinit-ca revoke <path/to/config> fingerprint <SHA256:...>"
+
+	// Interval in which the config file and key files are checked for changes
+	RELOAD_INTERVAL = 5 * time.Second
+
+	// Maximum duration for reading request headers
+	READ_HEADER_TIMEOUT = 10 * time.Second
+
+	// Maximum duration to wait for requests in progress on shutdown
+	SHUTDOWN_TIMEOUT = 30 * time.Second
 
 	SWAGGER_TITLE = "oinit CA API"
 	SWAGGER_DESC  = "Swagger documentation for the oinit CA REST API."
 )
 
-// ConfigMiddleware is a middleware function that attaches a configuration object
-// to the Gin context. This allows handlers downstream to access the configuration.
-func ConfigMiddleware(config config.Config) gin.HandlerFunc {
+// ConfigMiddleware is a middleware function that attaches the current
+// configuration object to the Gin context. This allows handlers downstream to
+// access the configuration. Requests keep the configuration they started
+// with, even if it is reloaded in the meantime.
+func ConfigMiddleware(store *config.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Set("config", config)
+		c.Set("config", store.Get())
 		c.Next()
 	}
 }
 
-func main() {
-	args := os.Args[1:]
-	if len(args) != 2 {
-		log.Fatalln(USAGE)
+// reloadConfig reloads the configuration of the given store and logs the
+// differences. The current configuration is kept if the new one is invalid.
+func reloadConfig(store *config.Store, reason string) {
+	diff, err := store.Reload()
+	if err != nil {
+		log.Println("Error while reloading config (" + reason + "), keeping current config: " + err.Error())
+		return
 	}
 
-	addr := args[0]
-	conf := args[1]
+	if len(diff) == 0 {
+		log.Println("Reloaded config (" + reason + "), no changes")
+		return
+	}
+
+	log.Println("Reloaded config (" + reason + "):")
+	for _, line := range diff {
+		log.Println("\t" + line)
+	}
+}
+
+// watchConfig reloads the configuration of the given store on SIGHUP and
+// whenever the config file or a key file changes. On SIGHUP, the audit log
+// file is reopened as well, so that it can be rotated.
+func watchConfig(store *config.Store, auditLogger *audit.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(RELOAD_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			if err := auditLogger.Reopen(); err != nil {
+				log.Println("Error while reopening audit log, keeping current file: " + err.Error())
+			}
+
+			reloadConfig(store, "SIGHUP")
+		case <-ticker.C:
+			if store.Changed() {
+				reloadConfig(store, "file change")
+			}
+		}
+	}
+}
+
+// LedgerMiddleware is a middleware function that attaches the certificate
+// ledger to the Gin context.
+func LedgerMiddleware(ledger *ledger.Ledger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("ledger", ledger)
+		c.Next()
+	}
+}
+
+// handleCommandRevoke handles the 'revoke' command, which adds a certificate
+// serial, key id or public key fingerprint to the key revocation lists served
+// by the CA.
+func handleCommandRevoke(args []string) {
+	if len(args) != 3 {
+		log.Fatalln(USAGE)
+	}
 
-	cfg, err := config.Load(conf)
+	cfg, err := config.Load(args[0])
 	if err != nil {
 		log.Fatalln("Error while loading config: " + err.Error())
 	}
 
-	gin.SetMode(gin.ReleaseMode)
+	ledgr, err := ledger.Open(cfg.Database)
+	if err != nil {
+		log.Fatalln("Error while opening ledger: " + err.Error())
+	}
+	defer ledgr.Close()
+
+	revocation := ledger.Revocation{
+		Type:  args[1],
+		Value: args[2],
+	}
+
+	switch revocation.Type {
+	case ledger.REVOKE_SERIAL:
+		serial, err := strconv.ParseUint(revocation.Value, 10, 64)
+		if err != nil {
+			log.Fatalln("Invalid serial: " + revocation.Value)
+		}
+
+		// Serials are only unique for this CA, therefore limit the revocation
+		// to the CA key that signed the certificate.
+		entry, err := ledgr.Get(serial)
+		if err != nil {
+			log.Fatalln("Certificate with serial " + revocation.Value + " was not issued by this CA.")
+		}
+
+		revocation.CAFingerprint = entry.CAFingerprint
+
+		log.Printf("Revoking %s certificate %d for '%s' (key %s)", entry.Type, entry.Serial, entry.Host, entry.Fingerprint)
+	case ledger.REVOKE_KEY_ID:
+		if revocation.Value == "" {
+			log.Fatalln("Invalid key id.")
+		}
+	case ledger.REVOKE_FINGERPRINT:
+		hash, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(revocation.Value, "SHA256:"))
+		if !strings.HasPrefix(revocation.Value, "SHA256:") || err != nil || len(hash) != 32 {
+			log.Fatalln("Invalid fingerprint, expected format SHA256:...")
+		}
+	default:
+		log.Fatalln(USAGE)
+	}
+
+	if err := ledgr.Revoke(revocation); err != nil {
+		log.Fatalln("Error while revoking: " + err.Error())
+	}
+
+	log.Println("Revoked " + revocation.Type + " " + revocation.Value)
+}
 
+// newRouter returns the router serving the API and metrics.
+func newRouter(store *config.Store, ledgr *ledger.Ledger, auditLogger *audit.Logger) (*gin.Engine, error) {
 	router := gin.Default()
-	router.Use(ConfigMiddleware(cfg))
+
+	// Only proxies listed in the config may set the client IP address using
+	// X-Forwarded-For, which is used for host enrollment and rate limits.
+	// The list cannot be changed without restart.
+	if err := router.SetTrustedProxies(store.Get().TrustedProxies); err != nil {
+		return nil, err
+	}
+
+	router.Use(metrics.Middleware())
+	router.Use(audit.Middleware(auditLogger, store.Get().TrustedProxyNetworks))
+	router.Use(ConfigMiddleware(store))
+	router.Use(LedgerMiddleware(ledgr))
+
+	// Routes for administrators and OpenSSH servers require a client
+	// certificate if mutual TLS is enabled.
+	router.GET("/metrics", ClientCertMiddleware(), gin.WrapH(metrics.Handler()))
 
 	gAPI := router.Group("/api")
 	{
@@ -60,13 +206,108 @@ func main() {
 			//     transmitted in the request body, not as query parameter).
 			// Therefore this route uses the POST method rather then GET.
 			v1.POST("/:host/certificate", api.PostHostCertificate)
+			v1.POST("/:host/host-certificate", ClientCertMiddleware(), api.PostHostHostCertificate)
+			v1.GET("/:host/krl", api.GetHostKRL)
+			v1.GET("/:host/user-ca-keys", api.GetHostUserCAKeys)
 		}
 	}
 
+	return router, nil
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == COMMAND_REVOKE {
+		handleCommandRevoke(args[1:])
+		return
+	}
+
+	if len(args) != 2 {
+		log.Fatalln(USAGE)
+	}
+
+	addr := args[0]
+	conf := args[1]
+
+	store, err := config.NewStore(conf)
+	if err != nil {
+		log.Fatalln("Error while loading config: " + err.Error())
+	}
+
+	// The database cannot be changed without restart. It is kept open until
+	// the server is shut down.
+	ledgr, err := ledger.Open(store.Get().Database)
+	if err != nil {
+		log.Fatalln("Error while opening ledger: " + err.Error())
+	}
+	defer ledgr.Close()
+
+	// The audit log output cannot be changed without restart either
+	auditLogger, err := audit.Open(store.Get().AuditLog)
+	if err != nil {
+		log.Fatalln("Error while opening audit log: " + err.Error())
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router, err := newRouter(store, ledgr, auditLogger)
+	if err != nil {
+		log.Fatalln("Error while setting trusted proxies: " + err.Error())
+	}
+
 	docs.SwaggerInfo.Version = api.API_VERSION
 	docs.SwaggerInfo.BasePath = "/api/v1"
 	docs.SwaggerInfo.Title = SWAGGER_TITLE
 	docs.SwaggerInfo.Description = SWAGGER_DESC
 
-	router.Run(addr)
+	go watchConfig(store, auditLogger)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           router,
+		ReadHeaderTimeout: READ_HEADER_TIMEOUT,
+	}
+
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		waitForShutdown(server)
+	}()
+
+	// Enabling or disabling TLS requires a restart, certificates are
+	// replaced on reload.
+	if store.Get().TLSEnabled() {
+		server.TLSConfig = newTLSConfig(store)
+
+		log.Println("Listening on " + addr + " (HTTPS)")
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Println("Listening on " + addr + " (HTTP)")
+		err = server.ListenAndServe()
+	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalln("Error while serving: " + err.Error())
+	}
+
+	// Close the ledger only after requests in progress are completed
+	<-shutdown
+	log.Println("Stopped")
+}
+
+// waitForShutdown shuts down the given server on SIGINT or SIGTERM, waiting
+// for requests in progress to complete for up to SHUTDOWN_TIMEOUT.
+func waitForShutdown(server *http.Server) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-stop
+	log.Println("Shutting down (" + sig.String() + ")")
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Println("Error while shutting down: " + err.Error())
+	}
 }
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lbrocke/oinit/internal/audit"
+	"github.com/lbrocke/oinit/internal/config"
+	"github.com/lbrocke/oinit/internal/ledger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func writeKeyPair(t *testing.T, dir, name string) {
+	pk, privkey, _ := ed25519.GenerateKey(rand.Reader)
+	pubkey, _ := ssh.NewPublicKey(pk)
+
+	block, err := ssh.MarshalPrivateKey(privkey, "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".pub"), ssh.MarshalAuthorizedKey(pubkey), 0644))
+}
+
+// newTestRouter returns a router using a config consisting of default keys
+// and the given options, as well as the ledger used by the router.
+func newTestRouter(t *testing.T, options string) (*gin.Engine, *ledger.Ledger) {
+	dir := t.TempDir()
+	writeKeyPair(t, dir, "host-ca")
+	writeKeyPair(t, dir, "user-ca")
+
+	path := filepath.Join(dir, "config.ini")
+	assert.NoError(t, os.WriteFile(path, []byte(
+		"database        = "+filepath.Join(dir, "ledger.db")+"\n"+
+			"host-ca-privkey = "+filepath.Join(dir, "host-ca")+"\n"+
+			"host-ca-pubkey  = "+filepath.Join(dir, "host-ca.pub")+"\n"+
+			"user-ca-privkey = "+filepath.Join(dir, "user-ca")+"\n"+
+			"user-ca-pubkey  = "+filepath.Join(dir, "user-ca.pub")+"\n"+
+			"cert-validity   = 3600\n"+
+			"cache-duration  = 600\n"+
+			options), 0600))
+
+	store, err := config.NewStore(path)
+	assert.NoError(t, err)
+
+	ledgr, err := ledger.Open(store.Get().Database)
+	assert.NoError(t, err)
+	t.Cleanup(func() { ledgr.Close() })
+
+	gin.SetMode(gin.TestMode)
+
+	router, err := newRouter(store, ledgr, audit.NewLogger(io.Discard))
+	assert.NoError(t, err)
+
+	return router, ledgr
+}
+
+// post sends a request with a JSON body from the given remote address, which
+// is httptest's default of 192.0.2.1, and with the given X-Forwarded-For
+// header, if not empty.
+func post(router *gin.Engine, path, body, forwardedFor string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+
+	return res
+}
+
+func TestHostEnrollmentTrustedProxies(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(rand.Reader)
+	pubkey, _ := ssh.NewPublicKey(pk)
+	body := `{"publickey": "` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubkey))) + `"}`
+
+	options := "[example.com]\n" +
+		"login.example.com     = https://login.example.com:8443\n" +
+		"host-enrollment-allow = 198.51.100.10\n"
+
+	t.Run("Spoofed X-Forwarded-For", func(t *testing.T) {
+		router, _ := newTestRouter(t, options)
+
+		res := post(router, "/api/v1/login.example.com/host-certificate", body, "198.51.100.10")
+		assert.Equal(t, http.StatusForbidden, res.Code)
+	})
+
+	t.Run("Trusted proxy", func(t *testing.T) {
+		router, _ := newTestRouter(t, "trusted-proxies = 192.0.2.1\n"+options)
+
+		res := post(router, "/api/v1/login.example.com/host-certificate", body, "198.51.100.10")
+		assert.Equal(t, http.StatusCreated, res.Code)
+	})
+}
+
+func TestHostEnrollmentWildcard(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(rand.Reader)
+	pubkey, _ := ssh.NewPublicKey(pk)
+	body := `{"publickey": "` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubkey))) + `", "secret": "secret"}`
+
+	router, _ := newTestRouter(t, "[example.com]\n"+
+		"login.example.com      = https://login.example.com:8443\n"+
+		"*.example.com          = https://login.example.com:8443\n"+
+		"host-enrollment-secret = secret\n")
+
+	res := post(router, "/api/v1/login.example.com/host-certificate", body, "")
+	assert.Equal(t, http.StatusCreated, res.Code)
+
+	// Names only matching the wildcard entry are rejected
+	res = post(router, "/api/v1/other.example.com/host-certificate", body, "")
+	assert.Equal(t, http.StatusForbidden, res.Code)
+}
+
+func TestRateLimitForwardedFor(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(rand.Reader)
+	pubkey, _ := ssh.NewPublicKey(pk)
+	body := `{"publickey": "` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubkey))) + `", "token": "opaque"}`
+
+	// motley_cue is not reachable, which doesn't matter for the rate limit
+	router, _ := newTestRouter(t, "[example.com]\n"+
+		"login.example.com = http://127.0.0.1:1\n"+
+		"rate-limit-ip     = 1/1h\n")
+
+	res := post(router, "/api/v1/login.example.com/certificate", body, "198.51.100.1")
+	assert.NotEqual(t, http.StatusTooManyRequests, res.Code)
+
+	// Forged X-Forwarded-For headers don't result in new buckets
+	for _, forwardedFor := range []string{"198.51.100.2", "198.51.100.3"} {
+		res = post(router, "/api/v1/login.example.com/certificate", body, forwardedFor)
+		assert.Equal(t, http.StatusTooManyRequests, res.Code)
+		assert.NotEmpty(t, res.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitSubject(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(rand.Reader)
+	pubkey, _ := ssh.NewPublicKey(pk)
+
+	newToken := func(jti string) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+			"iss": "https://issuer.example.com",
+			"sub": "victim",
+			"jti": jti,
+		}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		assert.NoError(t, err)
+
+		return token
+	}
+
+	valid := newToken("valid")
+
+	// motley_cue only accepts the valid token
+	motleyCue := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Header.Get("Authorization") != "Bearer "+valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"detail": "invalid token"}`))
+			return
+		}
+
+		w.Write([]byte(`{"state": "deployed", "credentials": {"ssh_user": "victim"}}`))
+	}))
+	defer motleyCue.Close()
+
+	router, _ := newTestRouter(t, "[example.com]\n"+
+		"login.example.com  = "+motleyCue.URL+"\n"+
+		"rate-limit-subject = 1/1h\n")
+
+	body := func(token string) string {
+		return `{"publickey": "` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubkey))) + `", "token": "` + token + `"}`
+	}
+
+	// Forged tokens of the subject don't use up its quota
+	for _, jti := range []string{"forged-1", "forged-2", "forged-3"} {
+		res := post(router, "/api/v1/login.example.com/certificate", body(newToken(jti)), "")
+		assert.Equal(t, http.StatusUnauthorized, res.Code)
+	}
+
+	res := post(router, "/api/v1/login.example.com/certificate", body(valid), "")
+	assert.Equal(t, http.StatusCreated, res.Code)
+
+	res = post(router, "/api/v1/login.example.com/certificate", body(valid), "")
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+}
+
+func TestCertificateValidityToken(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(rand.Reader)
+	pubkey, _ := ssh.NewPublicKey(pk)
+
+	// motley_cue accepts any token
+	motleyCue := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"state": "deployed", "credentials": {"ssh_user": "user"}}`))
+	}))
+	defer motleyCue.Close()
+
+	router, _ := newTestRouter(t, "[example.com]\n"+
+		"login.example.com = "+motleyCue.URL+"\n"+
+		"cert-validity     = token\n")
+
+	body := func(claims jwt.MapClaims) string {
+		claims["iss"] = "https://issuer.example.com"
+		claims["sub"] = "user"
+
+		token, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+		assert.NoError(t, err)
+
+		return `{"publickey": "` + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pubkey))) + `", "token": "` + token + `"}`
+	}
+
+	res := post(router, "/api/v1/login.example.com/certificate", body(jwt.MapClaims{"exp": time.Now().Add(time.Hour).Unix()}), "")
+	assert.Equal(t, http.StatusCreated, res.Code)
+
+	// Tokens without or with an expired exp claim leave no validity
+	res = post(router, "/api/v1/login.example.com/certificate", body(jwt.MapClaims{}), "")
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res = post(router, "/api/v1/login.example.com/certificate", body(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}), "")
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+}
+
+func TestKRLVersion(t *testing.T) {
+	router, ledgr := newTestRouter(t, "[example.com]\n"+
+		"login.example.com = https://login.example.com:8443\n")
+
+	// The krl_version field follows the magic and the format version
+	version := func() uint64 {
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/v1/login.example.com/krl", nil))
+		assert.Equal(t, http.StatusOK, res.Code)
+
+		return binary.BigEndian.Uint64(res.Body.Bytes()[12:20])
+	}
+
+	assert.Equal(t, uint64(0), version())
+
+	assert.NoError(t, ledgr.Revoke(ledger.Revocation{Type: ledger.REVOKE_KEY_ID, Value: "oinit@login.example.com"}))
+	assert.Equal(t, uint64(1), version())
+
+	// Revoking the same key id again does not change the KRL
+	assert.NoError(t, ledgr.Revoke(ledger.Revocation{Type: ledger.REVOKE_KEY_ID, Value: "oinit@login.example.com"}))
+	assert.Equal(t, uint64(1), version())
+
+	assert.NoError(t, ledgr.Revoke(ledger.Revocation{Type: ledger.REVOKE_SERIAL, Value: "1"}))
+	assert.Equal(t, uint64(2), version())
+}
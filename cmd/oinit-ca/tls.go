@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+
+	"github.com/lbrocke/oinit/internal/api"
+	"github.com/lbrocke/oinit/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TLS_CIPHER_SUITES are the cipher suites offered for TLS 1.2, which all
+// provide forward secrecy and authenticated encryption. Cipher suites of TLS
+// 1.3 are not configurable.
+var TLS_CIPHER_SUITES = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// newTLSConfig returns the TLS configuration of the server. Certificates and
+// client CAs are taken from the current configuration of the given store for
+// every connection, so that they are replaced on reload.
+func newTLSConfig(store *config.Store) *tls.Config {
+	base := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CipherSuites:     TLS_CIPHER_SUITES,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+
+	base.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		conf := store.Get()
+		if !conf.TLSEnabled() {
+			return nil, errors.New("TLS was disabled, restart required")
+		}
+
+		return conf.TLS.Certificate, nil
+	}
+
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		conf := store.Get()
+		if !conf.MutualTLSEnabled() {
+			return nil, nil
+		}
+
+		// Client certificates are optional during the handshake, as only
+		// some routes require them, see ClientCertMiddleware().
+		mutual := base.Clone()
+		mutual.GetConfigForClient = nil
+		mutual.ClientAuth = tls.VerifyClientCertIfGiven
+		mutual.ClientCAs = conf.TLS.ClientCAs
+
+		return mutual, nil
+	}
+
+	return base
+}
+
+// ClientCertMiddleware is a middleware function that rejects requests without
+// a valid client certificate if mutual TLS is enabled. It must be used after
+// ConfigMiddleware.
+func ClientCertMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		conf, ok := c.MustGet("config").(config.Config)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, api.ApiResponseError{Error: api.ERR_INTERNAL_ERROR})
+			return
+		}
+
+		if conf.MutualTLSEnabled() && (c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0) {
+			c.AbortWithStatusJSON(http.StatusForbidden, api.ApiResponseError{Error: api.ERR_CLIENT_CERT})
+			return
+		}
+
+		c.Next()
+	}
+}
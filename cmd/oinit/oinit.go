@@ -2,15 +2,19 @@ package main
 
 import (
 	"crypto/ed25519"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/lbrocke/oinit/internal/api"
 	"github.com/lbrocke/oinit/internal/dnsutil"
 	"github.com/lbrocke/oinit/internal/liboinitca"
 	"github.com/lbrocke/oinit/internal/oidc"
@@ -26,20 +30,51 @@ import (
 )
 
 const (
-	COMMAND_ADD    = "add"
-	COMMAND_DELETE = "delete"
-	COMMAND_LIST   = "list"
-	COMMAND_MATCH  = "match"
+	COMMAND_ADD          = "add"
+	COMMAND_DELETE       = "delete"
+	COMMAND_LIST         = "list"
+	COMMAND_MATCH        = "match"
+	COMMAND_STATUS       = "status"
+	COMMAND_RENEW        = "renew"
+	COMMAND_SET_PROVIDER = "set-provider"
+	COMMAND_SYNC         = "sync"
+
+	// Interval in which 'renew --watch' checks the certificates in ssh-agent
+	RENEW_INTERVAL = 30 * time.Second
+
+	// File in the user's cache directory in which failed CA endpoints are
+	// remembered, and the duration they are tried last for
+	HEALTH_FILE     = "ca-health.json"
+	HEALTH_DURATION = 5 * time.Minute
+
+	// OAuth client used to request tokens without oidc-agent, if not set in
+	// the config file
+	ENV_CLIENT_ID     = "OINIT_CLIENT_ID"
+	ENV_CLIENT_SECRET = "OINIT_CLIENT_SECRET"
 
 	USAGE = "Usage:\n" +
-		"\toinit add    <host>[:port] [ca]\tAdd a host managed by oinit.\n" +
+		"\toinit add    [--fingerprint fp] <host>[:port] [ca...]\n\t\t\t\tAdd a host managed by oinit.\n" +
 		"\toinit delete <host>[:port]\tDelete a host.\n" +
-		"\toinit list\t\t\tList all hosts managed by oinit.\n"
+		"\toinit list\t\t\tList all hosts managed by oinit.\n" +
+		"\toinit status [--json] [host]\tShow certificates held in ssh-agent.\n" +
+		"\toinit renew [--watch] [--force]\tRenew certificates held in ssh-agent.\n" +
+		"\toinit set-provider <host>[:port] [issuer]\n\t\t\t\tSet or reset the provider used for a host.\n" +
+		"\toinit sync\t\t\tUpdate known_hosts and ssh config for all hosts.\n"
 )
 
 // handleCommandAdd handles the 'add' command to add a host managed by oinit.
-// It takes the host and optional CA as arguments.
+// It takes the host and optional CA as arguments, optionally preceded by the
+// --fingerprint flag.
 func handleCommandAdd(args []string) {
+	flags := flag.NewFlagSet(COMMAND_ADD, flag.ContinueOnError)
+	fingerprintFlag := flags.String("fingerprint", "", "")
+
+	if flags.Parse(args) != nil {
+		os.Exit(1)
+	}
+
+	args = flags.Args()
+
 	if len(args) < 1 {
 		fmt.Print(USAGE)
 		return
@@ -71,12 +106,26 @@ func handleCommandAdd(args []string) {
 	}
 
 	// Determine CA from DNS if not given on command line.
-	var ca string
+	var cas []string
 	if len(args) >= 2 {
-		ca = args[1]
+		cas = args[1:]
 	} else {
-		detected, err := dnsutil.LookupCA(host)
+		opts, err := oinit.GetOptions(hostport)
 		if err != nil {
+			log.LogError("Could not read config file: " + err.Error())
+			return
+		}
+
+		detected, err := dnsutil.LookupCA(host, dnsutil.Options{
+			Resolver:      opts.DNSResolver,
+			RequireDNSSEC: opts.DNSRequireDNSSEC,
+			TrustAnchor:   opts.DNSTrustAnchor,
+		})
+		if err != nil && err.Error() == dnsutil.ERR_INSECURE {
+			log.LogError("The CA for this host could not be determined securely from DNS,")
+			log.LogError("as the answer was not validated using DNSSEC.")
+			return
+		} else if err != nil {
 			log.LogWarn("The CA for this host could not be determined from DNS.")
 			log.LogWarn("You can manually specify the CA by running:")
 			log.LogWarn("")
@@ -84,34 +133,42 @@ func handleCommandAdd(args []string) {
 			return
 		}
 
-		ca = detected
-		log.LogInfo("Determined CA from DNS: " + ca)
+		cas = detected
+		log.LogInfo("Determined CA from DNS: " + strings.Join(cas, ", "))
 	}
 
-	// Try to contact CA, which returns the host CA public key to be added
+	// Try to contact CA, which returns the host CA public keys to be added
 	// to the user's known_hosts file.
-	if res, err := liboinitca.NewClient(ca).GetHost(host); err != nil {
+	res, err := newCAClient(cas).GetHost(host)
+	if err != nil {
 		log.LogError("Could not contact CA: " + err.Error())
 		return
-	} else {
-		if err := sshutil.AddSSHKnownHost(host, port, res.PublicKey); err != nil {
-			log.LogWarn("Could not add public key to your known_hosts file.")
+	}
 
-			if newLine, err := sshutil.GenerateKnownHosts(host, port, res.PublicKey); err == nil {
-				log.LogWarn("Please add the following line by yourself:")
-				log.LogWarn("\t" + newLine)
-			}
-		}
+	// The keys are trusted for all hosts of the CA, so make sure they are the
+	// expected ones before adding them.
+	confirmed, err := confirmCAKeys(res.PublicKeys, *fingerprintFlag)
+	if err != nil {
+		log.LogError(err.Error())
+		return
 	}
 
-	// Add to users' hosts file.
-	if err := oinit.AddHostUser(hostport, ca); err != nil {
+	// The next key of a key rotation is trusted as well if it is signed by
+	// the confirmed key
+	pubkeys, _ := checkCAKeys(hostport, confirmed, res, log.LogWarn, nil)
+
+	syncKnownHosts(host, port, pubkeys, res.RetiredPublicKeys, new(syncSummary))
+
+	// Add to users' hosts file, pinning the confirmed keys.
+	if err := oinit.AddHostUser(hostport, cas, pubkeys); err != nil {
 		log.LogError("Could not add host: " + err.Error())
 		return
 	} else {
 		log.LogSuccess(hostport + " was added.")
 	}
 
+	updateUsersFile(log.LogWarn)
+
 	// Check if 'Match exec ...' block is present, and if not try to add it.
 	if added, err := sshutil.AddSSHMatchBlock(); err != nil {
 		log.LogWarn("Could not read or modify your OpenSSH config file.")
@@ -127,6 +184,146 @@ func handleCommandAdd(args []string) {
 	}
 }
 
+// confirmCAKeys checks the host CA public keys served by a CA before they
+// are trusted and returns the confirmed keys. If an expected fingerprint is
+// given, only the key matching it is confirmed. Otherwise, the fingerprints
+// are shown and the user is asked to confirm all of them.
+func confirmCAKeys(pubkeys []string, expected string) ([]string, error) {
+	if len(pubkeys) == 0 {
+		//lint:ignore ST1005 Error is display to user directly
+		return nil, errors.New("The CA sent no public key.")
+	}
+
+	fingerprints := make([]string, len(pubkeys))
+	for i, pubkey := range pubkeys {
+		fingerprint, err := sshutil.Fingerprint(pubkey)
+		if err != nil {
+			//lint:ignore ST1005 Error is display to user directly
+			return nil, errors.New("The CA sent an invalid public key: " + err.Error())
+		}
+
+		fingerprints[i] = fingerprint
+	}
+
+	if expected != "" {
+		if !strings.HasPrefix(expected, "SHA256:") {
+			expected = "SHA256:" + expected
+		}
+
+		i := slices.Index(fingerprints, expected)
+		if i < 0 {
+			//lint:ignore ST1005 Error is display to user directly
+			return nil, errors.New("The fingerprint of the CA key is " + strings.Join(fingerprints, ", ") + ", which does not match the expected one.")
+		}
+
+		return []string{pubkeys[i]}, nil
+	}
+
+	if len(fingerprints) == 1 {
+		log.LogTTY("The fingerprint of the host CA key is " + fingerprints[0] + ".")
+	} else {
+		// During a key rotation, the CA serves the current and next key
+		log.LogTTY("The fingerprints of the host CA keys are:")
+		for _, fingerprint := range fingerprints {
+			log.LogTTY("\t" + fingerprint)
+		}
+	}
+
+	log.LogTTY("Make sure it matches the one published by the administrator of the host,")
+	log.LogTTY("as hosts presenting a certificate signed by this key will be trusted.")
+
+	trusted, err := promptYesNo("Do you trust this key (yes/no)? ")
+	if err != nil {
+		return nil, err
+	}
+
+	if !trusted {
+		//lint:ignore ST1005 Error is display to user directly
+		return nil, errors.New("The host was not added.")
+	}
+
+	return pubkeys, nil
+}
+
+// promptYesNo asks the user the given question on the TTY and returns whether
+// it was answered with yes.
+func promptYesNo(question string) (bool, error) {
+	tty, err := tty.Open()
+	if err != nil {
+		//lint:ignore ST1005 Error is display to user directly
+		return false, errors.New("There was an error opening your TTY, use --fingerprint to confirm the key: " + err.Error())
+	}
+
+	log.PromptTTY(question)
+
+	answer, err := tty.ReadString()
+	tty.Close()
+
+	if err != nil {
+		//lint:ignore ST1005 Error is display to user directly
+		return false, errors.New("There was an error reading from your TTY: " + err.Error())
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "yes" || answer == "y", nil
+}
+
+// syncSummary counts the differences between the local files and the CAs
+// found by 'oinit sync', and how many of them were fixed.
+type syncSummary struct {
+	found int
+	fixed int
+}
+
+func (s *syncSummary) add(fixed bool) {
+	s.found++
+
+	if fixed {
+		s.fixed++
+	}
+}
+
+// syncKnownHosts adds the given trusted host CA public keys to the user's
+// known_hosts file and removes the retired ones. Changes are counted in the
+// given summary.
+func syncKnownHosts(host, port string, pubkeys, retired []string, summary *syncSummary) {
+	for _, pubkey := range pubkeys {
+		added, err := sshutil.AddSSHKnownHost(host, port, pubkey)
+		if err != nil {
+			summary.add(false)
+			log.LogWarn("Could not add public key to your known_hosts file.")
+
+			if newLine, err := sshutil.GenerateKnownHosts(host, port, pubkey); err == nil {
+				log.LogWarn("Please add the following line by yourself:")
+				log.LogWarn("\t" + newLine)
+			}
+		} else if added {
+			summary.add(true)
+			fingerprint, _ := sshutil.Fingerprint(pubkey)
+			log.LogInfo("Added CA key " + fingerprint + " of " + host + " to your known_hosts file.")
+		}
+	}
+
+	for _, pubkey := range retired {
+		removeKnownHost(host, port, pubkey, summary)
+	}
+}
+
+// removeKnownHost removes the given host CA public key of a host from the
+// user's known_hosts file. The change is counted in the given summary.
+func removeKnownHost(host, port, pubkey string, summary *syncSummary) {
+	fingerprint, _ := sshutil.Fingerprint(pubkey)
+
+	if removed, err := sshutil.RemoveSSHKnownHost(host, port, pubkey); err != nil {
+		summary.add(false)
+		log.LogWarn("Could not remove CA key " + fingerprint + " of " + host + " from your known_hosts file: " + err.Error())
+	} else if removed {
+		summary.add(true)
+		log.LogInfo("Removed CA key " + fingerprint + " of " + host + " from your known_hosts file.")
+	}
+}
+
 // handleCommandDelete handles the 'delete' command to delete a host.
 // It takes the host as an argument.
 func handleCommandDelete(args []string) {
@@ -156,9 +353,208 @@ func handleCommandDelete(args []string) {
 		sshutil.AgentRemoveCertificates(sshAgent, host)
 	}
 
+	sshutil.StoreRemoveCertificate(host)
+
 	log.LogSuccess(hostport + " was deleted.")
 }
 
+// handleCommandSetProvider handles the 'set-provider' command to set the
+// OIDC provider used for a host, which is otherwise selected on the first
+// connection. It takes the host and optional issuer as arguments. Without
+// issuer, the saved provider is reset.
+func handleCommandSetProvider(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Print(USAGE)
+		return
+	}
+
+	hostport := args[0]
+
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.TrimSpace(hostport)
+		port = "22"
+	}
+
+	hostport = net.JoinHostPort(host, port)
+
+	cas, err := oinit.GetCA(hostport)
+	if err != nil {
+		log.LogFatal("Could not read config file: " + err.Error())
+	} else if len(cas) == 0 {
+		log.LogFatal(hostport + " is not managed by oinit.")
+	}
+
+	if len(args) == 1 {
+		if err := oinit.SetIssuerUser(hostport, ""); err != nil {
+			log.LogFatal("Could not reset provider: " + err.Error())
+		}
+
+		log.LogSuccess("You will be asked for the provider on the next connection to " + hostport + ".")
+		return
+	}
+
+	issuer := args[1]
+
+	// Make sure the issuer is supported, to not break future connections
+	res, err := newCAClient(cas).GetHost(host)
+	if err != nil {
+		log.LogFatal("Could not contact CA: " + err.Error())
+	}
+
+	supported := make([]string, len(res.Providers))
+	for i, provider := range res.Providers {
+		supported[i] = provider.URL
+	}
+
+	if !slices.Contains(supported, issuer) {
+		sort.Strings(supported)
+
+		log.LogError(issuer + " is not supported by " + host + ". Supported providers are:")
+		for _, provider := range supported {
+			fmt.Println("\t" + provider)
+		}
+		os.Exit(1)
+	}
+
+	if err := oinit.SetIssuerUser(hostport, issuer); err != nil {
+		log.LogFatal("Could not set provider: " + err.Error())
+	}
+
+	log.LogSuccess(issuer + " will be used for " + hostport + ".")
+}
+
+// handleCommandSync handles the 'sync' command, which reconciles the user's
+// known_hosts and ssh config file with the CAs of all managed hosts:
+//
+//   - Host CA public keys served by the CAs are added to known_hosts, keys
+//     that are retired or not served anymore are removed. Keys are only
+//     updated if the CA still serves one of the pinned keys.
+//   - Keys added by oinit for hosts that are no longer managed are removed.
+//   - The 'Match' block is added, moved to the top or updated if necessary.
+//
+// A summary of the differences found and fixed is printed at the end.
+func handleCommandSync() {
+	hosts, err := oinit.GetManagedHosts()
+	if err != nil {
+		log.LogFatal("Could not read config file: " + err.Error())
+	}
+
+	hostports := make([]string, 0, len(hosts))
+	for hostport := range hosts {
+		hostports = append(hostports, hostport)
+	}
+	sort.Strings(hostports)
+
+	var summary syncSummary
+
+	// known_hosts lines that are still valid, and hosts whose lines must be
+	// kept as their CA could not be asked
+	keep := make(map[string]bool)
+	keepHosts := make(map[string]bool)
+
+	for _, hostport := range hostports {
+		host, port, err := net.SplitHostPort(hostport)
+		if err != nil {
+			continue
+		}
+
+		opts, err := oinit.GetOptions(hostport)
+		if err != nil {
+			log.LogFatal("Could not read config file: " + err.Error())
+		}
+
+		res, err := newCAClient(oinit.SplitCA(hosts[hostport])).GetHost(host)
+		if err != nil {
+			log.LogWarn(hostport + ": Could not contact CA: " + err.Error())
+			keepHosts[net.JoinHostPort(host, port)] = true
+			continue
+		}
+
+		pubkeys, ok := checkCAKeys(hostport, opts.CAKeys, res, log.LogWarn, func(fingerprint string) bool {
+			trusted, err := promptYesNo("Do you trust the new host CA key " + fingerprint + " of " + hostport + " (yes/no)? ")
+
+			return err == nil && trusted
+		})
+		if !ok {
+			summary.add(false)
+			keepHosts[net.JoinHostPort(host, port)] = true
+			continue
+		}
+
+		// New keys that were not trusted
+		for range res.PublicKeys[len(pubkeys):] {
+			summary.add(false)
+		}
+
+		syncKnownHosts(host, port, pubkeys, res.RetiredPublicKeys, &summary)
+
+		for _, pubkey := range pubkeys {
+			if line, err := sshutil.GenerateKnownHosts(host, port, pubkey); err == nil {
+				keep[line] = true
+			}
+		}
+
+		if !slices.Equal(opts.CAKeys, pubkeys) {
+			if err := oinit.SetCAKeysUser(hostport, pubkeys); err != nil {
+				summary.add(false)
+				log.LogWarn(hostport + ": Could not update pinned CA keys: " + err.Error())
+			} else if len(opts.CAKeys) > 0 {
+				summary.add(true)
+				log.LogInfo(hostport + ": Updated pinned CA keys.")
+			} else {
+				// Hosts added before keys were pinned are not counted
+				log.LogInfo(hostport + ": Pinned CA keys.")
+			}
+		}
+	}
+
+	// Remove lines that were added by oinit but are not valid anymore
+	knownHosts, err := sshutil.ListSSHKnownHosts()
+	if err != nil {
+		summary.add(false)
+		log.LogWarn("Could not read your known_hosts file: " + err.Error())
+	}
+
+	for _, knownHost := range knownHosts {
+		line, err := sshutil.GenerateKnownHosts(knownHost.Host, knownHost.Port, knownHost.PublicKey)
+		if err != nil || keep[line] || keepHosts[net.JoinHostPort(knownHost.Host, knownHost.Port)] {
+			continue
+		}
+
+		removeKnownHost(knownHost.Host, knownHost.Port, knownHost.PublicKey, &summary)
+	}
+
+	if len(hostports) > 0 {
+		updateUsersFile(log.LogWarn)
+
+		if state, err := sshutil.CheckSSHMatchBlock(); err != nil {
+			summary.add(false)
+			log.LogWarn("Could not read your OpenSSH config file: " + err.Error())
+		} else if state != sshutil.MATCH_BLOCK_OK {
+			if err := sshutil.RepairSSHMatchBlock(); err != nil {
+				summary.add(false)
+				log.LogWarn("The 'Match' block in your OpenSSH config file is " + state + ", but could not be fixed: " + err.Error())
+			} else {
+				summary.add(true)
+				log.LogInfo("The 'Match' block in your OpenSSH config file was " + state + " and has been fixed.")
+			}
+		}
+	}
+
+	if summary.found == 0 {
+		log.LogSuccess("Everything is up to date.")
+	} else if summary.found == summary.fixed {
+		log.LogSuccess(fmt.Sprintf("Found %d difference(s), all of which were fixed.", summary.found))
+	} else {
+		log.LogWarn(fmt.Sprintf("Found %d difference(s), %d of which were fixed.", summary.found, summary.fixed))
+	}
+
+	if summary.found != summary.fixed || len(keepHosts) > 0 {
+		os.Exit(1)
+	}
+}
+
 // handleCommandList handles the 'list' command to list all hosts managed by oinit.
 func handleCommandList() {
 	all, err := oinit.GetManagedHosts()
@@ -180,19 +576,145 @@ func handleCommandList() {
 	}
 }
 
-// getTokenFromOidcAgent prompts the user to select a supported OIDC issuer
-// and then requests an access token via oidc-agent. It takes the CA client
-// and host as arguments and returns the access token.
-func getTokenFromOidcAgent(caClient liboinitca.Client, host string) string {
-	if !oidc.AgentIsRunning() {
-		log.LogFatalTTY("oidc-agent is not running, please start it first.")
+// CertificateStatus describes a certificate held in ssh-agent, as printed by
+// the 'status' command in JSON mode.
+type CertificateStatus struct {
+	Host            string            `json:"host"`
+	Principals      []string          `json:"principals"`
+	Serial          uint64            `json:"serial"`
+	ValidAfter      time.Time         `json:"valid_after"`
+	ValidBefore     time.Time         `json:"valid_before"`
+	Remaining       int64             `json:"remaining_seconds"`
+	Fingerprint     string            `json:"fingerprint"`
+	CAFingerprint   string            `json:"ca_fingerprint"`
+	Extensions      []string          `json:"extensions"`
+	CriticalOptions map[string]string `json:"critical_options"`
+}
+
+// newCertificateStatus returns the status of the given certificate.
+func newCertificateStatus(cert ssh.Certificate) CertificateStatus {
+	extensions := make([]string, 0, len(cert.Permissions.Extensions))
+	for ext := range cert.Permissions.Extensions {
+		extensions = append(extensions, ext)
 	}
+	sort.Strings(extensions)
 
-	hostRes, err := caClient.GetHost(host)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	remaining := int64(time.Until(validBefore).Seconds())
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return CertificateStatus{
+		Host:            strings.TrimPrefix(cert.KeyId, sshutil.PRINCIPAL+"@"),
+		Principals:      cert.ValidPrincipals,
+		Serial:          cert.Serial,
+		ValidAfter:      time.Unix(int64(cert.ValidAfter), 0),
+		ValidBefore:     validBefore,
+		Remaining:       remaining,
+		Fingerprint:     ssh.FingerprintSHA256(cert.Key),
+		CAFingerprint:   ssh.FingerprintSHA256(cert.SignatureKey),
+		Extensions:      extensions,
+		CriticalOptions: cert.Permissions.CriticalOptions,
+	}
+}
+
+func joinOrNone(elems []string) string {
+	if len(elems) == 0 {
+		return "none"
+	}
+
+	return strings.Join(elems, ", ")
+}
+
+// handleCommandStatus handles the 'status' command to show the certificates
+// issued by oinit that are held in ssh-agent. It takes an optional host as
+// argument, optionally preceded by the --json flag.
+func handleCommandStatus(args []string) {
+	flags := flag.NewFlagSet(COMMAND_STATUS, flag.ContinueOnError)
+	jsonFlag := flags.Bool("json", false, "")
+
+	if flags.Parse(args) != nil || flags.NArg() > 1 {
+		fmt.Print(USAGE)
+		return
+	}
+
+	var host string
+	if flags.NArg() == 1 {
+		var err error
+		if host, _, err = net.SplitHostPort(flags.Arg(0)); err != nil {
+			host = strings.TrimSpace(flags.Arg(0))
+		}
+	}
+
+	if !sshutil.AgentIsRunning() {
+		log.LogFatal("ssh-agent is not running.")
+	}
+
+	sshAgent, _ := sshutil.GetAgent()
+
+	certificates, err := sshutil.AgentListCertificates(sshAgent, host)
 	if err != nil {
-		log.LogFatalTTY("Contacting the CA failed: " + err.Error())
+		log.LogFatal("Could not list certificates: " + err.Error())
+	}
+
+	statuses := make([]CertificateStatus, len(certificates))
+	for i, cert := range certificates {
+		statuses[i] = newCertificateStatus(cert)
 	}
 
+	sort.SliceStable(statuses, func(i, j int) bool {
+		return statuses[i].Host < statuses[j].Host
+	})
+
+	if *jsonFlag {
+		out, _ := json.MarshalIndent(statuses, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+
+	if len(statuses) == 0 {
+		log.LogInfo("ssh-agent holds no certificates issued by oinit.")
+		return
+	}
+
+	for _, status := range statuses {
+		log.LogInfo(status.Host)
+		fmt.Println("\tPrincipals:  " + strings.Join(status.Principals, ", "))
+		fmt.Println("\tSerial:      " + strconv.FormatUint(status.Serial, 10))
+		fmt.Printf("\tValid until: %s (%s left)\n", status.ValidBefore, time.Duration(status.Remaining)*time.Second)
+		fmt.Println("\tCA:          " + status.CAFingerprint)
+		fmt.Println("\tExtensions:  " + joinOrNone(status.Extensions))
+
+		options := make([]string, 0, len(status.CriticalOptions))
+		for key, val := range status.CriticalOptions {
+			options = append(options, key+" "+val)
+		}
+		sort.Strings(options)
+
+		fmt.Println("\tOptions:     " + joinOrNone(options))
+	}
+}
+
+// newCAClient returns a client for the given CA endpoints, which remembers
+// failed endpoints in the user's cache directory for HEALTH_DURATION.
+func newCAClient(cas []string) liboinitca.Client {
+	client := liboinitca.NewClient(cas...)
+
+	if dir, err := os.UserCacheDir(); err == nil {
+		path := filepath.Join(dir, "oinit", HEALTH_FILE)
+		client = client.WithHealth(liboinitca.NewFileHealth(path, HEALTH_DURATION))
+	}
+
+	return client
+}
+
+// selectProvider prompts the user to select a supported OIDC issuer, unless
+// it was preselected. It takes the host information returned by the CA,
+// host/port and options of the host as arguments and returns the selected
+// issuer and the scopes required for it. The selection is saved in the
+// user's config file.
+func selectProvider(hostRes api.ApiResponseHost, hostport string, opts oinit.Options) (string, []string, error) {
 	// Put provider URLs into slice to be able to sort them
 	providers := make([]string, len(hostRes.Providers))
 	for i, info := range hostRes.Providers {
@@ -200,9 +722,16 @@ func getTokenFromOidcAgent(caClient liboinitca.Client, host string) string {
 	}
 	sort.Strings(providers)
 
-	provider, err := promptProviders(providers)
+	provider, prompted, err := promptProviders(providers, opts.Issuer, opts.AgentAccount)
 	if err != nil {
-		log.LogFatalTTY(err.Error())
+		return "", nil, err
+	}
+
+	// Remember the selection, so that the user is not asked again
+	if prompted {
+		if err := oinit.SetIssuerUser(hostport, provider); err == nil {
+			log.LogInfoTTY("Your selection was saved. Run 'oinit " + COMMAND_SET_PROVIDER + "' to change it.")
+		}
 	}
 
 	// Get scopes for selected provider
@@ -215,42 +744,94 @@ func getTokenFromOidcAgent(caClient liboinitca.Client, host string) string {
 		scopes = info.Scopes
 	}
 
-	token, err := oidc.GetToken(provider, scopes)
-	if err != nil {
-		log.LogFatalTTY("Could not get token from oidc-agent: " + err.Error())
-	}
-	if token == "" {
-		log.LogFatalTTY("Received an empty token from oidc-agent.")
+	return provider, scopes, nil
+}
+
+// newTokenProvider returns the token provider configured by the given
+// options, which tries all providers listed in the token-provider option in
+// order.
+func newTokenProvider(opts oinit.Options) (oidc.TokenProvider, error) {
+	var chain oidc.ChainProvider
+
+	for _, name := range opts.TokenProviders {
+		switch name = strings.TrimSpace(name); name {
+		case oidc.PROVIDER_ENV:
+			chain = append(chain, oidc.EnvProvider{Keys: opts.TokenEnv})
+		case oidc.PROVIDER_AGENT:
+			chain = append(chain, oidc.AgentProvider{})
+		case oidc.PROVIDER_DEVICE, oidc.PROVIDER_CODE:
+			client := oidc.OAuthClient{
+				ID:     opts.ClientID,
+				Secret: opts.ClientSecret,
+			}
+			if client.ID == "" {
+				client.ID = os.Getenv(ENV_CLIENT_ID)
+				client.Secret = os.Getenv(ENV_CLIENT_SECRET)
+			}
+
+			chain = append(chain, oidc.FlowProvider{
+				Flow:   name,
+				Client: client,
+				PromptDevice: func(uri, code string) {
+					log.LogInfoTTY("To authorize oinit, please visit " + uri)
+					log.LogInfoTTY("and enter the code: " + code)
+				},
+				PromptCode: func(uri string) {
+					log.LogInfoTTY("To authorize oinit, please open the following URL in your browser:")
+					log.LogTTY(uri)
+				},
+			})
+		case oidc.PROVIDER_COMMAND:
+			if opts.TokenCommand == "" {
+				return nil, errors.New("token-command is not set")
+			}
+
+			chain = append(chain, oidc.CommandProvider{Command: opts.TokenCommand})
+		case oidc.PROVIDER_FILE:
+			if opts.TokenFile == "" {
+				return nil, errors.New("token-file is not set")
+			}
+
+			chain = append(chain, oidc.FileProvider{Path: opts.TokenFile})
+		case oidc.PROVIDER_KEYRING:
+			chain = append(chain, oidc.KeyringProvider{
+				Service: opts.TokenKeyringService,
+				User:    opts.TokenKeyringUser,
+			})
+		case "":
+			continue
+		default:
+			return nil, errors.New("unknown token provider '" + name + "'")
+		}
 	}
 
-	return token
+	return chain, nil
 }
 
 // promptProviders prompts the user to select an OIDC provider from the list
-// of available providers. It takes a list of provider URLs as arguments and
-// returns the selected provider URL.
-func promptProviders(providers []string) (string, error) {
+// of available providers. It takes a list of provider URLs as well as the
+// preselected issuer and oidc-agent account (which may be empty) as arguments
+// and returns the selected provider URL and whether the user was prompted.
+func promptProviders(providers []string, issuer, account string) (string, bool, error) {
 	if len(providers) == 0 {
 		//lint:ignore ST1005 Error is display to user directly
-		return "", errors.New("The server indicated that no OIDC provider is supported")
+		return "", false, errors.New("The server indicated that no OIDC provider is supported")
 	}
 
 	accs := oidc.GetConfiguredAccounts()
 
 	// Check if user pre-selected an account
-	if account := os.Getenv("OIDC_AGENT_ACCOUNT"); account != "" {
-		for issuer, accounts := range accs {
+	if account != "" {
+		for accIssuer, accounts := range accs {
 			if slices.Contains(accounts, account) {
-				return issuer, nil
+				return accIssuer, false, nil
 			}
 		}
 	}
 
-	// Check if user pre-selected an issuer
-	if issuer := util.Getenvs("OIDC_ISS", "OIDC_ISSUER"); issuer != "" {
-		if _, ok := accs[issuer]; ok {
-			return issuer, nil
-		}
+	// Check if user pre-selected an issuer supported by the host
+	if issuer != "" && slices.Contains(providers, issuer) {
+		return issuer, false, nil
 	}
 
 	for i, issuer := range providers {
@@ -265,7 +846,7 @@ func promptProviders(providers []string) (string, error) {
 
 	tty, err := tty.Open()
 	if err != nil {
-		return "", errors.New("There was an error opening your TTY: " + err.Error())
+		return "", false, errors.New("There was an error opening your TTY: " + err.Error())
 	}
 
 	log.PromptTTY(fmt.Sprintf("Please select a provider to use [1-%d]: ", len(providers)))
@@ -274,16 +855,99 @@ func promptProviders(providers []string) (string, error) {
 	tty.Close()
 
 	if err != nil {
-		return "", errors.New("There was an error reading from your TTY: " + err.Error())
+		return "", false, errors.New("There was an error reading from your TTY: " + err.Error())
 	}
 
 	selected, err := strconv.Atoi(sel)
 	if err != nil || selected < 1 || selected > len(providers) {
 		//lint:ignore ST1005 Error is display to user directly
-		return "", errors.New("Your selection is invalid.")
+		return "", false, errors.New("Your selection is invalid.")
+	}
+
+	return providers[selected-1], true, nil
+}
+
+// checkCAKeys returns the host CA public keys served by the CA that can be
+// trusted given the keys pinned when the host was added or last synced, and
+// whether any of them can be trusted. Pinned keys are trusted, as well as new
+// keys signed by a pinned key (see sshutil.SignCAKey()) or confirmed by the
+// user using confirm, which may be nil. Warnings are printed using the given
+// function. Hosts added before keys were pinned are not checked.
+func checkCAKeys(hostport string, pinned []string, res api.ApiResponseHost, warn func(string), confirm func(fingerprint string) bool) ([]string, bool) {
+	var pinnedKeys, pinnedFingerprints []string
+
+	for _, pubkey := range pinned {
+		if pubkey = strings.TrimSpace(pubkey); pubkey == "" {
+			continue
+		}
+
+		fingerprint, err := sshutil.Fingerprint(pubkey)
+		if err != nil {
+			warn("A pinned CA key of " + hostport + " is invalid: " + err.Error())
+			continue
+		}
+
+		pinnedKeys = append(pinnedKeys, pubkey)
+		pinnedFingerprints = append(pinnedFingerprints, fingerprint)
+	}
+
+	if len(pinnedFingerprints) == 0 {
+		return res.PublicKeys, true
+	}
+
+	var trusted []string
+	var unknown []int
+
+	for i, pubkey := range res.PublicKeys {
+		if fingerprint, err := sshutil.Fingerprint(pubkey); err == nil && slices.Contains(pinnedFingerprints, fingerprint) {
+			trusted = append(trusted, pubkey)
+		} else {
+			unknown = append(unknown, i)
+		}
 	}
 
-	return providers[selected-1], nil
+	if len(trusted) == 0 {
+		warn("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+		warn("@         WARNING: CA HOST KEY HAS CHANGED!               @")
+		warn("@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@@")
+		warn("The CA of " + hostport + " now serves a different host CA key than")
+		warn("when the host was added. Someone could be impersonating the CA,")
+		warn("or the administrator has replaced the key.")
+		warn("The pinned key has the fingerprint " + strings.Join(pinnedFingerprints, ", ") + ".")
+		warn("If the change is expected, run 'oinit " + COMMAND_DELETE + "' and")
+		warn("'oinit " + COMMAND_ADD + "' for this host to pin the new key.")
+
+		return nil, false
+	}
+
+	// A rogue CA could serve its own key alongside a pinned one, so new keys
+	// must be signed by a pinned key
+	for _, i := range unknown {
+		pubkey := res.PublicKeys[i]
+
+		signed := false
+		if i < len(res.PublicKeySignatures) {
+			for _, pinnedKey := range pinnedKeys {
+				if sshutil.VerifyCAKey(pinnedKey, pubkey, res.PublicKeySignatures[i]) {
+					signed = true
+					break
+				}
+			}
+		}
+
+		fingerprint, _ := sshutil.Fingerprint(pubkey)
+
+		if signed || (confirm != nil && confirm(fingerprint)) {
+			trusted = append(trusted, pubkey)
+			continue
+		}
+
+		warn("The CA of " + hostport + " serves the new host CA key " + fingerprint + ",")
+		warn("which is not signed by a pinned key and therefore not trusted.")
+		warn("Run 'oinit " + COMMAND_SYNC + "' to confirm it if the change is expected.")
+	}
+
+	return trusted, true
 }
 
 // generateEd25519Keys generates a new ED25519 key pair and returns the
@@ -302,78 +966,363 @@ func generateEd25519Keys() (string, ed25519.PrivateKey, error) {
 	return strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(pubkeyInst)), "\n"), privkey, nil
 }
 
+// getExistingKey returns the existing public key that should be certified
+// instead of a generated one, as configured by the key-file or key-fingerprint
+// option. For key-file, the path of the private key is returned as well. If
+// neither option is set, nil is returned.
+func getExistingKey(opts oinit.Options) (ssh.PublicKey, string, error) {
+	switch {
+	case opts.KeyFile != "" && opts.KeyFingerprint != "":
+		return nil, "", errors.New("key-file and key-fingerprint cannot be used together")
+	case opts.KeyFile != "":
+		keyFile, err := util.ExpandHome(strings.TrimSuffix(opts.KeyFile, ".pub"))
+		if err != nil {
+			return nil, "", err
+		}
+
+		content, err := os.ReadFile(keyFile + ".pub")
+		if err != nil {
+			return nil, "", errors.New("Cannot read public key: " + err.Error())
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+		if err != nil {
+			return nil, "", errors.New("Cannot parse public key " + keyFile + ".pub")
+		}
+
+		return key, keyFile, nil
+	case opts.KeyFingerprint != "":
+		if !sshutil.AgentIsRunning() {
+			return nil, "", errors.New("ssh-agent is not running, please start it first.")
+		}
+
+		sshAgent, _ := sshutil.GetAgent()
+
+		key, err := sshutil.AgentGetKey(sshAgent, opts.KeyFingerprint)
+
+		return key, "", err
+	default:
+		return nil, "", nil
+	}
+}
+
+// requestCertificate requests a new certificate for the given host/port from
+// the given CA endpoints and adds it to ssh-agent, replacing the certificates held for this
+// host. If sshAgent is nil, the certificate is written to the key store
+// instead. If an existing key is configured, it is certified instead of a
+// generated one and the certificate is always written to the key store, as
+// ssh-agent only accepts certificates together with their private key.
+// It returns the time until which the certificate is valid.
+func requestCertificate(sshAgent agent.ExtendedAgent, cas []string, hostport string, opts oinit.Options) (time.Time, error) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	caClient := newCAClient(cas)
+
+	hostRes, err := caClient.GetHost(host)
+	if err != nil {
+		return time.Time{}, errors.New("Contacting the CA failed: " + err.Error())
+	}
+
+	checkCAKeys(hostport, opts.CAKeys, hostRes, log.LogWarnTTY, nil)
+
+	key, keyFile, err := getExistingKey(opts)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	provider, err := newTokenProvider(opts)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid token provider configuration: " + err.Error())
+	}
+
+	token, err := provider.GetToken(oidc.OnceSelector(func() (string, []string, error) {
+		return selectProvider(hostRes, hostport, opts)
+	}))
+	if err != nil {
+		return time.Time{}, errors.New("Could not get an access token: " + err.Error())
+	}
+
+	var pubkey string
+	var privkey ed25519.PrivateKey
+
+	if key != nil {
+		pubkey = strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n")
+	} else if pubkey, privkey, err = generateEd25519Keys(); err != nil {
+		return time.Time{}, errors.New("There was an error generating a temporary key pair.")
+	}
+
+	lifetime, err := oinit.ParseLifetime(opts.CertLifetime)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	principals := opts.Principals()
+
+	res, err := caClient.PostHostCertificate(host, pubkey, token, lifetime, principals)
+	if err != nil {
+		return time.Time{}, errors.New("CA responded: " + err.Error())
+	}
+
+	certPk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(res.Certificate))
+	if err != nil {
+		return time.Time{}, errors.New("Cannot parse certificate.")
+	}
+
+	cert := certPk.(*ssh.Certificate)
+	validUntil := time.Unix(int64(cert.ValidBefore-1), 0)
+
+	if key != nil {
+		if err := sshutil.StoreExternalCertificate(host, cert, keyFile); err != nil {
+			return time.Time{}, errors.New("Cannot write certificate: " + err.Error())
+		}
+
+		return validUntil, nil
+	}
+
+	if sshAgent == nil {
+		// Remove expired certificates of other hosts as well
+		sshutil.StorePrune()
+
+		if err := sshutil.StoreCertificate(host, privkey, cert); err != nil {
+			return time.Time{}, errors.New("Cannot write private key and certificate: " + err.Error())
+		}
+
+		return validUntil, nil
+	}
+
+	// Remove certificates about to expire, which would otherwise still be
+	// offered to the server until they are removed by the agent.
+	sshutil.AgentRemoveCertificates(sshAgent, host)
+
+	if sshAgent.Add(agent.AddedKey{
+		PrivateKey:   privkey,
+		Certificate:  cert,
+		LifetimeSecs: uint32(time.Until(validUntil).Seconds()),
+	}) != nil {
+		return time.Time{}, errors.New("Cannot add private key and certificate to ssh-agent.")
+	}
+
+	return validUntil, nil
+}
+
+// getRenewBefore returns the renewal window of the given options, certificates
+// expiring within it are renewed.
+func getRenewBefore(opts oinit.Options) (time.Duration, error) {
+	renewBefore, err := oinit.ParseLifetime(opts.RenewBefore)
+
+	return time.Duration(renewBefore) * time.Second, err
+}
+
+// updateUsersFile writes the users file for the user options of the config
+// files, see sshutil.WriteUsersFile(). Warnings are printed using the given
+// function.
+func updateUsersFile(warn func(string)) {
+	users, err := oinit.ConfiguredUsers()
+	if err != nil {
+		warn("Could not read config file: " + err.Error())
+		return
+	}
+
+	if err := sshutil.WriteUsersFile(users); err != nil {
+		warn("Could not set the users to log in as: " + err.Error())
+	}
+}
+
 // handleCommandMatch handles the 'match' command to match a host managed by oinit.
-// It takes the host and port as arguments.
+// It takes the host and port as arguments, optionally preceded by the
+// --lifetime flag. With the --user flag, it only checks whether the user
+// option of the host is set to the given user, see sshutil.WriteUsersFile().
 func handleCommandMatch(args []string) {
+	flags := flag.NewFlagSet(COMMAND_MATCH, flag.ContinueOnError)
+	lifetimeFlag := flags.String("lifetime", "", "")
+	userFlag := flags.String("user", "", "")
+
+	if flags.Parse(args) != nil {
+		os.Exit(1)
+	}
+
+	args = flags.Args()
+
 	if len(args) != 2 {
 		os.Exit(1)
 	}
 
-	host := strings.ToLower(args[0])
+	// The host is not lowercased, as the key store needs it as expanded by
+	// ssh, see sshutil.storePaths(). Managed hosts and the CA are matched
+	// case-insensitively.
+	host := args[0]
 	port := args[1]
-	hostport := strings.ToLower(net.JoinHostPort(host, port))
+	hostport := net.JoinHostPort(host, port)
 
 	if is, err := oinit.IsManagedHost(hostport); err != nil || !is {
 		// Return non-zero exit code to indicate that host/port do not match
 		os.Exit(1)
 	}
 
-	ca, err := oinit.GetCA(hostport)
+	if *userFlag != "" {
+		if opts, err := oinit.GetOptions(hostport); err != nil || opts.User != *userFlag {
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// ssh includes the users file after this command returns, so changes to
+	// the user option apply to this connection already
+	updateUsersFile(log.LogWarnTTY)
+
+	cas, err := oinit.GetCA(hostport)
 	if err != nil {
 		log.LogFatalTTY("The CA managing '" + host + "' could not be determined.\n" +
 			"Did you run 'oinit add " + hostport + "' yet?")
 	}
 
-	caClient := liboinitca.NewClient(ca)
-
-	// Verify that ssh-agent is running, which is required in any case
-	if !sshutil.AgentIsRunning() {
-		log.LogFatalTTY("ssh-agent is not running, please start it first.")
+	opts, err := oinit.GetOptions(hostport)
+	if err != nil {
+		log.LogFatalTTY("Could not read config file: " + err.Error())
 	}
 
-	sshAgent, _ := sshutil.GetAgent()
+	// The --lifetime flag takes precedence over the config file
+	if *lifetimeFlag != "" {
+		opts.CertLifetime = *lifetimeFlag
+	}
 
-	if exists, err := sshutil.AgentHasCertificate(sshAgent, host); err == nil && exists {
-		// Agent already holds certificate, therefore do not request a new one
-		return
+	renewBefore, err := getRenewBefore(opts)
+	if err != nil {
+		log.LogFatalTTY(err.Error())
 	}
 
-	// Try to get token from environment variable
-	token := util.Getenvs("ACCESS_TOKEN", "OIDC", "OS_ACCESS_TOKEN",
-		"OIDC_ACCESS_TOKEN", "WATTS_TOKEN", "WATTSON_TOKEN")
+	// A nil agent indicates that the key store is used
+	var sshAgent agent.ExtendedAgent
+
+	switch opts.KeyStorage {
+	case oinit.STORAGE_AGENT:
+		if !sshutil.AgentIsRunning() {
+			log.LogFatalTTY("ssh-agent is not running, please start it first.")
+		}
 
-	if token == "" {
-		// Use oidc-agent to get token.
-		// getTokenFromOidcAgent() exits with -1 for any errors.
-		token = getTokenFromOidcAgent(caClient, host)
+		sshAgent, _ = sshutil.GetAgent()
+	case oinit.STORAGE_FILE:
+	case oinit.STORAGE_AUTO:
+		if sshutil.AgentIsRunning() {
+			sshAgent, _ = sshutil.GetAgent()
+		}
+	default:
+		log.LogFatalTTY("Invalid key-storage '" + opts.KeyStorage + "'")
 	}
 
-	pubkey, privkey, err := generateEd25519Keys()
+	key, _, err := getExistingKey(opts)
 	if err != nil {
-		log.LogFatalTTY("There was an error generating a temporary key pair.")
+		log.LogFatalTTY(err.Error())
+	}
+
+	// Do not request a new certificate if there is one that does not expire
+	// soon
+	if key != nil || sshAgent == nil {
+		if exists, err := sshutil.StoreHasCertificate(host, renewBefore, key); err == nil && exists {
+			return
+		}
+	} else {
+		if exists, err := sshutil.AgentHasCertificate(sshAgent, host, renewBefore); err == nil && exists {
+			return
+		}
 	}
 
-	res, err := caClient.PostHostCertificate(host, pubkey, token)
+	validUntil, err := requestCertificate(sshAgent, cas, hostport, opts)
 	if err != nil {
-		log.LogFatalTTY("CA responded: " + err.Error())
+		log.LogFatalTTY(err.Error())
 	}
 
-	certPk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(res.Certificate))
+	log.LogSuccessTTY(fmt.Sprintf("Received a certificate which is valid until %s", validUntil))
+}
+
+// renewCertificates renews all certificates in ssh-agent for managed hosts
+// that expire within the renewal window of the host. If force is set, all
+// certificates are renewed. Errors are logged and do not stop the renewal of
+// other certificates.
+func renewCertificates(sshAgent agent.ExtendedAgent, force bool) {
+	certificates, err := sshutil.AgentListCertificates(sshAgent, "")
 	if err != nil {
-		log.LogFatalTTY("Cannot parse certificate.")
+		log.LogError("Could not list certificates: " + err.Error())
+		return
 	}
 
-	cert := certPk.(*ssh.Certificate)
-	validUntil := time.Unix(int64(cert.ValidBefore-1), 0)
+	renewed := make(map[string]bool)
 
-	if sshAgent.Add(agent.AddedKey{
-		PrivateKey:   privkey,
-		Certificate:  cert,
-		LifetimeSecs: uint32(time.Until(validUntil).Seconds()),
-	}) != nil {
-		log.LogFatalTTY("Cannot add private key and certificate to ssh-agent.")
-	} else {
-		log.LogSuccessTTY(fmt.Sprintf("Received a certificate which is valid until %s", validUntil))
+	for _, cert := range certificates {
+		host := strings.TrimPrefix(cert.KeyId, sshutil.PRINCIPAL+"@")
+		if renewed[host] {
+			continue
+		}
+
+		hostport, err := oinit.GetHostport(host)
+		if err != nil || hostport == "" {
+			// Host is no longer managed by oinit
+			continue
+		}
+
+		opts, err := oinit.GetOptions(hostport)
+		if err != nil {
+			log.LogError("Could not read config file: " + err.Error())
+			return
+		}
+
+		renewBefore, err := getRenewBefore(opts)
+		if err != nil {
+			log.LogError(err.Error())
+			return
+		}
+
+		if exists, err := sshutil.AgentHasCertificate(sshAgent, host, renewBefore); !force && err == nil && exists {
+			continue
+		}
+
+		cas, err := oinit.GetCA(hostport)
+		if err != nil || len(cas) == 0 {
+			continue
+		}
+
+		validUntil, err := requestCertificate(sshAgent, cas, hostport, opts)
+		if err != nil {
+			log.LogError(host + ": " + err.Error())
+			continue
+		}
+
+		renewed[host] = true
+
+		log.LogSuccess(fmt.Sprintf("Renewed certificate for %s, which is valid until %s", host, validUntil))
+	}
+}
+
+// handleCommandRenew handles the 'renew' command to renew certificates in
+// ssh-agent before they expire. With --watch, it keeps running and checks the
+// certificates every RENEW_INTERVAL. With --force, all certificates are
+// renewed regardless of their expiry.
+func handleCommandRenew(args []string) {
+	flags := flag.NewFlagSet(COMMAND_RENEW, flag.ContinueOnError)
+	watchFlag := flags.Bool("watch", false, "")
+	forceFlag := flags.Bool("force", false, "")
+
+	if flags.Parse(args) != nil || flags.NArg() != 0 {
+		fmt.Print(USAGE)
+		return
+	}
+
+	if !sshutil.AgentIsRunning() {
+		log.LogFatal("ssh-agent is not running.")
+	}
+
+	sshAgent, _ := sshutil.GetAgent()
+
+	renewCertificates(sshAgent, *forceFlag)
+
+	for *watchFlag {
+		time.Sleep(RENEW_INTERVAL)
+
+		renewCertificates(sshAgent, false)
 	}
 }
 
@@ -394,6 +1343,14 @@ func main() {
 		handleCommandList()
 	case COMMAND_MATCH:
 		handleCommandMatch(args[1:])
+	case COMMAND_STATUS:
+		handleCommandStatus(args[1:])
+	case COMMAND_RENEW:
+		handleCommandRenew(args[1:])
+	case COMMAND_SET_PROVIDER:
+		handleCommandSetProvider(args[1:])
+	case COMMAND_SYNC:
+		handleCommandSync()
 	default:
 		fmt.Print(USAGE)
 	}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/lbrocke/oinit/internal/api"
+	"github.com/lbrocke/oinit/internal/sshutil"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newCAKey(t *testing.T) (ssh.Signer, string) {
+	_, privkey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(privkey)
+	assert.NoError(t, err)
+
+	return signer, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func TestCheckCAKeys(t *testing.T) {
+	pinnedSigner, pinned := newCAKey(t)
+	_, next := newCAKey(t)
+	rogueSigner, rogue := newCAKey(t)
+
+	nextSignature, err := sshutil.SignCAKey(pinnedSigner, next)
+	assert.NoError(t, err)
+	rogueSignature, err := sshutil.SignCAKey(rogueSigner, rogue)
+	assert.NoError(t, err)
+
+	var warnings []string
+	warn := func(msg string) { warnings = append(warnings, msg) }
+	deny := func(string) bool { return false }
+
+	// [pinned, unknown] does not trust the unknown key
+	res := api.ApiResponseHost{PublicKeys: []string{pinned, rogue}}
+	trusted, ok := checkCAKeys("login.example.com:22", []string{pinned}, res, warn, nil)
+	assert.True(t, ok)
+	assert.Equal(t, []string{pinned}, trusted)
+	assert.NotEmpty(t, warnings)
+
+	// ...unless it is signed by the pinned key
+	res.PublicKeySignatures = []string{"", rogueSignature}
+	trusted, _ = checkCAKeys("login.example.com:22", []string{pinned}, res, warn, deny)
+	assert.Equal(t, []string{pinned}, trusted)
+
+	res = api.ApiResponseHost{PublicKeys: []string{pinned, next}, PublicKeySignatures: []string{"", nextSignature}}
+	trusted, _ = checkCAKeys("login.example.com:22", []string{pinned}, res, warn, deny)
+	assert.Equal(t, []string{pinned, next}, trusted)
+
+	// ...or confirmed by the user
+	var confirmed []string
+	res = api.ApiResponseHost{PublicKeys: []string{pinned, rogue}}
+	trusted, _ = checkCAKeys("login.example.com:22", []string{pinned}, res, warn, func(fingerprint string) bool {
+		confirmed = append(confirmed, fingerprint)
+		return true
+	})
+	assert.Equal(t, []string{pinned, rogue}, trusted)
+	fingerprint, _ := sshutil.Fingerprint(rogue)
+	assert.Equal(t, []string{fingerprint}, confirmed)
+
+	// None of the keys is pinned
+	warnings = nil
+	res = api.ApiResponseHost{PublicKeys: []string{rogue}, PublicKeySignatures: []string{rogueSignature}}
+	trusted, ok = checkCAKeys("login.example.com:22", []string{pinned}, res, warn, nil)
+	assert.False(t, ok)
+	assert.Empty(t, trusted)
+	assert.NotEmpty(t, warnings)
+
+	// Hosts added before keys were pinned are not checked
+	trusted, ok = checkCAKeys("login.example.com:22", nil, res, warn, nil)
+	assert.True(t, ok)
+	assert.Equal(t, []string{rogue}, trusted)
+}
+
+func TestConfirmCAKeys(t *testing.T) {
+	_, active := newCAKey(t)
+	_, other := newCAKey(t)
+
+	// Only the key matching the fingerprint is confirmed
+	fingerprint, _ := sshutil.Fingerprint(active)
+	confirmed, err := confirmCAKeys([]string{other, active}, fingerprint)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{active}, confirmed)
+
+	confirmed, err = confirmCAKeys([]string{other, active}, strings.TrimPrefix(fingerprint, "SHA256:"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{active}, confirmed)
+
+	_, err = confirmCAKeys([]string{other}, fingerprint)
+	assert.Error(t, err)
+
+	_, err = confirmCAKeys(nil, fingerprint)
+	assert.Error(t, err)
+}
@@ -1,9 +1,17 @@
 package api
 
 import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/lbrocke/oinit/internal/krl"
+	"github.com/lbrocke/oinit/internal/ledger"
+
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slices"
 )
 
 const (
@@ -11,12 +19,52 @@ const (
 	FORCE_COMMAND = "oinit-switch"
 )
 
+// selectPrincipals returns the principals of a user certificate, which are
+// PRINCIPAL and the username by default. If principals were requested, only
+// these are returned, as long as they are a subset of the default ones.
+func selectPrincipals(requested []string, username string) ([]string, error) {
+	principals := []string{PRINCIPAL, username}
+
+	if len(requested) == 0 {
+		return principals, nil
+	}
+
+	var selected []string
+	for _, principal := range principals {
+		if slices.Contains(requested, principal) && !slices.Contains(selected, principal) {
+			selected = append(selected, principal)
+		}
+	}
+
+	for _, principal := range requested {
+		if !slices.Contains(principals, principal) {
+			return nil, errors.New("principal " + principal + " not allowed")
+		}
+	}
+
+	return selected, nil
+}
+
 // generateUserCertificate generates a new OpenSSH certificate based on the
-// given public key.
-func generateUserCertificate(host string, pubkey ssh.PublicKey, username string, duration uint64) ssh.Certificate {
+// given public key and principals. The certificate contains the extensions and critical
+// options of the given permissions, in addition to the force-command critical
+// option which is always set.
+func generateUserCertificate(host string, pubkey ssh.PublicKey, serial uint64, username string, principals []string, duration uint64, perms ssh.Permissions) ssh.Certificate {
 	validAfter := uint64(time.Now().Unix())
 	validBefore := validAfter + duration
 
+	// Copy maps, as they are shared with the config
+	criticalOptions := make(map[string]string, len(perms.CriticalOptions)+1)
+	for key, val := range perms.CriticalOptions {
+		criticalOptions[key] = val
+	}
+	criticalOptions["force-command"] = FORCE_COMMAND + " " + username
+
+	extensions := make(map[string]string, len(perms.Extensions))
+	for key, val := range perms.Extensions {
+		extensions[key] = val
+	}
+
 	return ssh.Certificate{
 		Key: pubkey,
 		// From OpenSSH PROTOCOL.certkeys:
@@ -24,7 +72,10 @@ func generateUserCertificate(host string, pubkey ssh.PublicKey, username string,
 		//   provide an abbreviated way to refer to certificates from that CA.
 		//   If a CA does not wish to number its certificates it must set this
 		//   field to zero.
-		Serial:   0,
+		//
+		// Serials are handed out by the ledger and are unique across all
+		// certificates issued by this CA.
+		Serial:   serial,
 		CertType: ssh.UserCert,
 		// From OpenSSH PROTOCOL.certkeys:
 		//   key id is a free-form text field that is filled in by the CA at
@@ -34,7 +85,7 @@ func generateUserCertificate(host string, pubkey ssh.PublicKey, username string,
 		// Set KeyId to "user@host" which can be used by the client to check
 		// which host this certificate was issued for.
 		KeyId:           PRINCIPAL + "@" + host,
-		ValidPrincipals: []string{PRINCIPAL, username},
+		ValidPrincipals: principals,
 		// From OpenSSH PROTOCOL.certkeys:
 		//   "valid after" and "valid before" specify a validity period for the
 		//   certificate. Each represents a time in seconds since 1970-01-01
@@ -43,13 +94,83 @@ func generateUserCertificate(host string, pubkey ssh.PublicKey, username string,
 		ValidAfter:  validAfter - 10, // account for slight clock differences
 		ValidBefore: validBefore,
 		Permissions: ssh.Permissions{
-			CriticalOptions: map[string]string{
-				"force-command": FORCE_COMMAND + " " + username,
-			},
-			Extensions: map[string]string{
-				"permit-agent-forwarding": "",
-				"permit-pty":              "",
-			},
+			CriticalOptions: criticalOptions,
+			Extensions:      extensions,
 		},
 	}
 }
+
+// generateHostCertificate generates a new OpenSSH host certificate for the
+// given host based on the given public key. A duration of 0 results in a
+// certificate that is valid forever.
+func generateHostCertificate(host string, pubkey ssh.PublicKey, serial uint64, duration uint64) ssh.Certificate {
+	validAfter := uint64(time.Now().Unix())
+	validBefore := uint64(ssh.CertTimeInfinity)
+
+	if duration > 0 {
+		validBefore = validAfter + duration
+	}
+
+	return ssh.Certificate{
+		Key:      pubkey,
+		Serial:   serial,
+		CertType: ssh.HostCert,
+		// Use the host name as key id, which is what admins used when signing
+		// host keys manually with ssh-keygen.
+		KeyId:           host,
+		ValidPrincipals: []string{host},
+		ValidAfter:      validAfter - 10, // account for slight clock differences
+		ValidBefore:     validBefore,
+	}
+}
+
+// generateKRL generates an OpenSSH key revocation list for the given CA
+// public keys based on the given revocations. The KRL contains a section for
+// every CA key, so that certificates signed by all trusted keys are revoked
+// during a key rotation. Serial revocations are only included in the section
+// of the CA key that issued the certificate.
+func generateKRL(caKeys []ssh.PublicKey, revocations []ledger.Revocation, version uint64) []byte {
+	list := krl.KRL{
+		Version: version,
+	}
+
+	if len(caKeys) > 0 {
+		list.Comment = "oinit-ca " + ssh.FingerprintSHA256(caKeys[0])
+	}
+
+	for _, caKey := range caKeys {
+		caFingerprint := ssh.FingerprintSHA256(caKey)
+		certs := krl.Certificates{CAKey: caKey}
+
+		for _, revocation := range revocations {
+			if revocation.CAFingerprint != "" && revocation.CAFingerprint != caFingerprint {
+				continue
+			}
+
+			switch revocation.Type {
+			case ledger.REVOKE_SERIAL:
+				if serial, err := strconv.ParseUint(revocation.Value, 10, 64); err == nil {
+					certs.Serials = append(certs.Serials, serial)
+				}
+			case ledger.REVOKE_KEY_ID:
+				certs.KeyIDs = append(certs.KeyIDs, revocation.Value)
+			}
+		}
+
+		list.Certificates = append(list.Certificates, certs)
+	}
+
+	// Fingerprints are revoked regardless of the CA
+	for _, revocation := range revocations {
+		if revocation.Type != ledger.REVOKE_FINGERPRINT {
+			continue
+		}
+
+		hash, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(revocation.Value, "SHA256:"))
+		if err == nil {
+			list.Fingerprints = append(list.Fingerprints, hash)
+		}
+	}
+
+	return list.Marshal()
+}
@@ -1,10 +1,15 @@
 package api
 
 import (
+	"bytes"
 	"crypto/ed25519"
+	"encoding/binary"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/lbrocke/oinit/internal/ledger"
+
 	"golang.org/x/crypto/ssh"
 )
 
@@ -14,13 +19,24 @@ func TestGenerateUserCertificate(t *testing.T) {
 	pk, _, _ := ed25519.GenerateKey(nil)
 	pubkey, _ := ssh.NewPublicKey(pk)
 
+	serial := uint64(42)
 	username := "testuser"
 	duration := uint64(3600)
 
-	certificate := generateUserCertificate(host, pubkey, username, duration)
+	perms := ssh.Permissions{
+		CriticalOptions: map[string]string{
+			"source-address": "192.0.2.0/24",
+		},
+		Extensions: map[string]string{
+			"permit-agent-forwarding": "",
+			"permit-pty":              "",
+		},
+	}
+
+	certificate := generateUserCertificate(host, pubkey, serial, username, []string{PRINCIPAL, username}, duration, perms)
 
-	if certificate.Serial != 0 {
-		t.Error("Expected Serial to be 0")
+	if certificate.Serial != serial {
+		t.Errorf("Expected Serial to be %d, but got %d", serial, certificate.Serial)
 	}
 
 	if certificate.CertType != ssh.UserCert {
@@ -47,6 +63,14 @@ func TestGenerateUserCertificate(t *testing.T) {
 		t.Errorf("Expected force-command to be %s, but got %s", expectedForceCommand, certificate.Permissions.CriticalOptions["force-command"])
 	}
 
+	if certificate.Permissions.CriticalOptions["source-address"] != "192.0.2.0/24" {
+		t.Errorf("Expected source-address to be 192.0.2.0/24, but got %s", certificate.Permissions.CriticalOptions["source-address"])
+	}
+
+	if _, ok := perms.CriticalOptions["force-command"]; ok {
+		t.Error("Expected given permissions not to be modified")
+	}
+
 	if _, ok := certificate.Permissions.Extensions["permit-agent-forwarding"]; !ok {
 		t.Error("Expected permit-agent-forwarding extension to be present")
 	}
@@ -56,6 +80,96 @@ func TestGenerateUserCertificate(t *testing.T) {
 	}
 }
 
+func TestGenerateHostCertificate(t *testing.T) {
+	host := "login.example.com"
+
+	pk, _, _ := ed25519.GenerateKey(nil)
+	pubkey, _ := ssh.NewPublicKey(pk)
+
+	certificate := generateHostCertificate(host, pubkey, 1, 3600)
+
+	if certificate.Serial != 1 {
+		t.Errorf("Expected Serial to be 1, but got %d", certificate.Serial)
+	}
+
+	if certificate.CertType != ssh.HostCert {
+		t.Error("Expected CertType to be ssh.HostCert")
+	}
+
+	if certificate.KeyId != host {
+		t.Errorf("Expected KeyId to be %s, but got %s", host, certificate.KeyId)
+	}
+
+	if !stringSlicesEqual(certificate.ValidPrincipals, []string{host}) {
+		t.Errorf("Expected ValidPrincipals to be %v, but got %v", []string{host}, certificate.ValidPrincipals)
+	}
+
+	currentTime := uint64(time.Now().Unix())
+	if !(certificate.ValidAfter <= currentTime && currentTime < certificate.ValidBefore) {
+		t.Error("Invalid certificate validity period")
+	}
+
+	forever := generateHostCertificate(host, pubkey, 2, 0)
+	if forever.ValidBefore != ssh.CertTimeInfinity {
+		t.Error("Expected certificate without duration to be valid forever")
+	}
+}
+
+func TestSelectPrincipals(t *testing.T) {
+	username := "testuser"
+
+	principals, err := selectPrincipals(nil, username)
+	if err != nil || !stringSlicesEqual(principals, []string{PRINCIPAL, username}) {
+		t.Errorf("Expected default principals, but got %v", principals)
+	}
+
+	principals, err = selectPrincipals([]string{PRINCIPAL}, username)
+	if err != nil || !stringSlicesEqual(principals, []string{PRINCIPAL}) {
+		t.Errorf("Expected principals to be %v, but got %v", []string{PRINCIPAL}, principals)
+	}
+
+	if _, err := selectPrincipals([]string{PRINCIPAL, "root"}, username); err == nil {
+		t.Error("Expected principal root to be rejected")
+	}
+}
+
+func TestGenerateKRL(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(nil)
+	activeKey, _ := ssh.NewPublicKey(pk)
+	pk, _, _ = ed25519.GenerateKey(nil)
+	nextKey, _ := ssh.NewPublicKey(pk)
+
+	serial := func(serial uint64) []byte {
+		return binary.BigEndian.AppendUint64(nil, serial)
+	}
+
+	revocations := []ledger.Revocation{
+		{Type: ledger.REVOKE_SERIAL, Value: strconv.Itoa(7), CAFingerprint: ssh.FingerprintSHA256(activeKey)},
+		// Certificate signed by the next key, e.g. during a key rotation
+		{Type: ledger.REVOKE_SERIAL, Value: strconv.Itoa(42), CAFingerprint: ssh.FingerprintSHA256(nextKey)},
+	}
+
+	blob := generateKRL([]ssh.PublicKey{activeKey, nextKey}, revocations, 1)
+
+	active := bytes.Index(blob, activeKey.Marshal())
+	next := bytes.Index(blob, nextKey.Marshal())
+	if active < 0 || next < active {
+		t.Fatal("Expected a section for every CA key")
+	}
+
+	if !bytes.Contains(blob[active:next], serial(7)) || bytes.Contains(blob[active:next], serial(42)) {
+		t.Error("Expected serial 7 only in the section of the active key")
+	}
+
+	if !bytes.Contains(blob[next:], serial(42)) || bytes.Contains(blob[next:], serial(7)) {
+		t.Error("Expected serial 42 only in the section of the next key")
+	}
+
+	if bytes.Contains(generateKRL([]ssh.PublicKey{activeKey}, revocations, 1), serial(42)) {
+		t.Error("Expected serial of other CA key to be omitted")
+	}
+}
+
 func stringSlicesEqual(slice1, slice2 []string) bool {
 	if len(slice1) != len(slice2) {
 		return false
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// claimHasValue returns whether the given claim equals the given value or,
+// if the claim is a list, contains the value.
+func claimHasValue(claim interface{}, value string) bool {
+	switch claim := claim.(type) {
+	case nil:
+		return false
+	case string:
+		return claim == value
+	case []interface{}:
+		for _, elem := range claim {
+			if claimHasValue(elem, value) {
+				return true
+			}
+		}
+
+		return false
+	default:
+		return fmt.Sprint(claim) == value
+	}
+}
+
+// checkClaimPolicy returns whether the given claims satisfy the given policy.
+// Every claim of the policy must have at least one of the accepted values.
+func checkClaimPolicy(policy map[string][]string, claims jwt.MapClaims) bool {
+	for name, values := range policy {
+		satisfied := false
+
+		for _, value := range values {
+			if claimHasValue(claims[name], value) {
+				satisfied = true
+				break
+			}
+		}
+
+		if !satisfied {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckClaimPolicy(t *testing.T) {
+	claims := jwt.MapClaims{
+		"acr": "https://refeds.org/profile/mfa",
+		"eduperson_entitlement": []interface{}{
+			"urn:example:group:a",
+			"urn:example:group:b",
+		},
+		"level": float64(2),
+	}
+
+	assert.True(t, checkClaimPolicy(nil, claims))
+	assert.True(t, checkClaimPolicy(map[string][]string{
+		"acr":                   {"https://refeds.org/profile/mfa"},
+		"eduperson_entitlement": {"urn:example:group:c", "urn:example:group:b"},
+		"level":                 {"2"},
+	}, claims))
+
+	assert.False(t, checkClaimPolicy(map[string][]string{
+		"eduperson_entitlement": {"urn:example:group:c"},
+	}, claims))
+	assert.False(t, checkClaimPolicy(map[string][]string{
+		"acr":    {"https://refeds.org/profile/mfa"},
+		"groups": {"admins"},
+	}, claims))
+}
@@ -2,14 +2,21 @@ package api
 
 import (
 	"crypto/rand"
-	"fmt"
-	"log"
+	"crypto/subtle"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/lbrocke/oinit/internal/audit"
 	"github.com/lbrocke/oinit/internal/config"
+	"github.com/lbrocke/oinit/internal/ledger"
+	"github.com/lbrocke/oinit/internal/metrics"
+	"github.com/lbrocke/oinit/internal/sshutil"
 	"github.com/lbrocke/oinit/internal/util"
+	"github.com/lbrocke/oinit/internal/verifier"
 	"github.com/lbrocke/oinit/pkg/libmotleycue"
 
 	"github.com/gin-gonic/gin"
@@ -21,10 +28,18 @@ import (
 const (
 	API_VERSION = "1.0.0"
 
+	// Duration (in seconds) that discovery documents and key sets of OpenID
+	// Connect providers are cached for.
+	VERIFIER_CACHE_DURATION = 3600
+
 	ERR_BAD_BODY       = "Request body is malformed."
 	ERR_UNKNOWN_HOST   = "Unknown host."
 	ERR_GATEWAY_DOWN   = "motley_cue is not reachable."
 	ERR_UNAUTHORIZED   = "User is not authorized or suspended."
+	ERR_FORBIDDEN      = "Access to this host is denied by policy."
+	ERR_ENROLLMENT     = "Host enrollment is not permitted."
+	ERR_CLIENT_CERT    = "A valid client certificate is required."
+	ERR_RATE_LIMITED   = "Too many requests, try again later."
 	ERR_INTERNAL_ERROR = "Internal server error."
 )
 
@@ -37,8 +52,15 @@ type ApiResponseIndex struct {
 }
 
 type ApiResponseHost struct {
-	PublicKey string     `json:"publickey"`
-	Providers []Provider `json:"providers"`
+	// The active host CA public key
+	PublicKey string `json:"publickey"`
+	// All trusted host CA public keys, starting with the active one
+	PublicKeys []string `json:"publickeys"`
+	// Signatures of PublicKeys by the active key, see sshutil.SignCAKey()
+	PublicKeySignatures []string `json:"publickey_signatures"`
+	// Host CA public keys that are no longer trusted
+	RetiredPublicKeys []string   `json:"retired_publickeys"`
+	Providers         []Provider `json:"providers"`
 }
 
 type ApiResponseCertificate struct {
@@ -57,23 +79,204 @@ type UriHost struct {
 type FormHostCertificate struct {
 	Publickey string `json:"publickey" binding:"required"`
 	Token     string `json:"token" binding:"required"`
+	// Requested validity in seconds, which is limited to the validity
+	// configured for the host. Optional.
+	Lifetime uint64 `json:"lifetime,omitempty" example:"900"`
+	// Requested subset of the principals "oinit" and the username of the
+	// user. Optional, defaults to both.
+	Principals []string `json:"principals,omitempty" example:"oinit"`
 }
 
+type FormHostHostCertificate struct {
+	Publickey string `json:"publickey" binding:"required"`
+	Secret    string `json:"secret"`
+}
+
+// Error responds with the given status code and error message, which is also
+// recorded as reason in the audit event of the request, if any.
 func Error(c *gin.Context, code int, msg string) {
+	if event := audit.FromContext(c); event != nil {
+		event.SetReason(msg)
+	}
+
 	c.JSON(code, ApiResponseError{
 		Error: msg,
 	})
 }
 
-type customLog struct {
+var cache = util.NewTimedCache[string, []Provider]()
+
+var tokenVerifier = verifier.NewVerifier(VERIFIER_CACHE_DURATION)
+
+var limiter = util.NewRateLimiter()
+
+func init() {
+	metrics.RegisterCache("providers", cache.Stats)
+	metrics.RegisterCache("verifier", tokenVerifier.CacheStats)
 }
 
-// Custom log format that imitates gin's output
-func (writer customLog) Write(bytes []byte) (int, error) {
-	return fmt.Print("[API] " + time.Now().Format("2006/01/02 - 15:04:05") + " " + string(bytes))
+// newMotleyCueClient returns a client for the motley_cue instance at the given
+// URL, whose requests are recorded in the metrics.
+func newMotleyCueClient(url string) libmotleycue.Client {
+	return libmotleycue.NewClient(url).WithObserver(metrics.MotleyCueObserver(url))
 }
 
-var cache = util.NewTimedCache[string, []Provider]()
+// tokenIdentity returns the issuer and subject claims of the given access
+// token without verifying it, or empty strings for opaque tokens.
+func tokenIdentity(token string) (string, string) {
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return "", ""
+	}
+
+	issuer, _ := parsed.Claims.GetIssuer()
+	subject, _ := parsed.Claims.GetSubject()
+
+	return issuer, subject
+}
+
+// checkRateLimits counts a certificate request against the rate limits per
+// client IP address and per hostgroup, in that order. If a limit is exceeded,
+// its name and the duration until the next request is allowed are returned.
+func checkRateLimits(info config.HostInfo, clientIP string) (string, time.Duration) {
+	if ok, retryAfter := limiter.Allow("ip "+info.HostGroup+" "+clientIP, info.RateLimits.IP.Limit, info.RateLimits.IP.Period); !ok {
+		return "client IP", retryAfter
+	}
+
+	if ok, retryAfter := limiter.Allow("hostgroup "+info.HostGroup, info.RateLimits.HostGroup.Limit, info.RateLimits.HostGroup.Period); !ok {
+		return "hostgroup", retryAfter
+	}
+
+	return "", 0
+}
+
+// checkSubjectRateLimit counts a certificate request against the rate limit
+// per token subject, see checkRateLimits(). It must only be called once the
+// token was verified, as anyone could exhaust the limit of other users using
+// forged tokens otherwise. Requests with opaque tokens have no subject and
+// are not limited.
+func checkSubjectRateLimit(info config.HostInfo, issuer, subject string) (string, time.Duration) {
+	if subject == "" {
+		return "", 0
+	}
+
+	if ok, retryAfter := limiter.Allow("sub "+info.HostGroup+" "+issuer+" "+subject, info.RateLimits.Subject.Limit, info.RateLimits.Subject.Period); !ok {
+		return "subject", retryAfter
+	}
+
+	return "", 0
+}
+
+// rateLimited responds with 429 (too many requests) as the given rate limit
+// was exceeded.
+func rateLimited(c *gin.Context, event *audit.Event, info config.HostInfo, limit string, retryAfter time.Duration) {
+	metrics.AuthorizationFailure(info.HostGroup, metrics.REASON_RATE_LIMIT)
+	event.SetReason("rate limit per " + limit + " exceeded")
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	Error(c, http.StatusTooManyRequests, ERR_RATE_LIMITED)
+}
+
+// getProviders returns the OpenID Connect providers supported by the
+// motley_cue instance of the given host. Responses from motley_cue are cached
+// for the cache duration of the host.
+func getProviders(info config.HostInfo) ([]Provider, error) {
+	providers, ok := cache.Get(info.URL)
+	if ok {
+		return providers, nil
+	}
+
+	hostInfo, err := newMotleyCueClient(info.URL).GetInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	// Iterate OpsInfo instead of SupportedOPs to only add hosts for which
+	// scopes are defined. Validate that issuer is listed in SupportedOPs
+	// however.
+	for issuer, info := range hostInfo.OpsInfo {
+		if slices.Contains(hostInfo.SupportedOPs, issuer) {
+			providers = append(providers, Provider{
+				URL:    issuer,
+				Scopes: info.Scopes,
+			})
+		}
+	}
+
+	cache.Set(info.URL, providers, time.Duration(info.CacheDuration))
+
+	return providers, nil
+}
+
+// enrollmentAllowed returns whether a host certificate may be issued to the
+// client with the given IP address and enrollment secret. Host enrollment is
+// disabled unless a secret and/or a list of allowed networks is configured. If
+// both are configured, both must match.
+func enrollmentAllowed(info config.HostInfo, clientIP string, secret string) bool {
+	if info.EnrollmentSecret == "" && len(info.EnrollmentNetworks) == 0 {
+		return false
+	}
+
+	if info.EnrollmentSecret != "" &&
+		subtle.ConstantTimeCompare([]byte(info.EnrollmentSecret), []byte(secret)) != 1 {
+		return false
+	}
+
+	if len(info.EnrollmentNetworks) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range info.EnrollmentNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newLedgerEntry returns the ledger entry describing the given signed
+// certificate.
+func newLedgerEntry(certType string, host string, cert ssh.Certificate, signer ssh.Signer, sshUser, subject, issuer string) ledger.Entry {
+	entry := ledger.Entry{
+		Type:          certType,
+		Host:          host,
+		SSHUser:       sshUser,
+		Subject:       subject,
+		Issuer:        issuer,
+		Fingerprint:   ssh.FingerprintSHA256(cert.Key),
+		CAFingerprint: ssh.FingerprintSHA256(signer.PublicKey()),
+		ValidAfter:    time.Unix(int64(cert.ValidAfter), 0),
+	}
+
+	// Do not convert CertTimeInfinity, which doesn't fit into int64.
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		entry.ValidBefore = time.Unix(int64(cert.ValidBefore), 0)
+	}
+
+	return entry
+}
+
+// marshalPublicKey returns the given public key in authorized_keys format
+// without trailing line break.
+func marshalPublicKey(key ssh.PublicKey) string {
+	return strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n")
+}
+
+// marshalPublicKeys returns the given public keys in authorized_keys format.
+// An empty slice instead of nil is returned if there are no keys.
+func marshalPublicKeys(keys []ssh.PublicKey) []string {
+	marshalled := make([]string, len(keys))
+	for i, key := range keys {
+		marshalled[i] = marshalPublicKey(key)
+	}
+
+	return marshalled
+}
 
 // GetIndex is the handler for GET /
 //
@@ -122,32 +325,35 @@ func GetHost(c *gin.Context) {
 		return
 	}
 
-	providers, ok := cache.Get(info.URL)
-	if !ok {
-		hostInfo, err := libmotleycue.NewClient(info.URL).GetInfo()
-		if err != nil {
-			Error(c, http.StatusBadGateway, ERR_GATEWAY_DOWN)
-			return
-		}
+	providers, err := getProviders(info)
+	if err != nil {
+		Error(c, http.StatusBadGateway, ERR_GATEWAY_DOWN)
+		return
+	}
 
-		// Iterate OpsInfo instead of SupportedOPs to only add hosts for which
-		// scopes are defined. Validate that issuer is listed in SupportedOPs
-		// however.
-		for issuer, info := range hostInfo.OpsInfo {
-			if slices.Contains(hostInfo.SupportedOPs, issuer) {
-				providers = append(providers, Provider{
-					URL:    issuer,
-					Scopes: info.Scopes,
-				})
-			}
-		}
+	signer, err := ssh.NewSignerFromKey(info.HostCAPrivateKey)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
 
-		cache.Set(info.URL, providers, time.Duration(info.CacheDuration))
+	// Clients trust new keys of a key rotation if they are signed by the
+	// active key they pinned before
+	pubkeys := marshalPublicKeys(info.TrustedHostCAKeys())
+	signatures := make([]string, len(pubkeys))
+	for i, pubkey := range pubkeys {
+		if signatures[i], err = sshutil.SignCAKey(signer, pubkey); err != nil {
+			Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+			return
+		}
 	}
 
 	c.JSON(http.StatusOK, ApiResponseHost{
-		PublicKey: strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(info.HostCAPublicKey)), "\n"),
-		Providers: providers,
+		PublicKey:           marshalPublicKey(info.HostCAPublicKey),
+		PublicKeys:          pubkeys,
+		PublicKeySignatures: signatures,
+		RetiredPublicKeys:   marshalPublicKeys(info.HostCARetiredPublicKeys),
+		Providers:           providers,
 	})
 }
 
@@ -162,13 +368,15 @@ func GetHost(c *gin.Context) {
 //	@Success		201		{object}	ApiResponseCertificate
 //	@Failure		400		{object}	ApiResponseError
 //	@Failure		401		{object}	ApiResponseError
+//	@Failure		403		{object}	ApiResponseError
 //	@Failure		404		{object}	ApiResponseError
+//	@Failure		429		{object}	ApiResponseError
+//	@Header			429		{integer}	Retry-After	"Seconds until the next request is allowed"
 //	@Failure		500		{object}	ApiResponseError
 //	@Failure		502		{object}	ApiResponseError
 //	@Router			/{host}/certificate [post]
 func PostHostCertificate(c *gin.Context) {
-	log.SetFlags(0)
-	log.SetOutput(new(customLog))
+	event := audit.Start(c, audit.ACTION_USER_CERTIFICATE)
 
 	var host UriHost
 	var body FormHostCertificate
@@ -179,6 +387,7 @@ func PostHostCertificate(c *gin.Context) {
 	}
 
 	host.Host = strings.ToLower(host.Host)
+	event.Host = host.Host
 
 	conf, ok := c.MustGet("config").(config.Config)
 	if !ok {
@@ -186,54 +395,373 @@ func PostHostCertificate(c *gin.Context) {
 		return
 	}
 
+	ledgr, ok := c.MustGet("ledger").(*ledger.Ledger)
+	if !ok {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
+
 	info, err := conf.GetInfo(host.Host)
 	if err != nil {
 		Error(c, http.StatusNotFound, ERR_UNKNOWN_HOST)
 		return
 	}
 
+	event.HostGroup = info.HostGroup
+	event.Issuer, event.Subject = tokenIdentity(body.Token)
+
+	// Limit requests before contacting motley_cue. The limit per subject is
+	// only checked once the token was verified, see checkSubjectRateLimit().
+	if limit, retryAfter := checkRateLimits(info, c.ClientIP()); limit != "" {
+		rateLimited(c, event, info, limit, retryAfter)
+		return
+	}
+
 	pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(body.Publickey))
 	if err != nil {
 		Error(c, http.StatusBadRequest, ERR_BAD_BODY)
 		return
 	}
 
-	// Parse JWT without verifying it, as the signer key is unknown to the CA.
-	// motley_cue will verify the token instead.
-	token, _, err := new(jwt.Parser).ParseUnverified(body.Token, jwt.MapClaims{})
-	if err != nil {
-		Error(c, http.StatusBadRequest, ERR_BAD_BODY)
+	var claims jwt.MapClaims
+
+	if info.VerifyToken {
+		// Only accept tokens of providers supported by motley_cue.
+		providers, err := getProviders(info)
+		if err != nil {
+			event.SetReason("motley_cue: " + err.Error())
+			Error(c, http.StatusBadGateway, ERR_GATEWAY_DOWN)
+			return
+		}
+
+		issuers := make([]string, len(providers))
+		for i, provider := range providers {
+			issuers[i] = provider.URL
+		}
+
+		// Reject invalid and expired tokens before contacting motley_cue.
+		// Opaque tokens cannot be verified and are rejected as well.
+		if claims, err = tokenVerifier.Verify(body.Token, issuers, info.TokenAudience); err != nil {
+			metrics.AuthorizationFailure(info.HostGroup, metrics.REASON_INVALID_TOKEN)
+			event.SetReason("invalid token: " + err.Error())
+			Error(c, http.StatusUnauthorized, ERR_UNAUTHORIZED)
+			return
+		}
+
+		if limit, retryAfter := checkSubjectRateLimit(info, event.Issuer, event.Subject); limit != "" {
+			rateLimited(c, event, info, limit, retryAfter)
+			return
+		}
+	} else {
+		// Parse JWT without verifying it, as the signer key is unknown to the
+		// CA. motley_cue will verify the token instead.
+		if token, _, err := new(jwt.Parser).ParseUnverified(body.Token, jwt.MapClaims{}); err == nil {
+			claims = token.Claims.(jwt.MapClaims)
+		} else if info.CertDuration <= 0 {
+			// Opaque tokens can only be used with a fixed certificate
+			// validity, as their expiry is unknown.
+			Error(c, http.StatusBadRequest, ERR_BAD_BODY)
+			return
+		}
+	}
+
+	// Claims have been verified at this point, as a claim policy requires
+	// verify-token to be enabled.
+	if !checkClaimPolicy(info.ClaimPolicy, claims) {
+		metrics.AuthorizationFailure(info.HostGroup, metrics.REASON_POLICY)
+		Error(c, http.StatusForbidden, ERR_FORBIDDEN)
 		return
 	}
 
-	status, err := libmotleycue.NewClient(info.URL).GetUserDeploy(body.Token)
+	status, err := newMotleyCueClient(info.URL).GetUserDeploy(body.Token)
 	if err != nil || status.State != libmotleycue.StateDeployed {
 		// Either something went wrong with the HTTP request/deployment, the
 		// access token is not valid (e.g. expired) or the user is suspended.
+		if err != nil {
+			metrics.AuthorizationFailure(info.HostGroup, metrics.REASON_MOTLEY_CUE)
+			event.SetReason("motley_cue: " + err.Error())
+		} else {
+			metrics.AuthorizationFailure(info.HostGroup, string(status.State))
+			event.MotleyCueState = string(status.State)
+			event.SetReason("user is " + string(status.State))
+		}
+
 		Error(c, http.StatusUnauthorized, ERR_UNAUTHORIZED)
 		return
 	}
 
+	event.MotleyCueState = string(status.State)
+	event.SSHUser = status.Credentials.SSHUser
+
+	// Unverified tokens were authenticated by motley_cue now
+	if !info.VerifyToken {
+		if limit, retryAfter := checkSubjectRateLimit(info, event.Issuer, event.Subject); limit != "" {
+			rateLimited(c, event, info, limit, retryAfter)
+			return
+		}
+	}
+
 	certDuration := info.CertDuration
 	// If CertDuration is set to 0 or negative number, use the expiry date of the
 	// given token as "valid before" date.
 	if certDuration <= 0 {
-		if exp, err := token.Claims.GetExpirationTime(); err == nil {
+		if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
 			certDuration = int(time.Until(exp.Time).Seconds())
 		}
 	}
 
-	cert := generateUserCertificate(host.Host, pubkey, status.Credentials.SSHUser, uint64(certDuration))
+	// Tokens without exp claim or already expired ones (which motley_cue may
+	// accept, if the token is not verified by the CA) leave no validity.
+	if certDuration <= 0 {
+		event.SetReason("token has no or an expired exp claim")
+		Error(c, http.StatusBadRequest, ERR_BAD_BODY)
+		return
+	}
+
+	// A shorter validity may be requested, but never a longer one
+	if body.Lifetime > 0 && body.Lifetime < uint64(certDuration) {
+		certDuration = int(body.Lifetime)
+	}
+
+	principals, err := selectPrincipals(body.Principals, status.Credentials.SSHUser)
+	if err != nil {
+		event.SetReason(err.Error())
+		Error(c, http.StatusBadRequest, ERR_BAD_BODY)
+		return
+	}
 
 	signer, err := ssh.NewSignerFromKey(info.UserCAPrivateKey)
-	if err != nil || cert.SignCert(rand.Reader, signer) != nil {
-		Error(c, http.StatusUnauthorized, ERR_INTERNAL_ERROR)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
+
+	// The token has already been accepted by motley_cue, missing claims only
+	// result in empty fields in the ledger.
+	subject, _ := claims.GetSubject()
+	issuer, _ := claims.GetIssuer()
+
+	var cert ssh.Certificate
+
+	_, err = ledgr.Issue(func(serial uint64) (ledger.Entry, error) {
+		cert = generateUserCertificate(host.Host, pubkey, serial, status.Credentials.SSHUser, principals, uint64(certDuration), info.CertPermissions)
+
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			return ledger.Entry{}, err
+		}
+
+		return newLedgerEntry(ledger.TYPE_USER, host.Host, cert, signer, status.Credentials.SSHUser, subject, issuer), nil
+	})
+	if err != nil {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
 		return
 	}
 
-	log.Printf("Issued certificate '%s' valid until '%s'", ssh.FingerprintSHA256(cert.Key), time.Unix(int64(cert.ValidBefore-1), 0))
+	metrics.CertificateIssued(info.HostGroup, ledger.TYPE_USER)
+	event.SetCertificate(cert)
 
 	c.JSON(http.StatusCreated, ApiResponseCertificate{
 		Certificate: strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(&cert)), "\n"),
 	})
 }
+
+// PostHostHostCertificate is the handler for POST /:host/host-certificate
+//
+//	@Summary		Generate SSH host certificate
+//	@Description	Generate and return a new SSH host certificate for the given host public key. Requires the host to be listed explicitly (not only by a wildcard entry), the enrollment secret and/or a client address allowed by the hostgroup, and a client certificate if mutual TLS is enabled.
+//	@Accept			json
+//	@Produce		json
+//	@Param			host	path		string					true	"Host"	example("example.com")
+//	@Param			body	body		FormHostHostCertificate	true	"Host public key and enrollment secret"
+//	@Success		201		{object}	ApiResponseCertificate
+//	@Failure		400		{object}	ApiResponseError
+//	@Failure		403		{object}	ApiResponseError
+//	@Failure		404		{object}	ApiResponseError
+//	@Failure		500		{object}	ApiResponseError
+//	@Router			/{host}/host-certificate [post]
+func PostHostHostCertificate(c *gin.Context) {
+	event := audit.Start(c, audit.ACTION_HOST_CERTIFICATE)
+
+	var host UriHost
+	var body FormHostHostCertificate
+
+	if c.ShouldBindUri(&host) != nil || c.ShouldBindJSON(&body) != nil {
+		Error(c, http.StatusBadRequest, ERR_BAD_BODY)
+		return
+	}
+
+	host.Host = strings.ToLower(host.Host)
+	event.Host = host.Host
+
+	// Host certificates are always issued for a single host
+	if strings.Contains(host.Host, "*") {
+		Error(c, http.StatusBadRequest, ERR_BAD_BODY)
+		return
+	}
+
+	conf, ok := c.MustGet("config").(config.Config)
+	if !ok {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
+
+	ledgr, ok := c.MustGet("ledger").(*ledger.Ledger)
+	if !ok {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
+
+	info, err := conf.GetInfo(host.Host)
+	if err != nil {
+		Error(c, http.StatusNotFound, ERR_UNKNOWN_HOST)
+		return
+	}
+
+	event.HostGroup = info.HostGroup
+
+	// Wildcard entries would allow anyone knowing the enrollment secret of
+	// the hostgroup to obtain certificates for arbitrary names below them,
+	// therefore hosts must be listed explicitly.
+	if info.Name != host.Host {
+		event.SetReason("host only matches wildcard entry " + info.Name)
+		Error(c, http.StatusForbidden, ERR_ENROLLMENT)
+		return
+	}
+
+	if !enrollmentAllowed(info, c.ClientIP(), body.Secret) {
+		Error(c, http.StatusForbidden, ERR_ENROLLMENT)
+		return
+	}
+
+	pubkey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(body.Publickey))
+	if err != nil {
+		Error(c, http.StatusBadRequest, ERR_BAD_BODY)
+		return
+	}
+
+	// Refuse to sign certificates (instead of plain public keys)
+	if _, ok := pubkey.(*ssh.Certificate); ok {
+		Error(c, http.StatusBadRequest, ERR_BAD_BODY)
+		return
+	}
+
+	signer, err := ssh.NewSignerFromKey(info.HostCAPrivateKey)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
+
+	var cert ssh.Certificate
+
+	_, err = ledgr.Issue(func(serial uint64) (ledger.Entry, error) {
+		cert = generateHostCertificate(host.Host, pubkey, serial, uint64(info.HostCertDuration))
+
+		if err := cert.SignCert(rand.Reader, signer); err != nil {
+			return ledger.Entry{}, err
+		}
+
+		return newLedgerEntry(ledger.TYPE_HOST, host.Host, cert, signer, "", "", ""), nil
+	})
+	if err != nil {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
+
+	metrics.CertificateIssued(info.HostGroup, ledger.TYPE_HOST)
+	event.SetCertificate(cert)
+
+	c.JSON(http.StatusCreated, ApiResponseCertificate{
+		Certificate: strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(&cert)), "\n"),
+	})
+}
+
+// GetHostKRL is the handler for GET /:host/krl
+//
+//	@Summary		Get key revocation list
+//	@Description	Return the OpenSSH key revocation list (KRL) for all trusted user CA keys of the given host, suitable for the RevokedKeys option of sshd.
+//	@Produce		octet-stream
+//	@Produce		json
+//	@Param			host	path		string	true	"Host"	example("example.com")
+//	@Success		200		{file}		binary
+//	@Failure		400		{object}	ApiResponseError
+//	@Failure		404		{object}	ApiResponseError
+//	@Failure		500		{object}	ApiResponseError
+//	@Router			/{host}/krl [get]
+func GetHostKRL(c *gin.Context) {
+	var host UriHost
+
+	if c.ShouldBindUri(&host) != nil {
+		Error(c, http.StatusBadRequest, ERR_BAD_BODY)
+		return
+	}
+
+	host.Host = strings.ToLower(host.Host)
+
+	conf, ok := c.MustGet("config").(config.Config)
+	if !ok {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
+
+	ledgr, ok := c.MustGet("ledger").(*ledger.Ledger)
+	if !ok {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
+
+	info, err := conf.GetInfo(host.Host)
+	if err != nil {
+		Error(c, http.StatusNotFound, ERR_UNKNOWN_HOST)
+		return
+	}
+
+	revocations, version, err := ledgr.Revocations()
+	if err != nil {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/octet-stream", generateKRL(info.TrustedUserCAKeys(), revocations, version))
+}
+
+// GetHostUserCAKeys is the handler for GET /:host/user-ca-keys
+//
+//	@Summary		Get trusted user CA keys
+//	@Description	Return the trusted user CA public keys of the given host, one per line, suitable for the TrustedUserCAKeys option of sshd.
+//	@Produce		plain
+//	@Produce		json
+//	@Param			host	path		string	true	"Host"	example("example.com")
+//	@Success		200		{string}	string
+//	@Failure		400		{object}	ApiResponseError
+//	@Failure		404		{object}	ApiResponseError
+//	@Failure		500		{object}	ApiResponseError
+//	@Router			/{host}/user-ca-keys [get]
+func GetHostUserCAKeys(c *gin.Context) {
+	var host UriHost
+
+	if c.ShouldBindUri(&host) != nil {
+		Error(c, http.StatusBadRequest, ERR_BAD_BODY)
+		return
+	}
+
+	host.Host = strings.ToLower(host.Host)
+
+	conf, ok := c.MustGet("config").(config.Config)
+	if !ok {
+		Error(c, http.StatusInternalServerError, ERR_INTERNAL_ERROR)
+		return
+	}
+
+	info, err := conf.GetInfo(host.Host)
+	if err != nil {
+		Error(c, http.StatusNotFound, ERR_UNKNOWN_HOST)
+		return
+	}
+
+	var keys string
+	for _, key := range info.TrustedUserCAKeys() {
+		keys += string(ssh.MarshalAuthorizedKey(key))
+	}
+
+	c.String(http.StatusOK, keys)
+}
@@ -0,0 +1,270 @@
+// Package audit records requests for certificates to oinit-ca as structured
+// events, written as one JSON object per line.
+package audit
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Special values of the audit-log option, any other value is a file path
+	OUTPUT_STDOUT = "stdout"
+	OUTPUT_SYSLOG = "syslog"
+
+	ACTION_USER_CERTIFICATE = "user_certificate"
+	ACTION_HOST_CERTIFICATE = "host_certificate"
+
+	OUTCOME_ISSUED = "issued"
+	OUTCOME_DENIED = "denied"
+	OUTCOME_ERROR  = "error"
+
+	HEADER_REQUEST_ID = "X-Request-ID"
+
+	// Keys of values attached to the Gin context
+	KEY_REQUEST_ID = "request_id"
+	KEY_EVENT      = "audit"
+)
+
+// Request IDs set by a trusted reverse proxy are kept if they match this
+// pattern.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Event describes a single request for a certificate and its outcome. Fields
+// that are unknown at the time the request was denied are omitted.
+type Event struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Action    string    `json:"action"`
+	Outcome   string    `json:"outcome"`
+	Status    int       `json:"status"`
+	ClientIP  string    `json:"client_ip"`
+	Host      string    `json:"host,omitempty"`
+	HostGroup string    `json:"hostgroup,omitempty"`
+	// Issuer and subject of the access token. They are only verified if
+	// verify-token is enabled, motley_cue verifies the token otherwise.
+	Issuer         string `json:"iss,omitempty"`
+	Subject        string `json:"sub,omitempty"`
+	MotleyCueState string `json:"motley_cue_state,omitempty"`
+	SSHUser        string `json:"ssh_user,omitempty"`
+	// Details of the issued certificate
+	Serial      uint64     `json:"serial,omitempty"`
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	Principals  []string   `json:"principals,omitempty"`
+	ValidAfter  *time.Time `json:"valid_after,omitempty"`
+	ValidBefore *time.Time `json:"valid_before,omitempty"`
+	// Reason why the request was denied or failed
+	Reason string `json:"reason,omitempty"`
+}
+
+// SetCertificate records the details of the given issued certificate. The
+// validity end is omitted for certificates that are valid forever.
+func (e *Event) SetCertificate(cert ssh.Certificate) {
+	validAfter := time.Unix(int64(cert.ValidAfter), 0).UTC()
+
+	e.Serial = cert.Serial
+	e.Fingerprint = ssh.FingerprintSHA256(cert.Key)
+	e.Principals = cert.ValidPrincipals
+	e.ValidAfter = &validAfter
+
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		validBefore := time.Unix(int64(cert.ValidBefore), 0).UTC()
+		e.ValidBefore = &validBefore
+	}
+}
+
+// SetReason records the reason why the request was denied, unless a more
+// specific reason was recorded before.
+func (e *Event) SetReason(reason string) {
+	if e.Reason == "" {
+		e.Reason = reason
+	}
+}
+
+// Logger writes events to an output. It is safe for concurrent use.
+type Logger struct {
+	mu     sync.Mutex
+	writer io.Writer
+	// Path of the file events are written to, if any, see Reopen()
+	path string
+}
+
+// NewLogger returns a logger writing events to the given writer.
+func NewLogger(writer io.Writer) *Logger {
+	return &Logger{writer: writer}
+}
+
+// Open returns a logger writing events to the given output, which is either
+// OUTPUT_STDOUT, OUTPUT_SYSLOG or the path of a file that events are appended
+// to.
+func Open(output string) (*Logger, error) {
+	switch output {
+	case OUTPUT_STDOUT:
+		return NewLogger(os.Stdout), nil
+	case OUTPUT_SYSLOG:
+		writer, err := openSyslog()
+		if err != nil {
+			return nil, err
+		}
+
+		return NewLogger(writer), nil
+	default:
+		file, err := openFile(output)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Logger{writer: file, path: output}, nil
+	}
+}
+
+func openFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+}
+
+// Reopen opens the file events are written to again, so that a rotated file
+// is replaced by a new one. Other outputs are not affected. The current file
+// is kept if opening fails.
+func (l *Logger) Reopen() error {
+	if l.path == "" {
+		return nil
+	}
+
+	file, err := openFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if closer, ok := l.writer.(io.Closer); ok {
+		closer.Close()
+	}
+
+	l.writer = file
+
+	return nil
+}
+
+// Log writes the given event as a single line of JSON.
+func (l *Logger) Log(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.writer.Write(append(line, '\n'))
+
+	return err
+}
+
+// trusted returns whether the given IP address is in one of the given
+// networks.
+func trusted(ip string, networks []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range networks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newRequestID returns the given request ID if it was set by a trusted proxy
+// and is valid, or a new random one otherwise. IDs set by other clients are
+// ignored, so that they cannot make events appear to belong to other requests.
+func newRequestID(requested string, fromTrustedProxy bool) string {
+	if fromTrustedProxy && requestIDPattern.MatchString(requested) {
+		return requested
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// Middleware returns a middleware function that assigns an ID to every request,
+// which is returned in the X-Request-ID header. IDs are only taken from the
+// request if it was sent by one of the given trusted proxies. Handlers record
+// events using Start(), which are written to the given logger once the
+// request is finished.
+func Middleware(logger *Logger, trustedProxies []*net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := newRequestID(c.GetHeader(HEADER_REQUEST_ID), trusted(c.RemoteIP(), trustedProxies))
+
+		c.Set(KEY_REQUEST_ID, id)
+		c.Header(HEADER_REQUEST_ID, id)
+
+		c.Next()
+
+		event := FromContext(c)
+		if event == nil {
+			return
+		}
+
+		event.RequestID = id
+		event.ClientIP = c.ClientIP()
+		event.Status = c.Writer.Status()
+
+		switch {
+		case event.Status < http.StatusBadRequest:
+			event.Outcome = OUTCOME_ISSUED
+		case event.Status < http.StatusInternalServerError:
+			event.Outcome = OUTCOME_DENIED
+		default:
+			event.Outcome = OUTCOME_ERROR
+		}
+
+		if err := logger.Log(*event); err != nil {
+			log.Println("Error while writing audit log: " + err.Error())
+		}
+	}
+}
+
+// Start attaches a new event for the given action to the Gin context and
+// returns it, so that the handler can fill in the details.
+func Start(c *gin.Context, action string) *Event {
+	event := &Event{
+		Time:   time.Now().UTC(),
+		Action: action,
+	}
+
+	c.Set(KEY_EVENT, event)
+
+	return event
+}
+
+// FromContext returns the event attached to the Gin context, or nil if the
+// request is not audited.
+func FromContext(c *gin.Context) *Event {
+	event, ok := c.Value(KEY_EVENT).(*Event)
+	if !ok {
+		return nil
+	}
+
+	return event
+}
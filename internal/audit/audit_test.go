@@ -0,0 +1,117 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var buf bytes.Buffer
+
+	// Requests of httptest are sent from 192.0.2.1
+	_, proxies, _ := net.ParseCIDR("192.0.2.0/24")
+
+	router := gin.New()
+	router.Use(Middleware(NewLogger(&buf), []*net.IPNet{proxies}))
+	router.GET("/denied", func(c *gin.Context) {
+		event := Start(c, ACTION_USER_CERTIFICATE)
+		event.Host = "login.example.com"
+		event.SetReason("user is suspended")
+		event.SetReason("ignored")
+		c.Status(http.StatusUnauthorized)
+	})
+	router.GET("/unaudited", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	t.Run("Event", func(t *testing.T) {
+		buf.Reset()
+
+		req := httptest.NewRequest(http.MethodGet, "/denied", nil)
+		req.Header.Set(HEADER_REQUEST_ID, "abc-123")
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+
+		assert.Equal(t, "abc-123", res.Header().Get(HEADER_REQUEST_ID))
+
+		var event Event
+		assert.Nil(t, json.Unmarshal(buf.Bytes(), &event))
+		assert.Equal(t, "abc-123", event.RequestID)
+		assert.Equal(t, OUTCOME_DENIED, event.Outcome)
+		assert.Equal(t, http.StatusUnauthorized, event.Status)
+		assert.Equal(t, "login.example.com", event.Host)
+		assert.Equal(t, "user is suspended", event.Reason)
+	})
+
+	t.Run("Generated request ID", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/unaudited", nil)
+		req.Header.Set(HEADER_REQUEST_ID, "invalid id\n")
+		res := httptest.NewRecorder()
+		buf.Reset()
+		router.ServeHTTP(res, req)
+
+		assert.Len(t, res.Header().Get(HEADER_REQUEST_ID), 32)
+		assert.Zero(t, buf.Len())
+
+		req.Header.Set(HEADER_REQUEST_ID, strings.Repeat("a", 65))
+		res = httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+
+		assert.Len(t, res.Header().Get(HEADER_REQUEST_ID), 32)
+	})
+
+	t.Run("Untrusted client", func(t *testing.T) {
+		untrusted := gin.New()
+		untrusted.Use(Middleware(NewLogger(&buf), nil))
+		untrusted.GET("/unaudited", func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/unaudited", nil)
+		req.Header.Set(HEADER_REQUEST_ID, "abc-123")
+		res := httptest.NewRecorder()
+		untrusted.ServeHTTP(res, req)
+
+		assert.Len(t, res.Header().Get(HEADER_REQUEST_ID), 32)
+	})
+}
+
+func TestLogger_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	logger, err := Open(path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, logger.Log(Event{RequestID: "1"}))
+
+	// Rotate the file
+	assert.NoError(t, os.Rename(path, path+".1"))
+	assert.NoError(t, logger.Log(Event{RequestID: "2"}))
+	assert.NoError(t, logger.Reopen())
+	assert.NoError(t, logger.Log(Event{RequestID: "3"}))
+
+	rotated, err := os.ReadFile(path + ".1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(rotated), "\n"))
+
+	current, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(current), `"request_id":"3"`)
+	assert.Equal(t, 1, strings.Count(string(current), "\n"))
+
+	// Other outputs are not reopened
+	assert.NoError(t, NewLogger(io.Discard).Reopen())
+}
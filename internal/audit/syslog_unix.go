@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package audit
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to the local syslog daemon, which is journald on
+// systems using systemd.
+func openSyslog() (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "oinit-ca")
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package audit
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog fails, as syslog is not available on Windows.
+func openSyslog() (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on windows")
+}
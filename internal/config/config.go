@@ -1,61 +1,197 @@
 package config
 
 import (
+	"bytes"
 	"errors"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/lbrocke/oinit/internal/util"
 
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slices"
 	"gopkg.in/ini.v1"
 )
 
 const (
 	ERR_HOST_NOT_FOUND = "host not found in config"
+
+	DEFAULT_DATABASE = "/var/lib/oinit-ca/ledger.db"
+
+	// Audit events are written to stdout by default, see audit.Open()
+	DEFAULT_AUDIT_LOG = "stdout"
+
+	// Prefix of options that require token claims to have certain values,
+	// e.g. "claim.eduperson_entitlement = urn:example:group:a".
+	CLAIM_PREFIX = "claim."
 )
 
+// DEFAULT_CERT_EXTENSIONS are the extensions of user certificates if not
+// configured otherwise.
+var DEFAULT_CERT_EXTENSIONS = []string{"permit-agent-forwarding", "permit-pty"}
+
+// certExtensions contains all extensions supported by OpenSSH, see
+// PROTOCOL.certkeys.
+var certExtensions = []string{
+	"no-touch-required",
+	"permit-X11-forwarding",
+	"permit-agent-forwarding",
+	"permit-port-forwarding",
+	"permit-pty",
+	"permit-user-rc",
+}
+
+// options contains all keys of DefaultOptions, which are therefore not
+// treated as hosts when found in a hostgroup section.
+var options = []string{
+	"host-ca-privkey",
+	"host-ca-pubkey",
+	"user-ca-privkey",
+	"user-ca-pubkey",
+	"host-ca-next-pubkey",
+	"host-ca-retired-pubkey",
+	"user-ca-next-pubkey",
+	"user-ca-retired-pubkey",
+	"cert-validity",
+	"cache-duration",
+	"host-cert-validity",
+	"host-enrollment-secret",
+	"host-enrollment-allow",
+	"verify-token",
+	"token-audience",
+	"cert-extensions",
+	"cert-source-address",
+	"rate-limit-ip",
+	"rate-limit-subject",
+	"rate-limit-hostgroup",
+}
+
+// GlobalOptions can only be set in the default section.
+type GlobalOptions struct {
+	Database string `ini:"database"`
+	AuditLog string `ini:"audit-log"`
+	// Addresses and networks of reverse proxies that may set the client IP
+	// address using X-Forwarded-For. No proxy is trusted by default.
+	TrustedProxies []string `ini:"trusted-proxies" delim:","`
+	// Certificate chain and private key (PEM) the API is served with, and CA
+	// certificates (PEM) that client certificates are verified against.
+	PathTLSCertificate string `ini:"tls-cert"`
+	PathTLSKey         string `ini:"tls-key"`
+	PathTLSClientCA    string `ini:"tls-client-ca"`
+}
+
 type DefaultOptions struct {
 	PathHostCAPrivateKey string `ini:"host-ca-privkey"`
 	PathHostCAPublicKey  string `ini:"host-ca-pubkey"`
 	PathUserCAPrivateKey string `ini:"user-ca-privkey"`
 	PathUserCAPublicKey  string `ini:"user-ca-pubkey"`
-	CertValidity         string `ini:"cert-validity"` // allows non-int values, parsed manually
-	CacheDuration        int    `ini:"cache-duration"`
+	// Public keys trusted in addition to the active key and public keys no
+	// longer trusted, used to rotate the CA keys.
+	PathsHostCANextPublicKeys    []string `ini:"host-ca-next-pubkey" delim:","`
+	PathsHostCARetiredPublicKeys []string `ini:"host-ca-retired-pubkey" delim:","`
+	PathsUserCANextPublicKeys    []string `ini:"user-ca-next-pubkey" delim:","`
+	PathsUserCARetiredPublicKeys []string `ini:"user-ca-retired-pubkey" delim:","`
+	CertValidity                 string   `ini:"cert-validity"`      // allows non-int values, parsed manually
+	HostCertValidity             string   `ini:"host-cert-validity"` // allows non-int values, parsed manually
+	CacheDuration                int      `ini:"cache-duration"`
+	EnrollmentSecret             string   `ini:"host-enrollment-secret"`
+	EnrollmentAllow              []string `ini:"host-enrollment-allow" delim:","`
+	VerifyToken                  bool     `ini:"verify-token"`
+	TokenAudience                string   `ini:"token-audience"`
+	CertExtensions               []string `ini:"cert-extensions" delim:","`
+	CertSourceAddress            string   `ini:"cert-source-address"`
+	RateLimitIP                  string   `ini:"rate-limit-ip"`        // parsed manually, see parseRateLimits
+	RateLimitSubject             string   `ini:"rate-limit-subject"`   // parsed manually, see parseRateLimits
+	RateLimitHostGroup           string   `ini:"rate-limit-hostgroup"` // parsed manually, see parseRateLimits
 }
 
+// RateLimit allows up to Limit requests per Period. A zero limit means no
+// limit.
+type RateLimit struct {
+	Limit  int
+	Period time.Duration
+}
+
+// RateLimits contains the limits of certificate requests per client IP
+// address, per token subject and per hostgroup.
+type RateLimits struct {
+	IP        RateLimit
+	Subject   RateLimit
+	HostGroup RateLimit
+}
+
+// Keys contains the active CA key pairs, which are used for signing, as well
+// as the public keys of rotated CA keys.
 type Keys struct {
-	HostCAPrivateKey interface{}
-	HostCAPublicKey  ssh.PublicKey
-	UserCAPrivateKey interface{}
-	UserCAPublicKey  ssh.PublicKey
+	HostCAPrivateKey        interface{}
+	HostCAPublicKey         ssh.PublicKey
+	HostCANextPublicKeys    []ssh.PublicKey
+	HostCARetiredPublicKeys []ssh.PublicKey
+	UserCAPrivateKey        interface{}
+	UserCAPublicKey         ssh.PublicKey
+	UserCANextPublicKeys    []ssh.PublicKey
+	UserCARetiredPublicKeys []ssh.PublicKey
+}
+
+// TrustedHostCAKeys returns the host CA public keys that clients should
+// trust, starting with the active key.
+func (k Keys) TrustedHostCAKeys() []ssh.PublicKey {
+	return append([]ssh.PublicKey{k.HostCAPublicKey}, k.HostCANextPublicKeys...)
+}
+
+// TrustedUserCAKeys returns the user CA public keys that OpenSSH servers
+// should trust, starting with the active key.
+func (k Keys) TrustedUserCAKeys() []ssh.PublicKey {
+	return append([]ssh.PublicKey{k.UserCAPublicKey}, k.UserCANextPublicKeys...)
 }
 
 type HostGroup struct {
 	DefaultOptions
 	Keys
-	CertDuration int
-	Name         string
-	Hosts        map[string]string
+	CertDuration       int
+	HostCertDuration   int
+	EnrollmentNetworks []*net.IPNet
+	CertPermissions    ssh.Permissions
+	ClaimPolicy        map[string][]string
+	RateLimits         RateLimits
+	Name               string
+	Hosts              map[string]string
 }
 
 type Config struct {
-	HostGroups []HostGroup
+	GlobalOptions
+	// TrustedProxies parsed into networks
+	TrustedProxyNetworks []*net.IPNet
+	TLS                  TLSCredentials
+	HostGroups           []HostGroup
 }
 
 // HostInfo is returned from the GetInfo function
 type HostInfo struct {
-	Name          string
-	URL           string
-	CertDuration  int
-	CacheDuration int
+	Name               string
+	HostGroup          string
+	URL                string
+	CertDuration       int
+	HostCertDuration   int
+	CacheDuration      int
+	EnrollmentSecret   string
+	EnrollmentNetworks []*net.IPNet
+	VerifyToken        bool
+	TokenAudience      string
+	CertPermissions    ssh.Permissions
+	ClaimPolicy        map[string][]string
+	RateLimits         RateLimits
 	Keys
 }
 
 func Load(path string) (Config, error) {
 	var conf Config
-	var defOptions DefaultOptions
+	var defOptions = DefaultOptions{
+		CertExtensions: DEFAULT_CERT_EXTENSIONS,
+	}
 
 	cfg, err := ini.Load(path)
 	if err != nil {
@@ -66,6 +202,26 @@ func Load(path string) (Config, error) {
 		return conf, err
 	}
 
+	if err := cfg.MapTo(&conf.GlobalOptions); err != nil {
+		return conf, err
+	}
+
+	if conf.Database == "" {
+		conf.Database = DEFAULT_DATABASE
+	}
+
+	if conf.AuditLog == "" {
+		conf.AuditLog = DEFAULT_AUDIT_LOG
+	}
+
+	conf.TrustedProxies = trimList(conf.TrustedProxies)
+
+	if conf.TrustedProxyNetworks, err = parseNetworks(conf.TrustedProxies); err != nil {
+		return conf, errors.New("could not parse trusted proxies: " + err.Error())
+	}
+
+	defPolicy := parseClaimPolicy(cfg.Section(ini.DefaultSection).KeysHash(), nil)
+
 	// ini doesn't support mapping to map[string]string, do it manually
 	for _, hostgroup := range cfg.Sections() {
 		if hostgroup.Name() == ini.DefaultSection {
@@ -73,14 +229,8 @@ func Load(path string) (Config, error) {
 		}
 
 		// prefill with global values
-		opts := &DefaultOptions{
-			PathHostCAPrivateKey: defOptions.PathHostCAPrivateKey,
-			PathHostCAPublicKey:  defOptions.PathHostCAPublicKey,
-			PathUserCAPrivateKey: defOptions.PathUserCAPrivateKey,
-			PathUserCAPublicKey:  defOptions.PathUserCAPublicKey,
-			CertValidity:         defOptions.CertValidity,
-			CacheDuration:        defOptions.CacheDuration,
-		}
+		opts := new(DefaultOptions)
+		*opts = defOptions
 
 		if err := hostgroup.MapTo(opts); err != nil {
 			return conf, err
@@ -89,14 +239,12 @@ func Load(path string) (Config, error) {
 		hg := &HostGroup{
 			DefaultOptions: *opts,
 			Name:           hostgroup.Name(),
-			Hosts:          hostgroup.KeysHash(),
+			ClaimPolicy:    parseClaimPolicy(hostgroup.KeysHash(), defPolicy),
 		}
 
 		hosts := make(map[string]string)
 		for key, val := range hostgroup.KeysHash() {
-			if key == "host-ca-privkey" || key == "host-ca-pubkey" ||
-				key == "user-ca-privkey" || key == "user-ca-pubkey" ||
-				key == "cert-validity" || key == "cache-duration" {
+			if slices.Contains(options, key) || strings.HasPrefix(key, CLAIM_PREFIX) {
 				continue
 			}
 
@@ -115,17 +263,39 @@ func Load(path string) (Config, error) {
 			return conf, errors.New("missing option in hostgroup " + hg.Name)
 		}
 
+		// Claims of unverified tokens can be forged by the user and must not
+		// be used for authorization.
+		if len(hg.ClaimPolicy) > 0 && !hg.VerifyToken {
+			return conf, errors.New("claim policy requires verify-token in hostgroup " + hg.Name)
+		}
+
 		conf.HostGroups = append(conf.HostGroups, *hg)
 	}
 
-	if loadKeys(&conf) != nil {
-		return conf, errors.New("could not open and parse keys")
+	if err := loadTLS(&conf); err != nil {
+		return conf, errors.New("could not load TLS certificates: " + err.Error())
+	}
+
+	if err := loadKeys(&conf); err != nil {
+		return conf, errors.New("could not open and parse keys: " + err.Error())
 	}
 
 	if parseCertValidity(&conf) != nil {
 		return conf, errors.New("could not parse certificate validities")
 	}
 
+	if parseEnrollmentAllow(&conf) != nil {
+		return conf, errors.New("could not parse host enrollment networks")
+	}
+
+	if err := parseCertPermissions(&conf); err != nil {
+		return conf, errors.New("could not parse certificate permissions: " + err.Error())
+	}
+
+	if err := parseRateLimits(&conf); err != nil {
+		return conf, errors.New("could not parse rate limits: " + err.Error())
+	}
+
 	return conf, nil
 }
 
@@ -133,18 +303,34 @@ func loadKeys(conf *Config) error {
 	var uniqPubKeys = make(map[string]ssh.PublicKey)
 	var uniqPrivKeys = make(map[string]interface{})
 
-	for i, group := range conf.HostGroups {
-		for _, path := range []string{group.PathHostCAPublicKey, group.PathUserCAPublicKey} {
-			if _, ok := uniqPubKeys[path]; ok {
+	// loadPublicKeys parses the public keys of the given paths, each of which
+	// is only parsed once.
+	loadPublicKeys := func(paths []string) ([]ssh.PublicKey, error) {
+		var keys []ssh.PublicKey
+
+		for _, path := range paths {
+			if path = strings.TrimSpace(path); path == "" {
 				continue
 			}
 
-			pk, err := parsePublicKeyFile(path)
-			if err != nil {
-				return err
+			if _, ok := uniqPubKeys[path]; !ok {
+				pk, err := parsePublicKeyFile(path)
+				if err != nil {
+					return nil, err
+				}
+
+				uniqPubKeys[path] = pk
 			}
 
-			uniqPubKeys[path] = pk
+			keys = append(keys, uniqPubKeys[path])
+		}
+
+		return keys, nil
+	}
+
+	for i, group := range conf.HostGroups {
+		if _, err := loadPublicKeys([]string{group.PathHostCAPublicKey, group.PathUserCAPublicKey}); err != nil {
+			return err
 		}
 
 		for _, path := range []string{group.PathHostCAPrivateKey, group.PathUserCAPrivateKey} {
@@ -160,15 +346,55 @@ func loadKeys(conf *Config) error {
 			uniqPrivKeys[path] = pk
 		}
 
-		conf.HostGroups[i].Keys.HostCAPublicKey = uniqPubKeys[group.PathHostCAPublicKey]
-		conf.HostGroups[i].Keys.UserCAPublicKey = uniqPubKeys[group.PathUserCAPublicKey]
-		conf.HostGroups[i].Keys.HostCAPrivateKey = uniqPrivKeys[group.PathHostCAPrivateKey]
-		conf.HostGroups[i].Keys.UserCAPrivateKey = uniqPrivKeys[group.PathUserCAPrivateKey]
+		keys := &conf.HostGroups[i].Keys
+
+		keys.HostCAPublicKey = uniqPubKeys[group.PathHostCAPublicKey]
+		keys.UserCAPublicKey = uniqPubKeys[group.PathUserCAPublicKey]
+		keys.HostCAPrivateKey = uniqPrivKeys[group.PathHostCAPrivateKey]
+		keys.UserCAPrivateKey = uniqPrivKeys[group.PathUserCAPrivateKey]
+
+		var err error
+
+		if keys.HostCANextPublicKeys, err = loadPublicKeys(group.PathsHostCANextPublicKeys); err != nil {
+			return err
+		}
+
+		if keys.HostCARetiredPublicKeys, err = loadPublicKeys(group.PathsHostCARetiredPublicKeys); err != nil {
+			return err
+		}
+
+		if keys.UserCANextPublicKeys, err = loadPublicKeys(group.PathsUserCANextPublicKeys); err != nil {
+			return err
+		}
+
+		if keys.UserCARetiredPublicKeys, err = loadPublicKeys(group.PathsUserCARetiredPublicKeys); err != nil {
+			return err
+		}
+
+		// A retired key must not be trusted at the same time
+		if containsKey(keys.TrustedHostCAKeys(), keys.HostCARetiredPublicKeys) ||
+			containsKey(keys.TrustedUserCAKeys(), keys.UserCARetiredPublicKeys) {
+			return errors.New("retired key is still in use in hostgroup " + group.Name)
+		}
 	}
 
 	return nil
 }
 
+// containsKey returns whether any of the given keys is contained in the given
+// list of keys.
+func containsKey(list []ssh.PublicKey, keys []ssh.PublicKey) bool {
+	for _, key := range keys {
+		for _, listKey := range list {
+			if bytes.Equal(key.Marshal(), listKey.Marshal()) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func parseCertValidity(conf *Config) error {
 	for i, group := range conf.HostGroups {
 		validity := group.CertValidity
@@ -186,6 +412,229 @@ func parseCertValidity(conf *Config) error {
 		conf.HostGroups[i].CertDuration = dur
 	}
 
+	for i, group := range conf.HostGroups {
+		validity := group.HostCertValidity
+
+		// Host certificates are valid forever by default, which is what
+		// ssh-keygen does when no validity interval is given.
+		if validity == "" || validity == "forever" {
+			conf.HostGroups[i].HostCertDuration = 0
+			continue
+		}
+
+		dur, err := strconv.Atoi(validity)
+		if err != nil || dur <= 0 {
+			return errors.New("invalid host certificate validity")
+		}
+
+		conf.HostGroups[i].HostCertDuration = dur
+	}
+
+	return nil
+}
+
+// parseRateLimit parses a rate limit of the form "<limit>/<period>", such as
+// "10/1m" for 10 requests per minute. An empty value means no limit.
+func parseRateLimit(value string) (RateLimit, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return RateLimit{}, nil
+	}
+
+	limit, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, errors.New("expected <limit>/<period>: " + value)
+	}
+
+	l, err := strconv.Atoi(strings.TrimSpace(limit))
+	if err != nil || l <= 0 {
+		return RateLimit{}, errors.New("invalid limit: " + value)
+	}
+
+	p, err := time.ParseDuration(strings.TrimSpace(period))
+	if err != nil || p <= 0 {
+		return RateLimit{}, errors.New("invalid period: " + value)
+	}
+
+	return RateLimit{Limit: l, Period: p}, nil
+}
+
+// parseRateLimits parses the rate limits of certificate requests.
+func parseRateLimits(conf *Config) error {
+	for i, group := range conf.HostGroups {
+		limits := &conf.HostGroups[i].RateLimits
+
+		var err error
+
+		if limits.IP, err = parseRateLimit(group.RateLimitIP); err != nil {
+			return err
+		}
+
+		if limits.Subject, err = parseRateLimit(group.RateLimitSubject); err != nil {
+			return err
+		}
+
+		if limits.HostGroup, err = parseRateLimit(group.RateLimitHostGroup); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// trimList returns the non-empty entries of the given list without
+// surrounding whitespace, or nil if there are none.
+func trimList(list []string) []string {
+	var trimmed []string
+
+	for _, entry := range list {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			trimmed = append(trimmed, entry)
+		}
+	}
+
+	return trimmed
+}
+
+// parseNetworks parses the given list of IP addresses and networks (in CIDR
+// notation). Empty entries are skipped.
+func parseNetworks(entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// Single IP addresses are treated as /32 (or /128) networks
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New("invalid address " + entry)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// parseEnrollmentAllow parses the list of IP addresses and networks (in CIDR
+// notation) that are allowed to request host certificates.
+func parseEnrollmentAllow(conf *Config) error {
+	for i, group := range conf.HostGroups {
+		networks, err := parseNetworks(group.EnrollmentAllow)
+		if err != nil {
+			return err
+		}
+
+		conf.HostGroups[i].EnrollmentNetworks = networks
+	}
+
+	return nil
+}
+
+// parseClaimPolicy returns the claims and their accepted values found in the
+// given section keys, merged with the given inherited policy. Claims of the
+// section replace inherited claims of the same name.
+func parseClaimPolicy(keys map[string]string, inherited map[string][]string) map[string][]string {
+	policy := make(map[string][]string)
+
+	for claim, values := range inherited {
+		policy[claim] = values
+	}
+
+	for key, val := range keys {
+		claim, found := strings.CutPrefix(key, CLAIM_PREFIX)
+		if !found || claim == "" {
+			continue
+		}
+
+		var values []string
+		for _, value := range strings.Split(val, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+
+		// An empty value removes an inherited claim
+		if len(values) == 0 {
+			delete(policy, claim)
+			continue
+		}
+
+		policy[claim] = values
+	}
+
+	return policy
+}
+
+// parseCertPermissions parses the extensions and critical options of user
+// certificates. The force-command critical option is not configurable, as it
+// is required for oinit-switch and therefore added when generating the
+// certificate.
+func parseCertPermissions(conf *Config) error {
+	for i, group := range conf.HostGroups {
+		perms := ssh.Permissions{
+			CriticalOptions: make(map[string]string),
+			Extensions:      make(map[string]string),
+		}
+
+		for _, ext := range group.CertExtensions {
+			// "none" is used to permit no extensions at all, as empty values
+			// are not distinguishable from missing ones.
+			ext = strings.TrimSpace(ext)
+			if ext == "" || ext == "none" {
+				continue
+			}
+
+			if !slices.Contains(certExtensions, ext) {
+				return errors.New("unknown extension " + ext)
+			}
+
+			perms.Extensions[ext] = ""
+		}
+
+		if group.CertSourceAddress != "" {
+			var addresses []string
+
+			for _, entry := range strings.Split(group.CertSourceAddress, ",") {
+				entry = strings.TrimSpace(entry)
+				if entry == "" {
+					continue
+				}
+
+				if _, _, err := net.ParseCIDR(entry); err != nil && net.ParseIP(entry) == nil {
+					return errors.New("invalid source address " + entry)
+				}
+
+				addresses = append(addresses, entry)
+			}
+
+			if len(addresses) > 0 {
+				perms.CriticalOptions["source-address"] = strings.Join(addresses, ",")
+			}
+		}
+
+		conf.HostGroups[i].CertPermissions = perms
+	}
+
 	return nil
 }
 
@@ -217,20 +666,36 @@ func parsePrivateKeyFile(path string) (interface{}, error) {
 	return pk, nil
 }
 
+// GetInfo returns the information about the given host. Hosts listed
+// explicitly take precedence over wildcard entries, so that the result does not
+// depend on the order of entries.
 func (c Config) GetInfo(host string) (HostInfo, error) {
 	host = strings.ToLower(host)
 
-	for _, hostGroup := range c.HostGroups {
-		for hostName, caURL := range hostGroup.Hosts {
-			hostName = strings.ToLower(hostName)
+	for _, wildcard := range []bool{false, true} {
+		for _, hostGroup := range c.HostGroups {
+			for hostName, caURL := range hostGroup.Hosts {
+				hostName = strings.ToLower(hostName)
+
+				if strings.HasPrefix(hostName, "*.") != wildcard || !util.MatchesHost(host, "", hostName, "") {
+					continue
+				}
 
-			if util.MatchesHost(host, "", hostName, "") {
 				return HostInfo{
-					Name:          hostName,
-					URL:           caURL,
-					CertDuration:  hostGroup.CertDuration,
-					CacheDuration: hostGroup.CacheDuration,
-					Keys:          hostGroup.Keys,
+					Name:               hostName,
+					HostGroup:          hostGroup.Name,
+					URL:                caURL,
+					CertDuration:       hostGroup.CertDuration,
+					HostCertDuration:   hostGroup.HostCertDuration,
+					CacheDuration:      hostGroup.CacheDuration,
+					EnrollmentSecret:   hostGroup.EnrollmentSecret,
+					EnrollmentNetworks: hostGroup.EnrollmentNetworks,
+					VerifyToken:        hostGroup.VerifyToken,
+					TokenAudience:      hostGroup.TokenAudience,
+					CertPermissions:    hostGroup.CertPermissions,
+					ClaimPolicy:        hostGroup.ClaimPolicy,
+					RateLimits:         hostGroup.RateLimits,
+					Keys:               hostGroup.Keys,
 				}, nil
 			}
 		}
@@ -0,0 +1,266 @@
+package config
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := parseRateLimit("")
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimit{}, limit)
+
+	limit, err = parseRateLimit(" 10 / 1m ")
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimit{Limit: 10, Period: time.Minute}, limit)
+
+	for _, invalid := range []string{"10", "0/1m", "-1/1m", "10/0s", "10/minute", "ten/1m"} {
+		_, err = parseRateLimit(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// writeConfig writes a config file with default keys, followed by the given
+// options, and returns its path.
+func writeConfig(t *testing.T, options string) string {
+	dir := t.TempDir()
+	writeKeyPair(t, dir, "host-ca")
+	writeKeyPair(t, dir, "user-ca")
+
+	path := filepath.Join(dir, "config.ini")
+	assert.NoError(t, os.WriteFile(path, []byte(
+		"host-ca-privkey = "+filepath.Join(dir, "host-ca")+"\n"+
+			"host-ca-pubkey  = "+filepath.Join(dir, "host-ca.pub")+"\n"+
+			"user-ca-privkey = "+filepath.Join(dir, "user-ca")+"\n"+
+			"user-ca-pubkey  = "+filepath.Join(dir, "user-ca.pub")+"\n"+
+			"cert-validity   = 3600\n"+
+			"cache-duration  = 600\n"+
+			options), 0600))
+
+	return path
+}
+
+func TestParseClaimPolicy(t *testing.T) {
+	inherited := map[string][]string{
+		"acr":    {"https://refeds.org/profile/mfa"},
+		"groups": {"admins"},
+	}
+
+	tests := []struct {
+		name      string
+		keys      map[string]string
+		inherited map[string][]string
+		policy    map[string][]string
+	}{
+		{
+			name:   "No claims",
+			keys:   map[string]string{"login.example.com": "https://login.example.com:8443"},
+			policy: map[string][]string{},
+		},
+		{
+			name:   "Single value",
+			keys:   map[string]string{"claim.acr": "https://refeds.org/profile/mfa"},
+			policy: map[string][]string{"acr": {"https://refeds.org/profile/mfa"}},
+		},
+		{
+			name:   "Multiple values",
+			keys:   map[string]string{"claim.groups": " admins,users , ,staff"},
+			policy: map[string][]string{"groups": {"admins", "users", "staff"}},
+		},
+		{
+			name: "Malformed keys",
+			keys: map[string]string{
+				"claim.":      "value",
+				"claim":       "value",
+				"claims.acr":  "value",
+				"claim.empty": " , ",
+			},
+			policy: map[string][]string{},
+		},
+		{
+			name:      "Inherited",
+			keys:      map[string]string{"claim.level": "2"},
+			inherited: inherited,
+			policy: map[string][]string{
+				"acr":    {"https://refeds.org/profile/mfa"},
+				"groups": {"admins"},
+				"level":  {"2"},
+			},
+		},
+		{
+			name:      "Overridden and removed",
+			keys:      map[string]string{"claim.groups": "users", "claim.acr": ""},
+			inherited: inherited,
+			policy:    map[string][]string{"groups": {"users"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.policy, parseClaimPolicy(tt.keys, tt.inherited))
+		})
+	}
+
+	// The inherited policy is not modified
+	assert.Equal(t, []string{"https://refeds.org/profile/mfa"}, inherited["acr"])
+}
+
+func TestLoadClaimPolicy(t *testing.T) {
+	t.Run("Requires verify-token", func(t *testing.T) {
+		_, err := Load(writeConfig(t, "claim.acr = https://refeds.org/profile/mfa\n"+
+			"[example.com]\n"+
+			"login.example.com = https://login.example.com:8443\n"))
+		assert.ErrorContains(t, err, "claim policy requires verify-token")
+	})
+
+	t.Run("Claims are not hosts", func(t *testing.T) {
+		conf, err := Load(writeConfig(t, "verify-token = true\n"+
+			"claim.acr = https://refeds.org/profile/mfa\n"+
+			"[example.com]\n"+
+			"login.example.com = https://login.example.com:8443\n"+
+			"claim.groups = admins, users\n"+
+			"[example.org]\n"+
+			"login.example.org = https://login.example.org:8443\n"+
+			"claim.acr =\n"))
+		assert.NoError(t, err)
+
+		info, err := conf.GetInfo("login.example.com")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]string{
+			"acr":    {"https://refeds.org/profile/mfa"},
+			"groups": {"admins", "users"},
+		}, info.ClaimPolicy)
+
+		info, err = conf.GetInfo("login.example.org")
+		assert.NoError(t, err)
+		assert.Empty(t, info.ClaimPolicy)
+
+		_, err = conf.GetInfo("claim.groups")
+		assert.Error(t, err)
+	})
+}
+
+func TestParseCertPermissions(t *testing.T) {
+	tests := []struct {
+		name           string
+		extensions     []string
+		sourceAddress  string
+		wantExtensions map[string]string
+		wantOptions    map[string]string
+		err            bool
+	}{
+		{
+			name:           "Empty list",
+			wantExtensions: map[string]string{},
+			wantOptions:    map[string]string{},
+		},
+		{
+			name:           "None",
+			extensions:     []string{"none"},
+			wantExtensions: map[string]string{},
+			wantOptions:    map[string]string{},
+		},
+		{
+			name:           "Blank entries",
+			extensions:     []string{" ", ""},
+			sourceAddress:  " , ",
+			wantExtensions: map[string]string{},
+			wantOptions:    map[string]string{},
+		},
+		{
+			name:       "Extensions",
+			extensions: []string{" permit-pty", "permit-X11-forwarding "},
+			wantExtensions: map[string]string{
+				"permit-pty":            "",
+				"permit-X11-forwarding": "",
+			},
+			wantOptions: map[string]string{},
+		},
+		{
+			name:       "Unknown extension",
+			extensions: []string{"permit-pty", "permit-everything"},
+			err:        true,
+		},
+		{
+			name:       "Wrong case",
+			extensions: []string{"permit-x11-forwarding"},
+			err:        true,
+		},
+		{
+			name:           "Source address",
+			sourceAddress:  "192.0.2.1, 198.51.100.0/24,,2001:db8::/32",
+			wantExtensions: map[string]string{},
+			wantOptions: map[string]string{
+				"source-address": "192.0.2.1,198.51.100.0/24,2001:db8::/32",
+			},
+		},
+		{
+			name:          "Invalid source address",
+			sourceAddress: "192.0.2.1, example.com",
+			err:           true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := Config{HostGroups: []HostGroup{{}}}
+			conf.HostGroups[0].CertExtensions = tt.extensions
+			conf.HostGroups[0].CertSourceAddress = tt.sourceAddress
+
+			err := parseCertPermissions(&conf)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantExtensions, conf.HostGroups[0].CertPermissions.Extensions)
+			assert.Equal(t, tt.wantOptions, conf.HostGroups[0].CertPermissions.CriticalOptions)
+		})
+	}
+}
+
+func TestLoadCertPermissions(t *testing.T) {
+	conf, err := Load(writeConfig(t, "[default]\n"+
+		"login.example.com = https://login.example.com:8443\n"+
+		"[none]\n"+
+		"login.example.org = https://login.example.org:8443\n"+
+		"cert-extensions = none\n"))
+	assert.NoError(t, err)
+
+	// Extensions default to DEFAULT_CERT_EXTENSIONS
+	info, err := conf.GetInfo("login.example.com")
+	assert.NoError(t, err)
+	assert.Len(t, info.CertPermissions.Extensions, len(DEFAULT_CERT_EXTENSIONS))
+	for _, ext := range DEFAULT_CERT_EXTENSIONS {
+		assert.Contains(t, info.CertPermissions.Extensions, ext)
+	}
+	assert.Empty(t, info.CertPermissions.CriticalOptions)
+
+	info, err = conf.GetInfo("login.example.org")
+	assert.NoError(t, err)
+	assert.Empty(t, info.CertPermissions.Extensions)
+
+	_, err = Load(writeConfig(t, "cert-extensions = permit-pty, permit-everything\n"+
+		"[example.com]\n"+
+		"login.example.com = https://login.example.com:8443\n"))
+	assert.ErrorContains(t, err, "unknown extension permit-everything")
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	conf, err := Load(writeConfig(t, "trusted-proxies = 127.0.0.1, 10.0.0.0/8, ::1\n"))
+	assert.NoError(t, err)
+	assert.Len(t, conf.TrustedProxyNetworks, 3)
+	assert.True(t, conf.TrustedProxyNetworks[0].Contains(net.ParseIP("127.0.0.1")))
+	assert.False(t, conf.TrustedProxyNetworks[0].Contains(net.ParseIP("127.0.0.2")))
+	assert.True(t, conf.TrustedProxyNetworks[1].Contains(net.ParseIP("10.1.2.3")))
+	assert.True(t, conf.TrustedProxyNetworks[2].Contains(net.ParseIP("::1")))
+
+	_, err = Load(writeConfig(t, "trusted-proxies = localhost\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,271 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Store holds the configuration loaded from a file and allows to replace it
+// at runtime. Get and Reload are safe for concurrent use.
+type Store struct {
+	path    string
+	current atomic.Pointer[Config]
+
+	// mu serializes reloads and guards stamps
+	mu     sync.Mutex
+	stamps map[string]fileStamp
+}
+
+// fileStamp identifies the state of a file, see Store.Changed().
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func stat(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+
+	return fileStamp{modTime: info.ModTime(), size: info.Size(), exists: true}
+}
+
+// NewStore loads the configuration file at the given path.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+
+	stamps := s.stampFiles(nil)
+
+	conf, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.stamps = s.addStamps(stamps, &conf)
+	s.current.Store(&conf)
+
+	return s, nil
+}
+
+// Get returns the current configuration.
+func (s *Store) Get() Config {
+	return *s.current.Load()
+}
+
+// files returns the paths of the configuration file and all key and TLS files
+// referenced by the given configuration.
+func (s *Store) files(conf *Config) []string {
+	files := []string{s.path}
+
+	if conf == nil {
+		return files
+	}
+
+	files = append(files, conf.PathTLSCertificate, conf.PathTLSKey, conf.PathTLSClientCA)
+
+	for _, group := range conf.HostGroups {
+		files = append(files,
+			group.PathHostCAPrivateKey,
+			group.PathHostCAPublicKey,
+			group.PathUserCAPrivateKey,
+			group.PathUserCAPublicKey)
+		files = append(files, group.PathsHostCANextPublicKeys...)
+		files = append(files, group.PathsHostCARetiredPublicKeys...)
+		files = append(files, group.PathsUserCANextPublicKeys...)
+		files = append(files, group.PathsUserCARetiredPublicKeys...)
+	}
+
+	return files
+}
+
+func (s *Store) stampFiles(conf *Config) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+
+	for _, path := range s.files(conf) {
+		if path = strings.TrimSpace(path); path != "" {
+			stamps[path] = stat(path)
+		}
+	}
+
+	return stamps
+}
+
+// addStamps adds the stamps of files referenced by the given configuration
+// to the given stamps, keeping existing ones.
+func (s *Store) addStamps(stamps map[string]fileStamp, conf *Config) map[string]fileStamp {
+	for path, stamp := range s.stampFiles(conf) {
+		if _, ok := stamps[path]; !ok {
+			stamps[path] = stamp
+		}
+	}
+
+	return stamps
+}
+
+// Changed returns whether the configuration file, any key file or TLS file was
+// modified since the last (successful or failed) reload.
+func (s *Store) Changed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for path, stamp := range s.stamps {
+		if stat(path) != stamp {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Reload loads the configuration file and key files again and replaces the
+// current configuration if they are valid and no option was changed that
+// requires a restart, see restartOptions(). The current configuration is
+// kept otherwise. It returns the differences between the configurations, see
+// Diff().
+func (s *Store) Reload() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.current.Load()
+
+	// Take stamps before loading, so that changes made while loading are
+	// detected. Stamps are updated even if loading fails, to not retry
+	// until the files are changed again.
+	stamps := s.stampFiles(old)
+
+	conf, err := Load(s.path)
+	if err != nil {
+		s.stamps = stamps
+		return nil, err
+	}
+
+	s.stamps = s.addStamps(stamps, &conf)
+
+	if options := restartOptions(*old, conf); len(options) > 0 {
+		return nil, errors.New("changing " + strings.Join(options, ", ") + " requires a restart")
+	}
+
+	s.current.Store(&conf)
+
+	return Diff(*old, conf), nil
+}
+
+// restartOptions returns the options that differ between the given
+// configurations and cannot be changed without a restart, as they are only
+// used at startup. Enabling or disabling TLS cannot be changed either, as the
+// listener would keep serving with or without TLS.
+func restartOptions(old, new Config) []string {
+	var options []string
+
+	if old.Database != new.Database {
+		options = append(options, "database")
+	}
+
+	if old.AuditLog != new.AuditLog {
+		options = append(options, "audit-log")
+	}
+
+	if strings.Join(old.TrustedProxies, ",") != strings.Join(new.TrustedProxies, ",") {
+		options = append(options, "trusted-proxies")
+	}
+
+	if old.TLSEnabled() != new.TLSEnabled() {
+		options = append(options, "TLS")
+	}
+
+	return options
+}
+
+// Diff returns human-readable lines describing the hostgroups and hosts that
+// were added, removed or changed between the given configurations. Changes of
+// other options are summarized per hostgroup.
+func Diff(old, new Config) []string {
+	var diff []string
+
+	if !sameTLS(old.TLS, new.TLS) {
+		diff = append(diff, "changed TLS certificates")
+	}
+
+	oldGroups := make(map[string]HostGroup)
+	for _, group := range old.HostGroups {
+		oldGroups[group.Name] = group
+	}
+
+	newGroups := make(map[string]HostGroup)
+	for _, group := range new.HostGroups {
+		newGroups[group.Name] = group
+	}
+
+	for name, oldGroup := range oldGroups {
+		if _, ok := newGroups[name]; !ok {
+			diff = append(diff, fmt.Sprintf("removed hostgroup %s (%d hosts)", name, len(oldGroup.Hosts)))
+		}
+	}
+
+	for name, newGroup := range newGroups {
+		oldGroup, ok := oldGroups[name]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("added hostgroup %s (%d hosts)", name, len(newGroup.Hosts)))
+			continue
+		}
+
+		for host, url := range oldGroup.Hosts {
+			if _, ok := newGroup.Hosts[host]; !ok {
+				diff = append(diff, "removed host "+host+" from hostgroup "+name)
+			} else if newGroup.Hosts[host] != url {
+				diff = append(diff, "changed host "+host+" in hostgroup "+name+" to "+newGroup.Hosts[host])
+			}
+		}
+
+		for host, url := range newGroup.Hosts {
+			if _, ok := oldGroup.Hosts[host]; !ok {
+				diff = append(diff, "added host "+host+" = "+url+" to hostgroup "+name)
+			}
+		}
+
+		if !sameKeys(oldGroup.Keys, newGroup.Keys) {
+			diff = append(diff, "changed keys of hostgroup "+name)
+		}
+
+		if fmt.Sprint(oldGroup.DefaultOptions, oldGroup.ClaimPolicy) != fmt.Sprint(newGroup.DefaultOptions, newGroup.ClaimPolicy) {
+			diff = append(diff, "changed options of hostgroup "+name)
+		}
+	}
+
+	sort.Strings(diff)
+
+	return diff
+}
+
+// sameKeys returns whether the given keys contain the same public keys. Private
+// keys are not compared, as they belong to the active public keys.
+func sameKeys(a, b Keys) bool {
+	fingerprints := func(k Keys) string {
+		var fps []string
+
+		for _, list := range [][]ssh.PublicKey{
+			k.TrustedHostCAKeys(), k.HostCARetiredPublicKeys,
+			k.TrustedUserCAKeys(), k.UserCARetiredPublicKeys,
+		} {
+			for _, key := range list {
+				fps = append(fps, ssh.FingerprintSHA256(key))
+			}
+
+			fps = append(fps, "|")
+		}
+
+		return strings.Join(fps, ",")
+	}
+
+	return fingerprints(a) == fingerprints(b)
+}
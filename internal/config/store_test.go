@@ -0,0 +1,132 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func writeKeyPair(t *testing.T, dir, name string) {
+	pk, privkey, _ := ed25519.GenerateKey(rand.Reader)
+	pubkey, _ := ssh.NewPublicKey(pk)
+
+	block, err := ssh.MarshalPrivateKey(privkey, "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".pub"), ssh.MarshalAuthorizedKey(pubkey), 0644))
+}
+
+func TestStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	writeKeyPair(t, dir, "host-ca")
+	writeKeyPair(t, dir, "user-ca")
+
+	header := "host-ca-privkey = " + filepath.Join(dir, "host-ca") + "\n" +
+		"host-ca-pubkey  = " + filepath.Join(dir, "host-ca.pub") + "\n" +
+		"user-ca-privkey = " + filepath.Join(dir, "user-ca") + "\n" +
+		"user-ca-pubkey  = " + filepath.Join(dir, "user-ca.pub") + "\n" +
+		"cert-validity   = 3600\n" +
+		"cache-duration  = 600\n"
+
+	path := filepath.Join(dir, "config.ini")
+	assert.NoError(t, os.WriteFile(path, []byte(header+
+		"[example.com]\n"+
+		"login.example.com = https://login.example.com:8443\n"), 0600))
+
+	store, err := NewStore(path)
+	assert.NoError(t, err)
+	assert.False(t, store.Changed())
+
+	assert.NoError(t, os.WriteFile(path, []byte(header+
+		"[example.com]\n"+
+		"login.example.com = https://login.example.com:8443\n"+
+		"login2.example.com = https://login2.example.com:8443\n"+
+		"[example.org]\n"+
+		"login.example.org = https://login.example.org:8443\n"), 0600))
+	assert.True(t, store.Changed())
+
+	diff, err := store.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"added host login2.example.com = https://login2.example.com:8443 to hostgroup example.com",
+		"added hostgroup example.org (1 hosts)",
+	}, diff)
+	assert.False(t, store.Changed())
+
+	_, err = store.Get().GetInfo("login.example.org")
+	assert.NoError(t, err)
+
+	// Replacing a key file is detected as well
+	writeKeyPair(t, dir, "user-ca")
+	assert.True(t, store.Changed())
+
+	diff, err = store.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"changed keys of hostgroup example.com", "changed keys of hostgroup example.org"}, diff)
+
+	// Invalid configs are not applied
+	assert.NoError(t, os.Remove(filepath.Join(dir, "host-ca.pub")))
+	assert.True(t, store.Changed())
+
+	_, err = store.Reload()
+	assert.Error(t, err)
+	assert.False(t, store.Changed())
+
+	_, err = store.Get().GetInfo("login2.example.com")
+	assert.NoError(t, err)
+}
+
+func TestStoreReloadRestart(t *testing.T) {
+	dir := t.TempDir()
+	writeKeyPair(t, dir, "host-ca")
+	writeKeyPair(t, dir, "user-ca")
+
+	header := "host-ca-privkey = " + filepath.Join(dir, "host-ca") + "\n" +
+		"host-ca-pubkey  = " + filepath.Join(dir, "host-ca.pub") + "\n" +
+		"user-ca-privkey = " + filepath.Join(dir, "user-ca") + "\n" +
+		"user-ca-pubkey  = " + filepath.Join(dir, "user-ca.pub") + "\n" +
+		"cert-validity   = 3600\n" +
+		"cache-duration  = 600\n" +
+		"[example.com]\n" +
+		"login.example.com = https://login.example.com:8443\n"
+
+	path := filepath.Join(dir, "config.ini")
+	assert.NoError(t, os.WriteFile(path, []byte("database = "+filepath.Join(dir, "ledger.db")+"\n"+header), 0600))
+
+	store, err := NewStore(path)
+	assert.NoError(t, err)
+
+	// Options used at startup cannot be changed by a reload
+	assert.NoError(t, os.WriteFile(path, []byte("database = "+filepath.Join(dir, "other.db")+"\n"+
+		"audit-log = "+filepath.Join(dir, "audit.log")+"\n"+
+		"trusted-proxies = 127.0.0.1\n"+
+		header+
+		"login2.example.com = https://login2.example.com:8443\n"), 0600))
+	assert.True(t, store.Changed())
+
+	_, err = store.Reload()
+	assert.EqualError(t, err, "changing database, audit-log, trusted-proxies requires a restart")
+	assert.False(t, store.Changed())
+
+	assert.Equal(t, filepath.Join(dir, "ledger.db"), store.Get().Database)
+	_, err = store.Get().GetInfo("login2.example.com")
+	assert.Error(t, err)
+
+	// Neither can TLS be enabled
+	writeTLSCertificate(t, dir, "server")
+	assert.NoError(t, os.WriteFile(path, []byte("database = "+filepath.Join(dir, "ledger.db")+"\n"+
+		"tls-cert = "+filepath.Join(dir, "server.crt")+"\n"+
+		"tls-key = "+filepath.Join(dir, "server.key")+"\n"+
+		header), 0600))
+
+	_, err = store.Reload()
+	assert.EqualError(t, err, "changing TLS requires a restart")
+	assert.False(t, store.Get().TLSEnabled())
+}
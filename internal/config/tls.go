@@ -0,0 +1,87 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// TLSCredentials contains the certificate the API is served with and the CA
+// certificates that client certificates are verified against. Certificate is
+// nil if TLS is disabled, ClientCAs is nil if mutual TLS is disabled.
+type TLSCredentials struct {
+	Certificate *tls.Certificate
+	ClientCAs   *x509.CertPool
+}
+
+// TLSEnabled returns whether the API is served using TLS.
+func (c Config) TLSEnabled() bool {
+	return c.TLS.Certificate != nil
+}
+
+// MutualTLSEnabled returns whether protected routes require a client
+// certificate.
+func (c Config) MutualTLSEnabled() bool {
+	return c.TLS.ClientCAs != nil
+}
+
+func loadTLS(conf *Config) error {
+	if conf.PathTLSCertificate == "" && conf.PathTLSKey == "" {
+		if conf.PathTLSClientCA != "" {
+			return errors.New("tls-client-ca requires tls-cert and tls-key")
+		}
+
+		return nil
+	}
+
+	if conf.PathTLSCertificate == "" || conf.PathTLSKey == "" {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.PathTLSCertificate, conf.PathTLSKey)
+	if err != nil {
+		return err
+	}
+
+	conf.TLS.Certificate = &cert
+
+	if conf.PathTLSClientCA == "" {
+		return nil
+	}
+
+	bundle, err := os.ReadFile(conf.PathTLSClientCA)
+	if err != nil {
+		return err
+	}
+
+	conf.TLS.ClientCAs = x509.NewCertPool()
+	if !conf.TLS.ClientCAs.AppendCertsFromPEM(bundle) {
+		return errors.New("no certificates found in " + conf.PathTLSClientCA)
+	}
+
+	return nil
+}
+
+// sameTLS returns whether the given credentials contain the same certificate
+// chain and client CAs.
+func sameTLS(a, b TLSCredentials) bool {
+	chain := func(cert *tls.Certificate) []byte {
+		if cert == nil {
+			return nil
+		}
+
+		return bytes.Join(cert.Certificate, nil)
+	}
+
+	if !bytes.Equal(chain(a.Certificate), chain(b.Certificate)) {
+		return false
+	}
+
+	if a.ClientCAs == nil || b.ClientCAs == nil {
+		return a.ClientCAs == b.ClientCAs
+	}
+
+	return a.ClientCAs.Equal(b.ClientCAs)
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTLSCertificate(t *testing.T, dir, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+}
+
+func TestLoadTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeTLSCertificate(t, dir, "server")
+	writeTLSCertificate(t, dir, "clients")
+
+	t.Run("Disabled", func(t *testing.T) {
+		var conf Config
+
+		assert.NoError(t, loadTLS(&conf))
+		assert.False(t, conf.TLSEnabled())
+		assert.False(t, conf.MutualTLSEnabled())
+	})
+
+	t.Run("TLS", func(t *testing.T) {
+		var conf Config
+		conf.PathTLSCertificate = filepath.Join(dir, "server.crt")
+		conf.PathTLSKey = filepath.Join(dir, "server.key")
+
+		assert.NoError(t, loadTLS(&conf))
+		assert.True(t, conf.TLSEnabled())
+		assert.False(t, conf.MutualTLSEnabled())
+
+		conf.PathTLSClientCA = filepath.Join(dir, "clients.crt")
+		old := conf.TLS
+
+		assert.NoError(t, loadTLS(&conf))
+		assert.True(t, conf.MutualTLSEnabled())
+		assert.False(t, sameTLS(old, conf.TLS))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		var conf Config
+		conf.PathTLSClientCA = filepath.Join(dir, "clients.crt")
+		assert.Error(t, loadTLS(&conf))
+
+		conf.PathTLSCertificate = filepath.Join(dir, "server.crt")
+		assert.Error(t, loadTLS(&conf))
+
+		// A private key is not a CA bundle
+		conf.PathTLSKey = filepath.Join(dir, "server.key")
+		conf.PathTLSClientCA = filepath.Join(dir, "server.key")
+		assert.Error(t, loadTLS(&conf))
+	})
+}
@@ -0,0 +1,258 @@
+package dnsutil
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ROOT_ANCHORS are the DS records of the key signing keys of the root zone,
+// see https://data.iana.org/root-anchors/root-anchors.xml. They can be
+// replaced using Options.TrustAnchor.
+var ROOT_ANCHORS = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// validator validates answers of a resolver using DNSSEC, following the chain
+// of DNSKEY and DS records from the signer of an answer up to the trust
+// anchors of the root zone. The resolver is not trusted, it merely retrieves
+// the records. Validated keys are cached for the lifetime of the validator.
+//
+// Answers without records are not validated, as proving the non-existence of
+// records is not implemented. Suppressing records only results in other
+// records published for the host being used, or the CA not being found.
+type validator struct {
+	resolver string
+	anchors  []*dns.DS
+	keys     map[string][]*dns.DNSKEY
+	now      func() time.Time
+}
+
+// newValidator returns a validator that queries the given resolver. If
+// trustAnchor is not empty, the trust anchors of the root zone are read from
+// this file, see parseTrustAnchors(). ROOT_ANCHORS are used otherwise.
+func newValidator(resolver, trustAnchor string) (*validator, error) {
+	var anchors []*dns.DS
+
+	if trustAnchor == "" {
+		for _, anchor := range ROOT_ANCHORS {
+			rr, err := dns.NewRR(anchor)
+			if err != nil {
+				return nil, err
+			}
+
+			anchors = append(anchors, rr.(*dns.DS))
+		}
+	} else {
+		f, err := os.Open(trustAnchor)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if anchors, err = parseTrustAnchors(dns.NewZoneParser(f, ".", trustAnchor)); err != nil {
+			return nil, err
+		}
+	}
+
+	return &validator{
+		resolver: resolver,
+		anchors:  anchors,
+		keys:     make(map[string][]*dns.DNSKEY),
+		now:      time.Now,
+	}, nil
+}
+
+// parseTrustAnchors returns the DS records of the root zone in the given zone
+// data, such as the root.key file of unbound. DNSKEY records of key signing
+// keys are converted to DS records.
+func parseTrustAnchors(zp *dns.ZoneParser) ([]*dns.DS, error) {
+	var anchors []*dns.DS
+
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Name != "." {
+			continue
+		}
+
+		switch rr := rr.(type) {
+		case *dns.DS:
+			anchors = append(anchors, rr)
+		case *dns.DNSKEY:
+			if rr.Flags&dns.SEP != 0 {
+				anchors = append(anchors, rr.ToDS(dns.SHA256))
+			}
+		}
+	}
+
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(anchors) == 0 {
+		return nil, errors.New("no trust anchor for the root zone found")
+	}
+
+	return anchors, nil
+}
+
+// query sends a query for the given name and type to the resolver and returns
+// the answer section without signatures, each RRset of which was validated.
+func (v *validator) query(name string, qtype uint16) ([]dns.RR, error) {
+	answer, err := exchange(v.resolver, name, qtype, true)
+	if err != nil {
+		return nil, err
+	}
+
+	rrsets, sigs := splitRRsets(answer)
+
+	var records []dns.RR
+	for _, rrset := range rrsets {
+		if !v.verify(rrset, sigs, v.zoneKeys) {
+			return nil, errors.New(ERR_INSECURE)
+		}
+
+		records = append(records, rrset...)
+	}
+
+	return records, nil
+}
+
+// zoneKeys returns the validated zone signing keys of the given zone, which
+// are the keys of its DNSKEY RRset signed by a key matching a DS record of
+// the parent zone or a trust anchor. nil is returned if the keys cannot be
+// validated.
+func (v *validator) zoneKeys(zone string) []*dns.DNSKEY {
+	zone = dns.CanonicalName(zone)
+
+	if keys, ok := v.keys[zone]; ok {
+		return keys
+	}
+
+	// Cache failures as well, as zones are looked up repeatedly
+	v.keys[zone] = nil
+
+	var ds []*dns.DS
+
+	if zone == "." {
+		ds = v.anchors
+	} else {
+		answer, err := exchange(v.resolver, zone, dns.TypeDS, true)
+		if err != nil {
+			return nil
+		}
+
+		rrsets, sigs := splitRRsets(answer)
+		if len(rrsets) != 1 || rrsets[0][0].Header().Rrtype != dns.TypeDS {
+			return nil
+		}
+
+		// DS records are signed by the parent zone, never the zone itself
+		var parentSigs []*dns.RRSIG
+		for _, sig := range sigs {
+			if dns.CanonicalName(sig.SignerName) != zone {
+				parentSigs = append(parentSigs, sig)
+			}
+		}
+
+		if !v.verify(rrsets[0], parentSigs, v.zoneKeys) {
+			return nil
+		}
+
+		for _, rr := range rrsets[0] {
+			ds = append(ds, rr.(*dns.DS))
+		}
+	}
+
+	answer, err := exchange(v.resolver, zone, dns.TypeDNSKEY, true)
+	if err != nil {
+		return nil
+	}
+
+	rrsets, sigs := splitRRsets(answer)
+	if len(rrsets) != 1 || rrsets[0][0].Header().Rrtype != dns.TypeDNSKEY {
+		return nil
+	}
+
+	// Secure entry points are the keys matching a DS record
+	var entries, keys []*dns.DNSKEY
+
+	for _, rr := range rrsets[0] {
+		key := rr.(*dns.DNSKEY)
+
+		if key.Flags&dns.ZONE != 0 {
+			keys = append(keys, key)
+		}
+
+		for _, d := range ds {
+			if d.KeyTag != key.KeyTag() || d.Algorithm != key.Algorithm {
+				continue
+			}
+
+			if digest := key.ToDS(d.DigestType); digest != nil && strings.EqualFold(digest.Digest, d.Digest) {
+				entries = append(entries, key)
+				break
+			}
+		}
+	}
+
+	if !v.verify(rrsets[0], sigs, func(string) []*dns.DNSKEY { return entries }) {
+		return nil
+	}
+
+	v.keys[zone] = keys
+
+	return keys
+}
+
+// verify returns whether one of the given signatures covering the RRset is
+// currently valid and was created by one of the keys returned by keys for the
+// signer name of the signature.
+func (v *validator) verify(rrset []dns.RR, sigs []*dns.RRSIG, keys func(signer string) []*dns.DNSKEY) bool {
+	owner := dns.CanonicalName(rrset[0].Header().Name)
+	rrtype := rrset[0].Header().Rrtype
+
+	for _, sig := range sigs {
+		if dns.CanonicalName(sig.Header().Name) != owner || sig.TypeCovered != rrtype ||
+			!dns.IsSubDomain(sig.SignerName, owner) || !sig.ValidityPeriod(v.now()) {
+			continue
+		}
+
+		for _, key := range keys(sig.SignerName) {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, rrset) == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// splitRRsets groups the given records into RRsets by name and type and
+// returns them along with the signatures among them.
+func splitRRsets(rrs []dns.RR) ([][]dns.RR, []*dns.RRSIG) {
+	var rrsets [][]dns.RR
+	var sigs []*dns.RRSIG
+
+	index := make(map[string]int)
+
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+			continue
+		}
+
+		key := dns.CanonicalName(rr.Header().Name) + " " + dns.TypeToString[rr.Header().Rrtype]
+		if i, ok := index[key]; ok {
+			rrsets[i] = append(rrsets[i], rr)
+		} else {
+			index[key] = len(rrsets)
+			rrsets = append(rrsets, []dns.RR{rr})
+		}
+	}
+
+	return rrsets, sigs
+}
@@ -3,38 +3,239 @@ package dnsutil
 import (
 	"errors"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 const (
 	TXT_PREFIX = "_oinit-ca."
+	SRV_PREFIX = "_oinit-ca._tcp."
+
+	RESOLV_CONF   = "/etc/resolv.conf"
+	QUERY_TIMEOUT = 5 * time.Second
+
+	ERR_NOT_FOUND = "could not find DNS record"
+	ERR_INSECURE  = "DNS answer is not DNSSEC-validated"
 )
 
+// Options configure how the CA is looked up.
+type Options struct {
+	// Address of the resolver to query, optionally including the port. If
+	// empty, the system resolver is used.
+	Resolver string
+	// Only accept answers that were validated using DNSSEC. Answers are
+	// validated by oinit itself, so that any resolver can be used.
+	RequireDNSSEC bool
+	// Path of a file containing the trust anchors of the root zone as DS or
+	// DNSKEY records, such as the root.key file of unbound. If empty,
+	// ROOT_ANCHORS are used.
+	TrustAnchor string
+}
+
+// lookupFunc returns the records of the given name and type.
+type lookupFunc func(name string, qtype uint16) ([]dns.RR, error)
+
 // LookupCA tries to find the CA for a given ssh server host name by querying
 // the domain name system.
 //
-// For a given ssh server login.example.com, a TXT record for either
-// _oinit-ca.login.example.com or _oinit-ca.example.com is expected. Wildcard
-// domains such as *.login.example.com are supported and will result in similar
-// lookups of _oinit-ca.login.example.com and _oinit-ca.example.com
-func LookupCA(host string) (string, error) {
+// For a given ssh server login.example.com, a SRV record for either
+// _oinit-ca._tcp.login.example.com or _oinit-ca._tcp.example.com, or a TXT
+// record for either _oinit-ca.login.example.com or _oinit-ca.example.com is
+// expected. Wildcard domains such as *.login.example.com are supported and
+// will result in similar lookups of login.example.com and example.com.
+//
+// Several records can be used to publish replicas of the CA, all of which
+// are returned. SRV records are ordered by priority and weight, and result in
+// https:// URLs.
+func LookupCA(host string, opts Options) ([]string, error) {
+	lookup, err := newLookup(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	lookup1, _ := strings.CutPrefix(host, "*.")
 
-	records, err := net.LookupTXT(TXT_PREFIX + lookup1)
-	if err == nil && len(records) > 0 {
-		return records[0], nil
+	cas, err := lookupName(lookup1, lookup)
+	if err == nil || err.Error() == ERR_INSECURE {
+		return cas, err
 	}
 
 	// remove subdomain and try again
 	_, lookup2, found := strings.Cut(lookup1, ".")
 	if !found || strings.Count(lookup2, ".") == 0 {
-		return "", errors.New("could not find DNS record")
+		return nil, errors.New(ERR_NOT_FOUND)
 	}
 
-	records, err = net.LookupTXT(TXT_PREFIX + lookup2)
-	if err == nil && len(records) > 0 {
-		return records[0], nil
+	return lookupName(lookup2, lookup)
+}
+
+// newLookup returns the function used to look up records, which uses the Go
+// resolver unless special handling is required, as it works on all
+// platforms.
+func newLookup(opts Options) (lookupFunc, error) {
+	if opts.Resolver == "" && !opts.RequireDNSSEC {
+		return lookupGo, nil
+	}
+
+	resolver := opts.Resolver
+	if resolver != "" {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			resolver = net.JoinHostPort(resolver, "53")
+		}
+	} else {
+		conf, err := dns.ClientConfigFromFile(RESOLV_CONF)
+		if err != nil || len(conf.Servers) == 0 {
+			return nil, errors.New("no DNS resolver configured")
+		}
+
+		resolver = net.JoinHostPort(conf.Servers[0], conf.Port)
+	}
+
+	if !opts.RequireDNSSEC {
+		return func(name string, qtype uint16) ([]dns.RR, error) {
+			return exchange(resolver, name, qtype, false)
+		}, nil
+	}
+
+	v, err := newValidator(resolver, opts.TrustAnchor)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.query, nil
+}
+
+// lookupGo looks up SRV and TXT records using the Go resolver.
+func lookupGo(name string, qtype uint16) ([]dns.RR, error) {
+	var rrs []dns.RR
+
+	switch qtype {
+	case dns.TypeSRV:
+		if _, srvs, err := net.LookupSRV("", "", name); err == nil {
+			for _, srv := range srvs {
+				rrs = append(rrs, &dns.SRV{
+					Hdr:      dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeSRV, Class: dns.ClassINET},
+					Priority: srv.Priority,
+					Weight:   srv.Weight,
+					Port:     srv.Port,
+					Target:   srv.Target,
+				})
+			}
+		}
+	case dns.TypeTXT:
+		if records, err := net.LookupTXT(name); err == nil {
+			for _, record := range records {
+				rrs = append(rrs, &dns.TXT{
+					Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+					Txt: []string{record},
+				})
+			}
+		}
+	}
+
+	return rrs, nil
+}
+
+// lookupName looks up the SRV and TXT records of a single domain name. SRV
+// records take precedence.
+func lookupName(name string, lookup lookupFunc) ([]string, error) {
+	answers, err := lookup(SRV_PREFIX+name, dns.TypeSRV)
+	if err != nil {
+		return nil, err
+	}
+
+	var srvs []*net.SRV
+	for _, rr := range answers {
+		if srv, ok := rr.(*dns.SRV); ok {
+			srvs = append(srvs, &net.SRV{
+				Target:   srv.Target,
+				Port:     srv.Port,
+				Priority: srv.Priority,
+				Weight:   srv.Weight,
+			})
+		}
+	}
+
+	if cas := srvToURLs(srvs); len(cas) > 0 {
+		return cas, nil
+	}
+
+	answers, err = lookup(TXT_PREFIX+name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	var cas []string
+	for _, rr := range answers {
+		if txt, ok := rr.(*dns.TXT); ok {
+			cas = append(cas, strings.Join(txt.Txt, ""))
+		}
+	}
+
+	if len(cas) == 0 {
+		return nil, errors.New(ERR_NOT_FOUND)
+	}
+
+	return cas, nil
+}
+
+// exchange sends a query for the given name and type to the given resolver
+// and returns the answer section. If dnssec is set, signatures are requested
+// and the resolver is asked not to validate the answer, as this is done by
+// the validator. Non-existent names result in an empty answer.
+func exchange(resolver, name string, qtype uint16, dnssec bool) ([]dns.RR, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+	msg.SetEdns0(4096, dnssec)
+	msg.CheckingDisabled = dnssec
+
+	client := &dns.Client{Timeout: QUERY_TIMEOUT}
+
+	res, _, err := client.Exchange(msg, resolver)
+	if err == nil && res.Truncated {
+		client.Net = "tcp"
+		res, _, err = client.Exchange(msg, resolver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return nil, errors.New("DNS query failed: " + dns.RcodeToString[res.Rcode])
+	}
+
+	return res.Answer, nil
+}
+
+// srvToURLs returns the https:// URLs of the given SRV records, ordered by
+// priority (ascending) and weight (descending). Records with target "." are
+// ignored, as they indicate that the service is not available.
+func srvToURLs(srvs []*net.SRV) []string {
+	sort.SliceStable(srvs, func(i, j int) bool {
+		if srvs[i].Priority != srvs[j].Priority {
+			return srvs[i].Priority < srvs[j].Priority
+		}
+
+		return srvs[i].Weight > srvs[j].Weight
+	})
+
+	var urls []string
+	for _, srv := range srvs {
+		target := strings.TrimSuffix(srv.Target, ".")
+		if target == "" {
+			continue
+		}
+
+		if srv.Port == 443 {
+			urls = append(urls, "https://"+target)
+		} else {
+			urls = append(urls, "https://"+net.JoinHostPort(target, strconv.Itoa(int(srv.Port))))
+		}
 	}
 
-	return "", errors.New("could not find DNS record")
+	return urls
 }
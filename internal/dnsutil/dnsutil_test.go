@@ -0,0 +1,218 @@
+package dnsutil
+
+import (
+	"crypto"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testZones is the zone data served by newServer. Records are signed by
+// sign(), which also creates the DNSKEY and DS records of the zones.
+type testZones struct {
+	t       *testing.T
+	records map[string][]dns.RR
+	keys    map[string]*dns.DNSKEY
+	privkey map[string]crypto.Signer
+}
+
+func newTestZones(t *testing.T) *testZones {
+	return &testZones{
+		t:       t,
+		records: make(map[string][]dns.RR),
+		keys:    make(map[string]*dns.DNSKEY),
+		privkey: make(map[string]crypto.Signer),
+	}
+}
+
+// add adds the given records without signing them.
+func (z *testZones) add(records ...string) []dns.RR {
+	var rrs []dns.RR
+
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		assert.NoError(z.t, err)
+
+		name := dns.CanonicalName(rr.Header().Name)
+		z.records[name] = append(z.records[name], rr)
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+// addZone creates a key for the given zone, which signs its DNSKEY RRset.
+// Unless the zone is the root zone, its DS record is added to and signed by
+// the given parent zone.
+func (z *testZones) addZone(zone, parent string) {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ED25519,
+	}
+
+	privkey, err := key.Generate(256)
+	assert.NoError(z.t, err)
+
+	z.keys[zone] = key
+	z.privkey[zone] = privkey.(crypto.Signer)
+	z.records[zone] = append(z.records[zone], key)
+	z.sign(zone, []dns.RR{key}, time.Hour)
+
+	if parent != "" {
+		ds := key.ToDS(dns.SHA256)
+		z.records[zone] = append(z.records[zone], ds)
+		z.sign(parent, []dns.RR{ds}, time.Hour)
+	}
+}
+
+// sign adds a signature of the given RRset by the key of the given zone,
+// which is valid for the given duration (and expired if negative).
+func (z *testZones) sign(zone string, rrset []dns.RR, validFor time.Duration) {
+	now := time.Now()
+
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		KeyTag:     z.keys[zone].KeyTag(),
+		SignerName: zone,
+		Algorithm:  dns.ED25519,
+		Inception:  uint32(now.Add(-2 * time.Hour).Unix()),
+		Expiration: uint32(now.Add(validFor).Unix()),
+	}
+	assert.NoError(z.t, sig.Sign(z.privkey[zone], rrset))
+
+	name := dns.CanonicalName(sig.Hdr.Name)
+	z.records[name] = append(z.records[name], sig)
+}
+
+// anchor writes the DNSKEY record of the root zone to a file and returns its
+// path, to be used as trust anchor.
+func (z *testZones) anchor() string {
+	path := filepath.Join(z.t.TempDir(), "root.key")
+	assert.NoError(z.t, os.WriteFile(path, []byte(z.keys["."].String()+"\n"), 0644))
+
+	return path
+}
+
+// newServer starts a DNS server on localhost that answers with the records
+// of the given zones, including their signatures if requested.
+func newServer(t *testing.T, zones *testZones) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	srv := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(req)
+
+		q := req.Question[0]
+		dnssec := req.IsEdns0() != nil && req.IsEdns0().Do()
+
+		for _, rr := range zones.records[dns.CanonicalName(q.Name)] {
+			if rr.Header().Rrtype == q.Qtype {
+				res.Answer = append(res.Answer, rr)
+			} else if sig, ok := rr.(*dns.RRSIG); ok && dnssec && sig.TypeCovered == q.Qtype {
+				res.Answer = append(res.Answer, rr)
+			}
+		}
+
+		w.WriteMsg(res)
+	})}
+
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestLookupCA(t *testing.T) {
+	zones := newTestZones(t)
+	zones.addZone(".", "")
+	zones.addZone("secure.example.", ".")
+
+	// Zone without DS record
+	zones.addZone("insecure.example.", "")
+
+	zones.sign("secure.example.", zones.add(
+		"_oinit-ca._tcp.login.secure.example. 60 IN SRV 20 0 8443 ca2.example.com.",
+		"_oinit-ca._tcp.login.secure.example. 60 IN SRV 10 5 443 ca1.example.com.",
+		"_oinit-ca._tcp.login.secure.example. 60 IN SRV 10 10 443 ca0.example.com.",
+	), time.Hour)
+	zones.sign("secure.example.", zones.add("_oinit-ca.secure.example. 60 IN TXT \"https://ca.secure.example.com\""), time.Hour)
+	zones.sign("insecure.example.", zones.add("_oinit-ca.insecure.example. 60 IN TXT \"https://ca.insecure.example.com\""), time.Hour)
+
+	// Signature expired
+	zones.sign("secure.example.", zones.add("_oinit-ca.expired.secure.example. 60 IN TXT \"https://ca.expired.example.com\""), -time.Hour)
+
+	// Record was modified after signing
+	forged := zones.add("_oinit-ca.forged.secure.example. 60 IN TXT \"https://ca.forged.example.com\"")
+	zones.sign("secure.example.", forged, time.Hour)
+	forged[0].(*dns.TXT).Txt = []string{"https://attacker.example.com"}
+
+	// Not signed at all
+	zones.add("_oinit-ca.unsigned.secure.example. 60 IN TXT \"https://ca.unsigned.example.com\"")
+
+	resolver := newServer(t, zones)
+	opts := Options{Resolver: resolver, RequireDNSSEC: true, TrustAnchor: zones.anchor()}
+
+	// SRV records, ordered by priority and weight
+	cas, err := LookupCA("login.secure.example", opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://ca0.example.com", "https://ca1.example.com", "https://ca2.example.com:8443"}, cas)
+
+	// TXT record of parent domain
+	cas, err = LookupCA("*.node.secure.example", opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://ca.secure.example.com"}, cas)
+
+	for _, host := range []string{"login.insecure.example", "login.expired.secure.example", "login.forged.secure.example", "login.unsigned.secure.example"} {
+		_, err = LookupCA(host, opts)
+		assert.EqualError(t, err, ERR_INSECURE, host)
+	}
+
+	// Different trust anchor
+	other := newTestZones(t)
+	other.addZone(".", "")
+
+	_, err = LookupCA("login.secure.example", Options{Resolver: resolver, RequireDNSSEC: true, TrustAnchor: other.anchor()})
+	assert.EqualError(t, err, ERR_INSECURE)
+
+	// The built-in trust anchors are used by default
+	_, err = LookupCA("login.secure.example", Options{Resolver: resolver, RequireDNSSEC: true})
+	assert.EqualError(t, err, ERR_INSECURE)
+
+	opts.RequireDNSSEC = false
+
+	cas, err = LookupCA("login.insecure.example", opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://ca.insecure.example.com"}, cas)
+
+	_, err = LookupCA("login.missing.example", opts)
+	assert.EqualError(t, err, ERR_NOT_FOUND)
+}
+
+func TestParseTrustAnchors(t *testing.T) {
+	zones := newTestZones(t)
+	zones.addZone(".", "")
+
+	// DNSKEY records are converted to DS records
+	anchors, err := parseTrustAnchors(dns.NewZoneParser(strings.NewReader(zones.keys["."].String()), ".", ""))
+	assert.NoError(t, err)
+	assert.Equal(t, []*dns.DS{zones.keys["."].ToDS(dns.SHA256)}, anchors)
+
+	anchors, err = parseTrustAnchors(dns.NewZoneParser(strings.NewReader(strings.Join(ROOT_ANCHORS, "\n")), ".", ""))
+	assert.NoError(t, err)
+	assert.Len(t, anchors, len(ROOT_ANCHORS))
+
+	_, err = parseTrustAnchors(dns.NewZoneParser(strings.NewReader("example. IN DS "+strings.Fields(ROOT_ANCHORS[0])[3]+" 8 2 "+strings.Repeat("00", 32)), ".", ""))
+	assert.Error(t, err)
+
+	_, err = parseTrustAnchors(dns.NewZoneParser(strings.NewReader("invalid"), ".", ""))
+	assert.Error(t, err)
+}
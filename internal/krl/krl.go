@@ -0,0 +1,177 @@
+// Package krl generates OpenSSH key revocation lists (KRLs) as described in
+// the PROTOCOL.krl file of OpenSSH.
+package krl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	KRL_MAGIC          = 0x5353484b524c0a00
+	KRL_FORMAT_VERSION = 1
+
+	KRL_SECTION_CERTIFICATES       = 1
+	KRL_SECTION_FINGERPRINT_SHA256 = 5
+
+	KRL_SECTION_CERT_SERIAL_LIST = 0x20
+	KRL_SECTION_CERT_KEY_ID      = 0x23
+)
+
+// KRL contains the revocations of one or more certificate authorities.
+type KRL struct {
+	// Version is the krl_version field, which should be increased whenever
+	// the list changes.
+	Version uint64
+	Comment string
+	// Certificates contains the revoked certificates per certificate
+	// authority.
+	Certificates []Certificates
+	// Fingerprints contains the raw SHA256 hashes of revoked public keys,
+	// regardless of whether they are certified or not.
+	Fingerprints [][]byte
+}
+
+// Certificates contains the revocations of certificates signed by a single
+// certificate authority.
+type Certificates struct {
+	// CAKey is the key of the certificate authority the serials and key ids
+	// are revoked for.
+	CAKey ssh.PublicKey
+	// Serials contains the serial numbers of revoked certificates.
+	Serials []uint64
+	// KeyIDs contains the key ids of revoked certificates.
+	KeyIDs []string
+}
+
+func putUint32(buf *bytes.Buffer, v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	buf.Write(b)
+}
+
+func putUint64(buf *bytes.Buffer, v uint64) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	buf.Write(b)
+}
+
+func putString(buf *bytes.Buffer, s []byte) {
+	putUint32(buf, uint32(len(s)))
+	buf.Write(s)
+}
+
+func putSection(buf *bytes.Buffer, sectionType byte, data []byte) {
+	buf.WriteByte(sectionType)
+	putString(buf, data)
+}
+
+// Marshal returns the binary representation of the KRL, as understood by the
+// RevokedKeys option of sshd(8) and ssh-keygen -Q.
+func (k KRL) Marshal() []byte {
+	var buf bytes.Buffer
+
+	putUint64(&buf, KRL_MAGIC)
+	putUint32(&buf, KRL_FORMAT_VERSION)
+	putUint64(&buf, k.Version)
+	putUint64(&buf, uint64(time.Now().Unix()))
+	putUint64(&buf, 0)   // flags
+	putString(&buf, nil) // reserved
+	putString(&buf, []byte(k.Comment))
+
+	// One section per certificate authority, see PROTOCOL.krl
+	for _, certs := range k.Certificates {
+		if section := certs.marshal(); section != nil {
+			putSection(&buf, KRL_SECTION_CERTIFICATES, section)
+		}
+	}
+
+	if len(k.Fingerprints) > 0 {
+		var hashes bytes.Buffer
+
+		// OpenSSH expects hashes to be sorted
+		fps := make([]string, len(k.Fingerprints))
+		for i, fp := range k.Fingerprints {
+			fps[i] = string(fp)
+		}
+
+		for _, fp := range sortedUniqueStrings(fps) {
+			putString(&hashes, []byte(fp))
+		}
+
+		putSection(&buf, KRL_SECTION_FINGERPRINT_SHA256, hashes.Bytes())
+	}
+
+	return buf.Bytes()
+}
+
+// marshal returns the content of the certificates section, or nil if there
+// are no revocations or no CA key.
+func (c Certificates) marshal() []byte {
+	if c.CAKey == nil || (len(c.Serials) == 0 && len(c.KeyIDs) == 0) {
+		return nil
+	}
+
+	var certs bytes.Buffer
+
+	putString(&certs, c.CAKey.Marshal())
+	putString(&certs, nil) // reserved
+
+	if len(c.Serials) > 0 {
+		var serials bytes.Buffer
+
+		for _, serial := range sortedUniqueSerials(c.Serials) {
+			putUint64(&serials, serial)
+		}
+
+		putSection(&certs, KRL_SECTION_CERT_SERIAL_LIST, serials.Bytes())
+	}
+
+	if len(c.KeyIDs) > 0 {
+		var keyIDs bytes.Buffer
+
+		for _, keyID := range sortedUniqueStrings(c.KeyIDs) {
+			putString(&keyIDs, []byte(keyID))
+		}
+
+		putSection(&certs, KRL_SECTION_CERT_KEY_ID, keyIDs.Bytes())
+	}
+
+	return certs.Bytes()
+}
+
+func sortedUniqueSerials(serials []uint64) []uint64 {
+	sorted := make([]uint64, 0, len(serials))
+	seen := make(map[uint64]bool)
+
+	for _, serial := range serials {
+		if !seen[serial] {
+			seen[serial] = true
+			sorted = append(sorted, serial)
+		}
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	return sorted
+}
+
+func sortedUniqueStrings(strs []string) []string {
+	sorted := make([]string, 0, len(strs))
+	seen := make(map[string]bool)
+
+	for _, str := range strs {
+		if !seen[str] {
+			seen[str] = true
+			sorted = append(sorted, str)
+		}
+	}
+
+	sort.Strings(sorted)
+
+	return sorted
+}
@@ -0,0 +1,61 @@
+package krl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKRL_Marshal(t *testing.T) {
+	pk, _, _ := ed25519.GenerateKey(nil)
+	caKey, _ := ssh.NewPublicKey(pk)
+
+	t.Run("Empty list", func(t *testing.T) {
+		blob := KRL{Version: 1}.Marshal()
+
+		assert.Equal(t, uint64(KRL_MAGIC), binary.BigEndian.Uint64(blob[0:8]))
+		assert.Equal(t, uint32(KRL_FORMAT_VERSION), binary.BigEndian.Uint32(blob[8:12]))
+		assert.Equal(t, uint64(1), binary.BigEndian.Uint64(blob[12:20]))
+		// header only: magic, format version, krl version, date, flags and
+		// two empty strings
+		assert.Len(t, blob, 8+4+8+8+8+4+4)
+	})
+
+	t.Run("Serials are sorted and unique", func(t *testing.T) {
+		blob := KRL{Version: 2, Certificates: []Certificates{{CAKey: caKey, Serials: []uint64{3, 1, 3}}}}.Marshal()
+
+		var serials bytes.Buffer
+		putUint64(&serials, 1)
+		putUint64(&serials, 3)
+
+		var section bytes.Buffer
+		putSection(&section, KRL_SECTION_CERT_SERIAL_LIST, serials.Bytes())
+
+		assert.True(t, bytes.HasSuffix(blob, section.Bytes()))
+	})
+
+	t.Run("Certificate section requires CA key", func(t *testing.T) {
+		with := KRL{Certificates: []Certificates{{CAKey: caKey, KeyIDs: []string{"oinit@example.com"}}}}.Marshal()
+		without := KRL{Certificates: []Certificates{{KeyIDs: []string{"oinit@example.com"}}}}.Marshal()
+
+		assert.Contains(t, string(with), "oinit@example.com")
+		assert.NotContains(t, string(without), "oinit@example.com")
+	})
+
+	t.Run("One section per CA key", func(t *testing.T) {
+		pk2, _, _ := ed25519.GenerateKey(nil)
+		caKey2, _ := ssh.NewPublicKey(pk2)
+
+		blob := KRL{Certificates: []Certificates{
+			{CAKey: caKey, Serials: []uint64{1}},
+			{CAKey: caKey2, Serials: []uint64{2}},
+		}}.Marshal()
+
+		assert.Equal(t, 2, bytes.Count(blob, []byte{KRL_SECTION_CERT_SERIAL_LIST, 0, 0, 0, 8}))
+		assert.Less(t, bytes.Index(blob, caKey.Marshal()), bytes.Index(blob, caKey2.Marshal()))
+	})
+}
@@ -0,0 +1,236 @@
+// Package ledger keeps a persistent record of all certificates issued by
+// oinit-ca and hands out their serial numbers.
+package ledger
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	ERR_LOCKED = "database is in use by another process, such as a running oinit-ca"
+
+	OPEN_TIMEOUT = 5 * time.Second
+
+	TYPE_USER = "user"
+	TYPE_HOST = "host"
+
+	REVOKE_SERIAL      = "serial"
+	REVOKE_KEY_ID      = "key-id"
+	REVOKE_FINGERPRINT = "fingerprint"
+)
+
+var (
+	bucketCertificates = []byte("certificates")
+	bucketRevocations  = []byte("revocations")
+)
+
+// Entry describes a single issued certificate.
+type Entry struct {
+	Serial        uint64    `json:"serial"`
+	Type          string    `json:"type"`
+	Host          string    `json:"host"`
+	SSHUser       string    `json:"ssh_user,omitempty"`
+	Subject       string    `json:"sub,omitempty"`
+	Issuer        string    `json:"iss,omitempty"`
+	Fingerprint   string    `json:"fingerprint"`
+	CAFingerprint string    `json:"ca_fingerprint"`
+	ValidAfter    time.Time `json:"valid_after"`
+	ValidBefore   time.Time `json:"valid_before"`
+	IssuedAt      time.Time `json:"issued_at"`
+}
+
+// Revocation describes a revoked serial number, key id or public key
+// fingerprint.
+type Revocation struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	// CAFingerprint limits the revocation to certificates issued by the
+	// given CA. An empty value applies the revocation to all CAs.
+	CAFingerprint string    `json:"ca_fingerprint,omitempty"`
+	RevokedAt     time.Time `json:"revoked_at"`
+}
+
+// Ledger is a certificate ledger stored in a bbolt database file.
+//
+// The database file is kept open until Close is called. bbolt locks the file
+// exclusively while it is open, so other processes, such as the admin
+// commands of oinit-ca, cannot access the ledger in the meantime.
+type Ledger struct {
+	db *bolt.DB
+}
+
+// Open returns the ledger stored at the given path. The file is created if
+// it doesn't exist yet. ERR_LOCKED is returned if the file is opened by
+// another process.
+func Open(path string) (*Ledger, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: OPEN_TIMEOUT})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, errors.New(ERR_LOCKED)
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketCertificates, bucketRevocations} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Ledger{db: db}, nil
+}
+
+// Close closes the database file. Transactions in progress are completed
+// first.
+func (l *Ledger) Close() error {
+	return l.db.Close()
+}
+
+// itob returns the big endian representation of v, which keeps keys sorted
+// by serial within the bucket.
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+
+	return b
+}
+
+// Issue allocates a new serial number and passes it to sign, which is
+// expected to sign the certificate and return the entry describing it. The
+// entry is then recorded in the ledger.
+//
+// Serial numbers are unique and monotonically increasing, starting with 1. If
+// sign returns an error, nothing is recorded and the serial number is not
+// used up.
+func (l *Ledger) Issue(sign func(serial uint64) (Entry, error)) (Entry, error) {
+	var entry Entry
+
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketCertificates)
+
+		serial, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		entry, err = sign(serial)
+		if err != nil {
+			return err
+		}
+
+		entry.Serial = serial
+		if entry.IssuedAt.IsZero() {
+			entry.IssuedAt = time.Now()
+		}
+
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(itob(serial), value)
+	})
+
+	return entry, err
+}
+
+// Get returns the entry of the certificate with the given serial number.
+func (l *Ledger) Get(serial uint64) (Entry, error) {
+	var entry Entry
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(bucketCertificates).Get(itob(serial))
+		if value == nil {
+			return errors.New("certificate not found")
+		}
+
+		return json.Unmarshal(value, &entry)
+	})
+
+	return entry, err
+}
+
+// List returns all entries of the ledger, ordered by serial number.
+func (l *Ledger) List() ([]Entry, error) {
+	var entries []Entry
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCertificates).ForEach(func(_, value []byte) error {
+			var entry Entry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return err
+			}
+
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+
+	return entries, err
+}
+
+// Revoke records the given revocation. Revoking the same value twice is not
+// an error.
+func (l *Ledger) Revoke(revocation Revocation) error {
+	if revocation.RevokedAt.IsZero() {
+		revocation.RevokedAt = time.Now()
+	}
+
+	value, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRevocations)
+		key := []byte(revocation.Type + ":" + revocation.Value)
+
+		if b.Get(key) != nil {
+			return nil
+		}
+
+		// The bucket sequence is used as version of the revocation list and
+		// therefore increased with every change.
+		if _, err := b.NextSequence(); err != nil {
+			return err
+		}
+
+		return b.Put(key, value)
+	})
+}
+
+// Revocations returns all recorded revocations as well as a version number,
+// which increases with every new revocation.
+func (l *Ledger) Revocations() ([]Revocation, uint64, error) {
+	var revocations []Revocation
+	var version uint64
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketRevocations)
+		version = b.Sequence()
+
+		return b.ForEach(func(_, value []byte) error {
+			var revocation Revocation
+			if err := json.Unmarshal(value, &revocation); err != nil {
+				return err
+			}
+
+			revocations = append(revocations, revocation)
+			return nil
+		})
+	})
+
+	return revocations, version, err
+}
@@ -0,0 +1,96 @@
+package ledger
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedger_Issue(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "ledger.db"))
+	assert.NoError(t, err)
+	defer l.Close()
+
+	for want := uint64(1); want <= 3; want++ {
+		entry, err := l.Issue(func(serial uint64) (Entry, error) {
+			return Entry{Type: TYPE_USER, Host: "example.com"}, nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, want, entry.Serial)
+	}
+
+	// A failed signing operation must neither be recorded nor use up a serial
+	_, err = l.Issue(func(serial uint64) (Entry, error) {
+		return Entry{}, errors.New("signing failed")
+	})
+	assert.Error(t, err)
+
+	entry, err := l.Issue(func(serial uint64) (Entry, error) {
+		return Entry{Type: TYPE_HOST, Host: "login.example.com"}, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), entry.Serial)
+
+	entries, err := l.List()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+
+	got, err := l.Get(4)
+	assert.NoError(t, err)
+	assert.Equal(t, "login.example.com", got.Host)
+
+	_, err = l.Get(5)
+	assert.Error(t, err)
+}
+
+func TestLedger_Revoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.db")
+
+	l, err := Open(path)
+	assert.NoError(t, err)
+
+	revocations, version, err := l.Revocations()
+	assert.NoError(t, err)
+	assert.Empty(t, revocations)
+	assert.Equal(t, uint64(0), version)
+
+	assert.NoError(t, l.Revoke(Revocation{Type: REVOKE_SERIAL, Value: "1", CAFingerprint: "SHA256:ca"}))
+	assert.NoError(t, l.Revoke(Revocation{Type: REVOKE_KEY_ID, Value: "oinit@login.example.com"}))
+
+	revocations, version, err = l.Revocations()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), version)
+	assert.Len(t, revocations, 2)
+
+	assert.Equal(t, REVOKE_KEY_ID, revocations[0].Type)
+	assert.Equal(t, "oinit@login.example.com", revocations[0].Value)
+	assert.False(t, revocations[0].RevokedAt.IsZero())
+
+	assert.Equal(t, REVOKE_SERIAL, revocations[1].Type)
+	assert.Equal(t, "SHA256:ca", revocations[1].CAFingerprint)
+
+	// Revoking the same value again does not change the version
+	assert.NoError(t, l.Revoke(Revocation{Type: REVOKE_SERIAL, Value: "1"}))
+
+	revocations, version, err = l.Revocations()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), version)
+	assert.Len(t, revocations, 2)
+
+	// Revocations are persisted
+	assert.NoError(t, l.Close())
+
+	l, err = Open(path)
+	assert.NoError(t, err)
+	defer l.Close()
+
+	assert.NoError(t, l.Revoke(Revocation{Type: REVOKE_FINGERPRINT, Value: "SHA256:key"}))
+
+	revocations, version, err = l.Revocations()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), version)
+	assert.Len(t, revocations, 3)
+}
@@ -0,0 +1,105 @@
+package liboinitca
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HealthStore remembers which CA endpoints recently failed, so that they are
+// not tried first on every request.
+type HealthStore interface {
+	// IsDown returns whether the endpoint recently failed.
+	IsDown(addr string) bool
+	// MarkDown records that a request to the endpoint failed.
+	MarkDown(addr string)
+	// MarkUp records that a request to the endpoint succeeded.
+	MarkUp(addr string)
+}
+
+// FileHealth is a HealthStore that persists failed endpoints in a JSON file,
+// so that the state is shared between invocations of the client. Endpoints
+// are considered down for the given duration after they failed.
+type FileHealth struct {
+	path     string
+	duration time.Duration
+	mu       sync.Mutex
+}
+
+// NewFileHealth returns a HealthStore persisted in the file at the given path.
+func NewFileHealth(path string, duration time.Duration) *FileHealth {
+	return &FileHealth{
+		path:     path,
+		duration: duration,
+	}
+}
+
+// load returns the endpoints and the time until which they are considered
+// down. A missing or malformed file results in an empty map.
+func (h *FileHealth) load() map[string]time.Time {
+	down := make(map[string]time.Time)
+
+	if content, err := os.ReadFile(h.path); err == nil {
+		json.Unmarshal(content, &down)
+	}
+
+	return down
+}
+
+// save writes the given endpoints to the file. Expired entries are removed.
+// Errors are ignored, as the health state is only an optimization.
+func (h *FileHealth) save(down map[string]time.Time) {
+	for addr, until := range down {
+		if time.Now().After(until) {
+			delete(down, addr)
+		}
+	}
+
+	content, err := json.Marshal(down)
+	if err != nil {
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return
+	}
+
+	// Write to temporary file first, as several clients may run at once
+	tmp := h.path + ".tmp"
+	if os.WriteFile(tmp, content, 0600) == nil {
+		os.Rename(tmp, h.path)
+	}
+}
+
+func (h *FileHealth) IsDown(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	until, ok := h.load()[addr]
+
+	return ok && time.Now().Before(until)
+}
+
+func (h *FileHealth) MarkDown(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	down := h.load()
+	down[addr] = time.Now().Add(h.duration)
+	h.save(down)
+}
+
+func (h *FileHealth) MarkUp(addr string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	down := h.load()
+	if _, ok := down[addr]; !ok {
+		return
+	}
+
+	delete(down, addr)
+	h.save(down)
+}
@@ -8,7 +8,9 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/lbrocke/oinit/internal/api"
 )
@@ -18,12 +20,73 @@ const (
 	ERR_RESPONSE_BODY        = "cannot parse response body"
 	ERR_SERVER_RESPONSE      = "server responded: "
 	ERR_SERVER_RESPONSE_CODE = "server responded with unexpected code: %d"
+	ERR_RATE_LIMITED         = "%s (retry after %s)"
 
 	API_V1 = "/api/v1"
+
+	// Requests that are rate limited are retried up to MAX_RETRIES times, if
+	// the server asks to wait for MAX_RETRY_WAIT at most.
+	MAX_RETRIES    = 2
+	MAX_RETRY_WAIT = 10 * time.Second
+
+	// Endpoints not responding within REQUEST_TIMEOUT (including the response
+	// body) are considered down. Issuing a certificate involves requests of
+	// the CA to motley_cue, so this is not too short.
+	REQUEST_TIMEOUT = 30 * time.Second
+)
+
+// sleep and httpClient are replaced in tests
+var (
+	sleep      = time.Sleep
+	httpClient = &http.Client{Timeout: REQUEST_TIMEOUT}
 )
 
+// RateLimitError is returned if the CA rejected a request because of too many
+// requests (429), after retrying failed or if the requested wait is too long.
+type RateLimitError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf(ERR_RATE_LIMITED, e.Message, e.RetryAfter)
+}
+
+// parseRetryAfter returns the duration of the Retry-After header of the given
+// response, which is either a number of seconds or a date. Zero is returned
+// if the header is missing or invalid.
+func parseRetryAfter(res *http.Response) time.Duration {
+	value := res.Header.Get("Retry-After")
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil && time.Until(date) > 0 {
+		return time.Until(date).Round(time.Second)
+	}
+
+	return 0
+}
+
+// parseRateLimitError returns a RateLimitError for the given 429 response.
+func parseRateLimitError(res *http.Response) error {
+	var response api.ApiResponseError
+
+	// Proxies may respond without a JSON body
+	message := http.StatusText(http.StatusTooManyRequests)
+	if parseResponse(res.Body, &response) == nil && response.Error != "" {
+		message = response.Error
+	}
+
+	return &RateLimitError{Message: message, RetryAfter: parseRetryAfter(res)}
+}
+
+// Client talks to one or more replicas of a CA. Requests are sent to the
+// first endpoint that works, see do().
 type Client struct {
-	addr string
+	addrs  []string
+	health HealthStore
 }
 
 // parseError tries to unmarshal the given response body into
@@ -51,30 +114,133 @@ func parseResponse(responseBody io.ReadCloser, into interface{}) error {
 	return nil
 }
 
-// NewClient creates a new API client. addr is the server address (and port)
-// including the protocol, such as http://example.com:8080
-func NewClient(addr string) Client {
-	addr, _ = strings.CutSuffix(addr, "/")
+// NewClient creates a new API client. addrs are the server addresses (and
+// ports) including the protocol, such as http://example.com:8080, of replicas
+// of the same CA. They are tried in the given order.
+func NewClient(addrs ...string) Client {
+	trimmed := make([]string, len(addrs))
+	for i, addr := range addrs {
+		trimmed[i], _ = strings.CutSuffix(strings.TrimSpace(addr), "/")
+	}
 
 	return Client{
-		addr: addr,
+		addrs: trimmed,
+	}
+}
+
+// WithHealth returns a copy of the client that remembers failed endpoints in
+// the given HealthStore and tries them last.
+func (c Client) WithHealth(health HealthStore) Client {
+	c.health = health
+
+	return c
+}
+
+// do sends a request to the endpoints of the client until one of them
+// responds with a status code below 500. Endpoints that are known to be down
+// are tried last. The response of the last endpoint is returned if all of
+// them fail. newRequest is called for every endpoint, as request bodies can
+// only be read once.
+func (c Client) do(newRequest func(addr string) (*http.Request, error)) (*http.Response, error) {
+	var up, down []string
+
+	for _, addr := range c.addrs {
+		if c.health != nil && c.health.IsDown(addr) {
+			down = append(down, addr)
+		} else {
+			up = append(up, addr)
+		}
+	}
+
+	addrs := append(up, down...)
+	if len(addrs) == 0 {
+		return nil, errors.New(ERR_REQUEST)
+	}
+
+	for i, addr := range addrs {
+		last := i == len(addrs)-1
+
+		req, err := newRequest(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := httpClient.Do(req)
+		if err == nil && res.StatusCode < http.StatusInternalServerError {
+			if c.health != nil {
+				c.health.MarkUp(addr)
+			}
+
+			return res, nil
+		}
+
+		if c.health != nil {
+			c.health.MarkDown(addr)
+		}
+
+		if last {
+			if err != nil {
+				return nil, errors.New(ERR_REQUEST)
+			}
+
+			return res, nil
+		}
+
+		if err == nil {
+			res.Body.Close()
+		}
+	}
+
+	// Not reached, as the last endpoint always returns
+	return nil, errors.New(ERR_REQUEST)
+}
+
+// doWithRetry sends a request like do(), but honors responses with status code
+// 429 (too many requests) by waiting for the duration given in their
+// Retry-After header and retrying, see MAX_RETRIES and MAX_RETRY_WAIT. Other
+// endpoints are not tried in this case, as the limit applies to the client.
+func (c Client) doWithRetry(newRequest func(addr string) (*http.Request, error)) (*http.Response, error) {
+	for retries := 0; ; retries++ {
+		res, err := c.do(newRequest)
+		if err != nil || res.StatusCode != http.StatusTooManyRequests || retries == MAX_RETRIES {
+			return res, err
+		}
+
+		wait := parseRetryAfter(res)
+		if wait <= 0 || wait > MAX_RETRY_WAIT {
+			return res, nil
+		}
+
+		res.Body.Close()
+		sleep(wait)
 	}
 }
 
-// Return the CA public key and supported OpenID Connect providers.
+// Return the CA public keys and supported OpenID Connect providers.
 func (c Client) GetHost(host string) (api.ApiResponseHost, error) {
 	var response api.ApiResponseHost
 
-	res, err := http.Get(fmt.Sprintf("%s%s/%s", c.addr, API_V1, url.PathEscape(host)))
+	res, err := c.doWithRetry(func(addr string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, fmt.Sprintf("%s%s/%s", addr, API_V1, url.PathEscape(host)), nil)
+	})
 	if err != nil {
-		return response, errors.New(ERR_REQUEST)
+		return response, err
 	}
 
 	defer res.Body.Close()
 
 	switch res.StatusCode {
 	case http.StatusOK:
-		return response, parseResponse(res.Body, &response)
+		if err := parseResponse(res.Body, &response); err != nil {
+			return response, err
+		}
+
+		// CAs not supporting key rotation only return the active key
+		if len(response.PublicKeys) == 0 && response.PublicKey != "" {
+			response.PublicKeys = []string{response.PublicKey}
+		}
+
+		return response, nil
 	case http.StatusBadRequest:
 		fallthrough
 	case http.StatusNotFound:
@@ -83,26 +249,42 @@ func (c Client) GetHost(host string) (api.ApiResponseHost, error) {
 		fallthrough
 	case http.StatusBadGateway:
 		return response, parseError(res.Body)
+	case http.StatusTooManyRequests:
+		return response, parseRateLimitError(res)
 	default:
 		return response, fmt.Errorf(ERR_SERVER_RESPONSE_CODE, res.StatusCode)
 	}
 }
 
 // Generate and return a new SSH certificate using the given access token.
-func (c Client) PostHostCertificate(host, pubkey, token string) (api.ApiResponseCertificate, error) {
+// Optionally, a lifetime (in seconds) shorter than the one configured at the
+// CA and a subset of principals can be requested. Use 0 and nil to request
+// the defaults.
+func (c Client) PostHostCertificate(host, pubkey, token string, lifetime uint64, principals []string) (api.ApiResponseCertificate, error) {
 	var response api.ApiResponseCertificate
 
 	reqBody, err := json.Marshal(api.FormHostCertificate{
-		Publickey: pubkey,
-		Token:     token,
+		Publickey:  pubkey,
+		Token:      token,
+		Lifetime:   lifetime,
+		Principals: principals,
 	})
 	if err != nil {
 		return response, err
 	}
 
-	res, err := http.Post(fmt.Sprintf("%s%s/%s/certificate", c.addr, API_V1, url.PathEscape(host)), "application/json", bytes.NewReader(reqBody))
+	res, err := c.doWithRetry(func(addr string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s%s/%s/certificate", addr, API_V1, url.PathEscape(host)), bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		return req, nil
+	})
 	if err != nil {
-		return response, errors.New(ERR_REQUEST)
+		return response, err
 	}
 
 	defer res.Body.Close()
@@ -114,12 +296,16 @@ func (c Client) PostHostCertificate(host, pubkey, token string) (api.ApiResponse
 		fallthrough
 	case http.StatusUnauthorized:
 		fallthrough
+	case http.StatusForbidden:
+		fallthrough
 	case http.StatusNotFound:
 		fallthrough
 	case http.StatusInternalServerError:
 		fallthrough
 	case http.StatusBadGateway:
 		return response, parseError(res.Body)
+	case http.StatusTooManyRequests:
+		return response, parseRateLimitError(res)
 	default:
 		return response, fmt.Errorf(ERR_SERVER_RESPONSE_CODE, res.StatusCode)
 	}
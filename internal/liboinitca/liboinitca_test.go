@@ -0,0 +1,156 @@
+package liboinitca
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lbrocke/oinit/internal/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func newServer(t *testing.T, status int, requests *int) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(api.ApiResponseHost{PublicKey: "ssh-ed25519 AAAA"})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestClientFailover(t *testing.T) {
+	var downRequests, upRequests int
+
+	down := newServer(t, http.StatusServiceUnavailable, &downRequests)
+	up := newServer(t, http.StatusOK, &upRequests)
+
+	health := NewFileHealth(filepath.Join(t.TempDir(), "health.json"), time.Minute)
+	client := NewClient(down.URL, up.URL+"/").WithHealth(health)
+
+	res, err := client.GetHost("login.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh-ed25519 AAAA", res.PublicKey)
+	assert.Equal(t, 1, downRequests)
+	assert.Equal(t, 1, upRequests)
+	assert.True(t, health.IsDown(down.URL))
+	assert.False(t, health.IsDown(up.URL))
+
+	// The failed endpoint is not tried again while it is considered down
+	_, err = client.GetHost("login.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, downRequests)
+	assert.Equal(t, 2, upRequests)
+
+	// The last response is returned if all endpoints fail
+	_, err = NewClient(down.URL).GetHost("login.example.com")
+	assert.Error(t, err)
+	assert.Equal(t, 2, downRequests)
+
+	// Unreachable endpoints are skipped as well
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	_, err = NewClient(unreachable.URL, up.URL).GetHost("login.example.com")
+	assert.NoError(t, err)
+}
+
+func TestClientTimeout(t *testing.T) {
+	httpClient = &http.Client{Timeout: 100 * time.Millisecond}
+	t.Cleanup(func() { httpClient = &http.Client{Timeout: REQUEST_TIMEOUT} })
+
+	// Server that accepts requests, but never answers
+	done := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	t.Cleanup(hanging.Close)
+	t.Cleanup(func() { close(done) })
+
+	var upRequests int
+	up := newServer(t, http.StatusOK, &upRequests)
+
+	health := NewFileHealth(filepath.Join(t.TempDir(), "health.json"), time.Minute)
+
+	_, err := NewClient(hanging.URL).WithHealth(health).GetHost("login.example.com")
+	assert.EqualError(t, err, ERR_REQUEST)
+	assert.True(t, health.IsDown(hanging.URL))
+
+	// The next endpoint is tried after the timeout
+	res, err := NewClient(hanging.URL, up.URL).GetHost("login.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh-ed25519 AAAA", res.PublicKey)
+	assert.Equal(t, 1, upRequests)
+}
+
+func TestClientRateLimit(t *testing.T) {
+	var waited []time.Duration
+
+	sleep = func(d time.Duration) { waited = append(waited, d) }
+	t.Cleanup(func() { sleep = time.Sleep })
+
+	newLimitedServer := func(retryAfter string, limited int, requests *int) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*requests++
+
+			if *requests <= limited {
+				w.Header().Set("Retry-After", retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(api.ApiResponseError{Error: api.ERR_RATE_LIMITED})
+				return
+			}
+
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(api.ApiResponseCertificate{Certificate: "ssh-ed25519-cert-v01@openssh.com AAAA"})
+		}))
+		t.Cleanup(srv.Close)
+
+		return srv
+	}
+
+	t.Run("Retry", func(t *testing.T) {
+		var requests int
+		waited = nil
+
+		srv := newLimitedServer("2", 1, &requests)
+
+		res, err := NewClient(srv.URL).PostHostCertificate("login.example.com", "ssh-ed25519 AAAA", "token", 0, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "ssh-ed25519-cert-v01@openssh.com AAAA", res.Certificate)
+		assert.Equal(t, 2, requests)
+		assert.Equal(t, []time.Duration{2 * time.Second}, waited)
+	})
+
+	t.Run("Too long", func(t *testing.T) {
+		var requests int
+		waited = nil
+
+		srv := newLimitedServer("3600", 1, &requests)
+
+		_, err := NewClient(srv.URL).PostHostCertificate("login.example.com", "ssh-ed25519 AAAA", "token", 0, nil)
+
+		var rateLimitErr *RateLimitError
+		assert.ErrorAs(t, err, &rateLimitErr)
+		assert.Equal(t, time.Hour, rateLimitErr.RetryAfter)
+		assert.Equal(t, api.ERR_RATE_LIMITED, rateLimitErr.Message)
+		assert.Equal(t, 1, requests)
+		assert.Empty(t, waited)
+	})
+
+	t.Run("Retries exhausted", func(t *testing.T) {
+		var requests int
+		waited = nil
+
+		srv := newLimitedServer("1", 10, &requests)
+
+		_, err := NewClient(srv.URL).PostHostCertificate("login.example.com", "ssh-ed25519 AAAA", "token", 0, nil)
+		assert.Error(t, err)
+		assert.Equal(t, MAX_RETRIES+1, requests)
+		assert.Len(t, waited, MAX_RETRIES)
+	})
+}
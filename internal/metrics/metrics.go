@@ -0,0 +1,152 @@
+// Package metrics collects metrics of oinit-ca and exposes them in the
+// Prometheus format.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	NAMESPACE = "oinit_ca"
+
+	// Reasons for authorization failures in addition to the motley_cue
+	// states, see AuthorizationFailure()
+	REASON_INVALID_TOKEN = "invalid_token"
+	REASON_POLICY        = "policy"
+	REASON_MOTLEY_CUE    = "motley_cue_error"
+	REASON_RATE_LIMIT    = "rate_limit"
+
+	// Value of the code label of motley_cue requests without response
+	CODE_NO_RESPONSE = "none"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	certificatesIssued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "certificates_issued_total",
+		Help:      "Number of issued certificates by hostgroup and type (user or host).",
+	}, []string{"hostgroup", "type"})
+
+	authorizationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "authorization_failures_total",
+		Help:      "Number of rejected certificate requests by hostgroup and reason, which is either the motley_cue state of the user or one of invalid_token, policy, motley_cue_error and rate_limit.",
+	}, []string{"hostgroup", "reason"})
+
+	motleyCueRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name:      "motley_cue_requests_total",
+		Help:      "Number of requests to motley_cue by instance, path and response status code (none if no response was received).",
+	}, []string{"instance", "path", "code"})
+
+	motleyCueDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "motley_cue_request_duration_seconds",
+		Help:      "Duration of requests to motley_cue by instance and path.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"instance", "path"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of API requests by method, route and response status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "code"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		certificatesIssued,
+		authorizationFailures,
+		motleyCueRequests,
+		motleyCueDuration,
+		requestDuration,
+	)
+}
+
+// Handler returns the handler serving the metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Middleware returns a middleware function that measures the duration of
+// every request. Routes are identified by their pattern (such as
+// /api/v1/:host), so that the number of label values is limited.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unknown"
+		}
+
+		requestDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// CertificateIssued counts a certificate of the given type issued for a host
+// of the given hostgroup.
+func CertificateIssued(hostgroup, certType string) {
+	certificatesIssued.WithLabelValues(hostgroup, certType).Inc()
+}
+
+// AuthorizationFailure counts a certificate request for a host of the given
+// hostgroup that was rejected for the given reason.
+func AuthorizationFailure(hostgroup, reason string) {
+	authorizationFailures.WithLabelValues(hostgroup, reason).Inc()
+}
+
+// MotleyCueObserver returns a function to be passed to
+// libmotleycue.Client.WithObserver, which records requests to the motley_cue
+// instance at the given URL.
+func MotleyCueObserver(instance string) func(string, time.Duration, int, error) {
+	return func(path string, duration time.Duration, statusCode int, err error) {
+		code := CODE_NO_RESPONSE
+		if statusCode != 0 {
+			code = strconv.Itoa(statusCode)
+		}
+
+		motleyCueRequests.WithLabelValues(instance, path, code).Inc()
+		motleyCueDuration.WithLabelValues(instance, path).Observe(duration.Seconds())
+	}
+}
+
+// RegisterCache exposes the hits and misses of a cache, as returned by the
+// given function (such as util.TimedCache.Stats), using the given name.
+func RegisterCache(name string, stats func() (uint64, uint64)) {
+	registry.MustRegister(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   NAMESPACE,
+			Name:        "cache_hits_total",
+			Help:        "Number of cache lookups that found a valid entry.",
+			ConstLabels: prometheus.Labels{"cache": name},
+		}, func() float64 {
+			hits, _ := stats()
+			return float64(hits)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   NAMESPACE,
+			Name:        "cache_misses_total",
+			Help:        "Number of cache lookups that found no or an expired entry.",
+			ConstLabels: prometheus.Labels{"cache": name},
+		}, func() float64 {
+			_, misses := stats()
+			return float64(misses)
+		}),
+	)
+}
@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(Middleware())
+	router.GET("/api/v1/:host", func(c *gin.Context) {
+		c.Status(http.StatusNotFound)
+	})
+
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/"+host, nil))
+	}
+
+	// Requests are counted per route, not per path
+	assert.Equal(t, 1, testutil.CollectAndCount(requestDuration))
+}
+
+func TestMotleyCueObserver(t *testing.T) {
+	observe := MotleyCueObserver("https://login.example.com:8443")
+
+	observe("/info", time.Second, http.StatusOK, nil)
+	observe("/user/deploy", time.Second, 0, assert.AnError)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(motleyCueRequests.WithLabelValues("https://login.example.com:8443", "/info", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(motleyCueRequests.WithLabelValues("https://login.example.com:8443", "/user/deploy", CODE_NO_RESPONSE)))
+}
@@ -0,0 +1,375 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const (
+	FLOW_DEVICE = "device"
+	FLOW_CODE   = "code"
+
+	DISCOVERY_PATH   = "/.well-known/openid-configuration"
+	GRANT_DEVICE     = "urn:ietf:params:oauth:grant-type:device_code"
+	GRANT_CODE       = "authorization_code"
+	DEFAULT_INTERVAL = 5 * time.Second
+	CODE_TIMEOUT     = 5 * time.Minute
+	HTTP_TIMEOUT     = 30 * time.Second
+
+	ERR_NO_DEVICE_FLOW = "the provider does not support the device authorization grant"
+	ERR_DISCOVERY      = "cannot retrieve provider configuration"
+	ERR_EXPIRED        = "the authorization request expired"
+	ERR_DENIED         = "the authorization request was denied"
+	ERR_STATE          = "invalid state in authorization response"
+)
+
+// OAuthClient contains the credentials of the OAuth client registered at the
+// provider. Secret may be empty for public clients.
+type OAuthClient struct {
+	ID     string
+	Secret string
+}
+
+type providerMetadata struct {
+	Issuer                      string `json:"issuer"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+}
+
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// httpClient is used for all requests to providers, it is replaced in tests
+var httpClient = &http.Client{Timeout: HTTP_TIMEOUT}
+
+func getMetadata(issuer string) (providerMetadata, error) {
+	var meta providerMetadata
+
+	res, err := httpClient.Get(strings.TrimSuffix(issuer, "/") + DISCOVERY_PATH)
+	if err != nil {
+		return meta, errors.New(ERR_DISCOVERY)
+	}
+
+	defer res.Body.Close()
+
+	if body, err := io.ReadAll(res.Body); err != nil || res.StatusCode != http.StatusOK ||
+		json.Unmarshal(body, &meta) != nil || meta.TokenEndpoint == "" {
+		return meta, errors.New(ERR_DISCOVERY)
+	}
+
+	// From OpenID Connect Discovery 1.0, section 4.3:
+	//   The issuer value returned MUST be identical to the Issuer URL that was
+	//   directly used to retrieve the configuration information.
+	if meta.Issuer != issuer {
+		return meta, errors.New(ERR_DISCOVERY)
+	}
+
+	return meta, nil
+}
+
+// postForm sends the given form to the given endpoint, authenticating the
+// client using HTTP basic authentication if a secret is set. The response
+// body is unmarshalled into the given struct regardless of the status code,
+// as OAuth error responses are JSON-encoded as well.
+func postForm(endpoint string, client OAuthClient, form url.Values, into interface{}) error {
+	if client.Secret == "" {
+		form.Set("client_id", client.ID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	if client.Secret != "" {
+		req.SetBasicAuth(url.QueryEscape(client.ID), url.QueryEscape(client.Secret))
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, into); err != nil {
+		return fmt.Errorf("provider responded with code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+func tokenError(res tokenResponse) error {
+	if res.ErrorDescription != "" {
+		return errors.New(res.ErrorDescription)
+	}
+
+	return errors.New(res.Error)
+}
+
+// GetTokenDevice requests an access token using the OAuth 2.0 device
+// authorization grant (RFC 8628). prompt is called with the URL the user has
+// to visit and the code to enter there. This function blocks until the user
+// authorized the request, denied it, or the request expired.
+func GetTokenDevice(issuer string, scopes []string, client OAuthClient, prompt func(uri, code string)) (string, error) {
+	meta, err := getMetadata(issuer)
+	if err != nil {
+		return "", err
+	}
+
+	if meta.DeviceAuthorizationEndpoint == "" {
+		return "", errors.New(ERR_NO_DEVICE_FLOW)
+	}
+
+	var auth deviceAuthorizationResponse
+
+	if err := postForm(meta.DeviceAuthorizationEndpoint, client, url.Values{
+		"scope": {strings.Join(scopes, " ")},
+	}, &auth); err != nil {
+		return "", err
+	}
+
+	if auth.DeviceCode == "" {
+		return "", errors.New(ERR_NO_DEVICE_FLOW)
+	}
+
+	uri := auth.VerificationURIComplete
+	if uri == "" {
+		uri = auth.VerificationURI
+	}
+
+	prompt(uri, auth.UserCode)
+
+	interval := DEFAULT_INTERVAL
+	if auth.Interval > 0 {
+		interval = time.Duration(auth.Interval) * time.Second
+	}
+
+	expires := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	if auth.ExpiresIn <= 0 {
+		expires = time.Now().Add(CODE_TIMEOUT)
+	}
+
+	for time.Now().Before(expires) {
+		time.Sleep(interval)
+
+		var res tokenResponse
+
+		if err := postForm(meta.TokenEndpoint, client, url.Values{
+			"grant_type":  {GRANT_DEVICE},
+			"device_code": {auth.DeviceCode},
+		}, &res); err != nil {
+			return "", err
+		}
+
+		switch res.Error {
+		case "":
+			return res.AccessToken, nil
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			// From RFC 8628, section 3.5:
+			//   the interval MUST be increased by 5 seconds for this and all
+			//   subsequent requests.
+			interval += 5 * time.Second
+		case "access_denied":
+			return "", errors.New(ERR_DENIED)
+		case "expired_token":
+			return "", errors.New(ERR_EXPIRED)
+		default:
+			return "", tokenError(res)
+		}
+	}
+
+	return "", errors.New(ERR_EXPIRED)
+}
+
+// randomString returns a random URL-safe string suitable for PKCE code
+// verifiers and state parameters.
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// GetTokenCode requests an access token using the authorization code grant
+// with PKCE (RFC 7636) and a loopback redirect URI (RFC 8252). prompt is
+// called with the URL the user has to open in their browser, which this
+// function also tries to open automatically. This function blocks until the
+// browser was redirected back or CODE_TIMEOUT passed.
+func GetTokenCode(issuer string, scopes []string, client OAuthClient, prompt func(uri string)) (string, error) {
+	meta, err := getMetadata(issuer)
+	if err != nil {
+		return "", err
+	}
+
+	verifier, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+
+	redirectURI := fmt.Sprintf("http://%s/", listener.Addr().String())
+
+	type result struct {
+		code string
+		err  error
+	}
+	results := make(chan result, 1)
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Ignore other requests of the browser, such as /favicon.ico
+			if r.URL.Path != "/" {
+				http.NotFound(w, r)
+				return
+			}
+
+			query := r.URL.Query()
+
+			// Requests without the state of this authorization request were
+			// not sent by the provider, but possibly by other websites opened
+			// in the browser, and are ignored.
+			if query.Get("state") != state {
+				http.Error(w, ERR_STATE, http.StatusBadRequest)
+				return
+			}
+
+			var res result
+			switch {
+			case query.Get("error") != "":
+				res = result{err: tokenError(tokenResponse{
+					Error:            query.Get("error"),
+					ErrorDescription: query.Get("error_description"),
+				})}
+			default:
+				res = result{code: query.Get("code")}
+			}
+
+			// Only the first response is used
+			select {
+			case results <- res:
+			default:
+			}
+
+			fmt.Fprintln(w, "You can close this window and return to your terminal.")
+		}),
+	}
+
+	go srv.Serve(listener)
+	defer srv.Shutdown(context.Background())
+
+	authURL, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil || meta.AuthorizationEndpoint == "" {
+		return "", errors.New(ERR_DISCOVERY)
+	}
+
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", client.ID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	authURL.RawQuery = query.Encode()
+
+	prompt(authURL.String())
+	openBrowser(authURL.String())
+
+	var res result
+
+	select {
+	case res = <-results:
+	case <-time.After(CODE_TIMEOUT):
+		return "", errors.New(ERR_EXPIRED)
+	}
+
+	if res.err != nil {
+		return "", res.err
+	}
+
+	var token tokenResponse
+
+	if err := postForm(meta.TokenEndpoint, client, url.Values{
+		"grant_type":    {GRANT_CODE},
+		"code":          {res.code},
+		"redirect_uri":  {redirectURI},
+		"code_verifier": {verifier},
+	}, &token); err != nil {
+		return "", err
+	}
+
+	if token.Error != "" {
+		return "", tokenError(token)
+	}
+
+	return token.AccessToken, nil
+}
+
+// openBrowser tries to open the given URL in the default browser. Errors are
+// ignored, as the URL is also shown to the user.
+var openBrowser = func(url string) {
+	var cmd *exec.Cmd
+
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+
+	if cmd.Start() == nil {
+		go cmd.Wait()
+	}
+}
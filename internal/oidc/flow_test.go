@@ -0,0 +1,158 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newProvider starts a test server acting as OpenID Connect provider that
+// supports the device authorization and authorization code grants.
+func newProvider(t *testing.T) *httptest.Server {
+	var srv *httptest.Server
+	var challenge string
+	polls := 0
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(DISCOVERY_PATH, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(providerMetadata{
+			Issuer:                      srv.URL,
+			AuthorizationEndpoint:       srv.URL + "/authorize",
+			TokenEndpoint:               srv.URL + "/token",
+			DeviceAuthorizationEndpoint: srv.URL + "/device",
+		})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "oinit", r.FormValue("client_id"))
+		assert.Equal(t, "openid profile", r.FormValue("scope"))
+
+		json.NewEncoder(w).Encode(deviceAuthorizationResponse{
+			DeviceCode:      "device-code",
+			UserCode:        "ABCD-EFGH",
+			VerificationURI: srv.URL + "/verify",
+			ExpiresIn:       30,
+			Interval:        1,
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		assert.Equal(t, "S256", query.Get("code_challenge_method"))
+		challenge = query.Get("code_challenge")
+
+		redirect, _ := url.Parse(query.Get("redirect_uri"))
+		redirect.RawQuery = url.Values{
+			"code":  {"auth-code"},
+			"state": {query.Get("state")},
+		}.Encode()
+
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("grant_type") {
+		case GRANT_DEVICE:
+			assert.Equal(t, "device-code", r.FormValue("device_code"))
+
+			polls++
+			if polls == 1 {
+				json.NewEncoder(w).Encode(tokenResponse{Error: "authorization_pending"})
+				return
+			}
+		case GRANT_CODE:
+			assert.Equal(t, "auth-code", r.FormValue("code"))
+
+			hash := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+			if base64.RawURLEncoding.EncodeToString(hash[:]) != challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(tokenResponse{Error: "invalid_grant"})
+				return
+			}
+		}
+
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "access-token"})
+	})
+
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestGetTokenDevice(t *testing.T) {
+	srv := newProvider(t)
+
+	var prompted string
+	token, err := GetTokenDevice(srv.URL, []string{"openid", "profile"}, OAuthClient{ID: "oinit"}, func(uri, code string) {
+		prompted = code
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token", token)
+	assert.Equal(t, "ABCD-EFGH", prompted)
+}
+
+func TestGetTokenCode(t *testing.T) {
+	srv := newProvider(t)
+
+	// Do not open a browser during tests
+	openBrowser = func(string) {}
+
+	token, err := GetTokenCode(srv.URL, []string{"openid"}, OAuthClient{ID: "oinit"}, func(uri string) {
+		authURL, err := url.Parse(uri)
+		assert.NoError(t, err)
+
+		// Responses with another state are ignored
+		res, err := http.Get(authURL.Query().Get("redirect_uri") + "?code=forged&state=forged")
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+		// Act as browser, which follows the redirect back to oinit
+		go http.Get(uri)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token", token)
+}
+
+func TestGetMetadata(t *testing.T) {
+	srv := newProvider(t)
+
+	meta, err := getMetadata(srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, srv.URL+"/token", meta.TokenEndpoint)
+
+	// The issuer of the metadata must match
+	mux := http.NewServeMux()
+	mux.HandleFunc(DISCOVERY_PATH, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(providerMetadata{
+			Issuer:        srv.URL,
+			TokenEndpoint: srv.URL + "/token",
+		})
+	})
+	other := httptest.NewServer(mux)
+	t.Cleanup(other.Close)
+
+	_, err = getMetadata(other.URL)
+	assert.EqualError(t, err, ERR_DISCOVERY)
+
+	// Providers that never respond time out
+	httpClient = &http.Client{Timeout: 100 * time.Millisecond}
+	t.Cleanup(func() { httpClient = &http.Client{Timeout: HTTP_TIMEOUT} })
+
+	done := make(chan struct{})
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	t.Cleanup(hanging.Close)
+	t.Cleanup(func() { close(done) })
+
+	_, err = getMetadata(hanging.URL)
+	assert.EqualError(t, err, ERR_DISCOVERY)
+}
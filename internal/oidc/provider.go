@@ -0,0 +1,213 @@
+package oidc
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/lbrocke/oinit/internal/util"
+
+	"github.com/zalando/go-keyring"
+)
+
+const (
+	PROVIDER_ENV     = "env"
+	PROVIDER_AGENT   = "oidc-agent"
+	PROVIDER_DEVICE  = FLOW_DEVICE
+	PROVIDER_CODE    = FLOW_CODE
+	PROVIDER_COMMAND = "command"
+	PROVIDER_FILE    = "file"
+	PROVIDER_KEYRING = "keyring"
+
+	ERR_AGENT_NOT_RUNNING = "oidc-agent is not running"
+	ERR_NO_CLIENT         = "no OAuth client id configured"
+	ERR_EMPTY_TOKEN       = "received an empty token"
+)
+
+// IssuerSelector returns the OIDC issuer to request a token from, as well as
+// the scopes required for it. Selecting the issuer may involve contacting the
+// CA and prompting the user, therefore it is only called by providers that
+// actually need to know the issuer.
+type IssuerSelector func() (string, []string, error)
+
+// TokenProvider is a source of access tokens.
+type TokenProvider interface {
+	// GetToken returns an access token or an error if the provider cannot
+	// provide one.
+	GetToken(selectIssuer IssuerSelector) (string, error)
+}
+
+// OnceSelector wraps the given selector, so that it is called at most once.
+// This prevents prompting the user multiple times when several providers of
+// a chain need the issuer.
+func OnceSelector(selectIssuer IssuerSelector) IssuerSelector {
+	var called bool
+	var issuer string
+	var scopes []string
+	var err error
+
+	return func() (string, []string, error) {
+		if !called {
+			called = true
+			issuer, scopes, err = selectIssuer()
+		}
+
+		return issuer, scopes, err
+	}
+}
+
+// EnvProvider reads the token from the first non-empty environment variable
+// in Keys.
+type EnvProvider struct {
+	Keys []string
+}
+
+func (p EnvProvider) GetToken(IssuerSelector) (string, error) {
+	for _, key := range p.Keys {
+		if val := os.Getenv(strings.TrimSpace(key)); val != "" {
+			return val, nil
+		}
+	}
+
+	return "", errors.New("none of the environment variables " + strings.Join(p.Keys, ", ") + " is set")
+}
+
+// AgentProvider requests the token from oidc-agent.
+type AgentProvider struct{}
+
+func (p AgentProvider) GetToken(selectIssuer IssuerSelector) (string, error) {
+	if !AgentIsRunning() {
+		return "", errors.New(ERR_AGENT_NOT_RUNNING)
+	}
+
+	issuer, scopes, err := selectIssuer()
+	if err != nil {
+		return "", err
+	}
+
+	return nonEmpty(GetToken(issuer, scopes))
+}
+
+// FlowProvider requests the token from the issuer directly, using either the
+// device authorization grant (FLOW_DEVICE) or the authorization code grant
+// (FLOW_CODE). PromptDevice and PromptCode are passed to GetTokenDevice and
+// GetTokenCode respectively.
+type FlowProvider struct {
+	Flow         string
+	Client       OAuthClient
+	PromptDevice func(uri, code string)
+	PromptCode   func(uri string)
+}
+
+func (p FlowProvider) GetToken(selectIssuer IssuerSelector) (string, error) {
+	if p.Client.ID == "" {
+		return "", errors.New(ERR_NO_CLIENT)
+	}
+
+	issuer, scopes, err := selectIssuer()
+	if err != nil {
+		return "", err
+	}
+
+	if p.Flow == FLOW_CODE {
+		return nonEmpty(GetTokenCode(issuer, scopes, p.Client, p.PromptCode))
+	}
+
+	return nonEmpty(GetTokenDevice(issuer, scopes, p.Client, p.PromptDevice))
+}
+
+// CommandProvider runs Command using the system shell and uses its output as
+// token.
+type CommandProvider struct {
+	Command string
+}
+
+func (p CommandProvider) GetToken(IssuerSelector) (string, error) {
+	var cmd *exec.Cmd
+
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", p.Command)
+	} else {
+		cmd = exec.Command("sh", "-c", p.Command)
+	}
+
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.New("token command failed: " + err.Error())
+	}
+
+	return nonEmpty(strings.TrimSpace(string(out)), nil)
+}
+
+// FileProvider reads the token from the file at Path. A leading ~ is
+// replaced by the user's home directory.
+type FileProvider struct {
+	Path string
+}
+
+func (p FileProvider) GetToken(IssuerSelector) (string, error) {
+	path, err := util.ExpandHome(p.Path)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return nonEmpty(strings.TrimSpace(string(content)), nil)
+}
+
+// KeyringProvider reads the token from the keyring of the operating system,
+// such as the Secret Service on Linux, the Keychain on macOS or the Windows
+// Credential Manager.
+type KeyringProvider struct {
+	Service string
+	User    string
+}
+
+func (p KeyringProvider) GetToken(IssuerSelector) (string, error) {
+	token, err := keyring.Get(p.Service, p.User)
+	if err != nil {
+		return "", errors.New("keyring: " + err.Error())
+	}
+
+	return nonEmpty(strings.TrimSpace(token), nil)
+}
+
+// ChainProvider tries each provider in order and returns the first token
+// found. If no provider returns a token, the errors of all providers are
+// returned.
+type ChainProvider []TokenProvider
+
+func (p ChainProvider) GetToken(selectIssuer IssuerSelector) (string, error) {
+	var errs []string
+
+	for _, provider := range p {
+		token, err := provider.GetToken(selectIssuer)
+		if err == nil {
+			return token, nil
+		}
+
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) == 0 {
+		return "", errors.New("no token provider configured")
+	}
+
+	return "", errors.New(strings.Join(errs, "; "))
+}
+
+func nonEmpty(token string, err error) (string, error) {
+	if err == nil && token == "" {
+		return "", errors.New(ERR_EMPTY_TOKEN)
+	}
+
+	return token, err
+}
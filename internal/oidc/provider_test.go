@@ -0,0 +1,86 @@
+package oidc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type staticProvider struct {
+	token string
+	err   error
+}
+
+func (p staticProvider) GetToken(IssuerSelector) (string, error) {
+	return p.token, p.err
+}
+
+func TestEnvProvider(t *testing.T) {
+	t.Setenv("OINIT_TEST_A", "")
+	t.Setenv("OINIT_TEST_B", "token-b")
+
+	token, err := EnvProvider{Keys: []string{"OINIT_TEST_A", "OINIT_TEST_B"}}.GetToken(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-b", token)
+
+	_, err = EnvProvider{Keys: []string{"OINIT_TEST_A"}}.GetToken(nil)
+	assert.Error(t, err)
+}
+
+func TestFileProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(path, []byte("token-file\n"), 0600))
+
+	token, err := FileProvider{Path: path}.GetToken(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-file", token)
+
+	assert.NoError(t, os.WriteFile(path, []byte("\n"), 0600))
+
+	_, err = FileProvider{Path: path}.GetToken(nil)
+	assert.EqualError(t, err, ERR_EMPTY_TOKEN)
+}
+
+func TestCommandProvider(t *testing.T) {
+	token, err := CommandProvider{Command: "echo token-command"}.GetToken(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-command", token)
+
+	_, err = CommandProvider{Command: "exit 1"}.GetToken(nil)
+	assert.Error(t, err)
+}
+
+func TestChainProvider(t *testing.T) {
+	chain := ChainProvider{
+		staticProvider{err: errors.New("first")},
+		staticProvider{token: "second"},
+		staticProvider{token: "third"},
+	}
+
+	token, err := chain.GetToken(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", token)
+
+	_, err = ChainProvider{
+		staticProvider{err: errors.New("first")},
+		staticProvider{err: errors.New("second")},
+	}.GetToken(nil)
+	assert.EqualError(t, err, "first; second")
+}
+
+func TestOnceSelector(t *testing.T) {
+	calls := 0
+	selectIssuer := OnceSelector(func() (string, []string, error) {
+		calls++
+		return "https://issuer.example.com", nil, nil
+	})
+
+	selectIssuer()
+	issuer, _, _ := selectIssuer()
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, "https://issuer.example.com", issuer)
+}
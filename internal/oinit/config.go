@@ -0,0 +1,184 @@
+package oinit
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lbrocke/oinit/internal/sshutil"
+	"github.com/lbrocke/oinit/internal/util"
+
+	"golang.org/x/exp/slices"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	// Use ssh-agent if it is running, files otherwise
+	STORAGE_AUTO  = "auto"
+	STORAGE_AGENT = "agent"
+	STORAGE_FILE  = "file"
+)
+
+// Options contains the settings of the oinit client. They can be set
+// globally at the top of the configuration file, or for single hosts in a
+// section named after the host and port, such as [login.example.com:22] or
+// [*.example.com:22]. Sections of managed hosts additionally contain the CA
+// (see KEY_CA) and its pinned host CA public keys.
+type Options struct {
+	TokenProviders      []string `ini:"token-provider" delim:","`
+	TokenEnv            []string `ini:"token-env" delim:","`
+	TokenCommand        string   `ini:"token-command"`
+	TokenFile           string   `ini:"token-file"`
+	TokenKeyringService string   `ini:"token-keyring-service"`
+	TokenKeyringUser    string   `ini:"token-keyring-user"`
+	ClientID            string   `ini:"client-id"`
+	ClientSecret        string   `ini:"client-secret"`
+	CertLifetime        string   `ini:"cert-lifetime"`
+	CertPrincipals      []string `ini:"cert-principals" delim:","`
+	RenewBefore         string   `ini:"renew-before"`
+	KeyStorage          string   `ini:"key-storage"`
+	KeyFile             string   `ini:"key-file"`
+	KeyFingerprint      string   `ini:"key-fingerprint"`
+	Issuer              string   `ini:"issuer"`
+	AgentAccount        string   `ini:"agent-account"`
+	User                string   `ini:"user"`
+	DNSResolver         string   `ini:"dns-resolver"`
+	DNSRequireDNSSEC    bool     `ini:"dns-require-dnssec"`
+	DNSTrustAnchor      string   `ini:"dns-trust-anchor"`
+	CAKeys              []string `ini:"ca-key" delim:","`
+}
+
+// defaultOptions returns the options used if not configured otherwise.
+func defaultOptions() Options {
+	return Options{
+		TokenProviders: []string{"env", "oidc-agent", "device"},
+		TokenEnv: []string{"ACCESS_TOKEN", "OIDC", "OS_ACCESS_TOKEN",
+			"OIDC_ACCESS_TOKEN", "WATTS_TOKEN", "WATTSON_TOKEN"},
+		TokenKeyringService: "oinit",
+		RenewBefore:         "1m",
+		KeyStorage:          STORAGE_AUTO,
+		// These environment variables were used to preselect the issuer
+		// before the config file existed.
+		Issuer:       util.Getenvs("OIDC_ISS", "OIDC_ISSUER"),
+		AgentAccount: os.Getenv("OIDC_AGENT_ACCOUNT"),
+	}
+}
+
+// loadConfig loads the system and user configuration files. Values of the
+// user file take precedence. Missing files are ignored.
+func loadConfig() (*ini.File, error) {
+	paths, err := sshutil.PathsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return ini.LoadSources(ini.LoadOptions{Loose: true}, paths.System, paths.User)
+}
+
+// sectionMatches returns whether the given section name matches the given
+// host and port. Section names without port match port 22.
+func sectionMatches(name, host, port string) bool {
+	sectionHost, sectionPort, err := net.SplitHostPort(name)
+	if err != nil {
+		sectionHost = name
+		sectionPort = "22"
+	}
+
+	return util.MatchesHost(host, port, strings.ToLower(sectionHost), sectionPort)
+}
+
+// GetOptions returns the options for the given host/port, which are the
+// global options overridden by all sections matching the host.
+func GetOptions(hostport string) (Options, error) {
+	opts := defaultOptions()
+
+	host, port, err := net.SplitHostPort(strings.ToLower(hostport))
+	if err != nil {
+		return opts, err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return opts, err
+	}
+
+	if err := cfg.Section(ini.DefaultSection).MapTo(&opts); err != nil {
+		return opts, err
+	}
+
+	for _, section := range cfg.Sections() {
+		if section.Name() == ini.DefaultSection || !sectionMatches(section.Name(), host, port) {
+			continue
+		}
+
+		if err := section.MapTo(&opts); err != nil {
+			return opts, err
+		}
+	}
+
+	if opts.TokenKeyringUser == "" {
+		opts.TokenKeyringUser = host
+	}
+
+	return opts, nil
+}
+
+// ParseLifetime parses a certificate lifetime or renewal window, which is
+// either given in seconds or as duration such as "15m". An empty string
+// results in 0, which requests the lifetime configured at the CA.
+func ParseLifetime(lifetime string) (uint64, error) {
+	if lifetime == "" {
+		return 0, nil
+	}
+
+	if secs, err := strconv.ParseUint(lifetime, 10, 64); err == nil {
+		return secs, nil
+	}
+
+	dur, err := time.ParseDuration(lifetime)
+	if err != nil || dur < time.Second {
+		return 0, errors.New("invalid lifetime '" + lifetime + "'")
+	}
+
+	return uint64(dur.Seconds()), nil
+}
+
+// Principals returns the certificate principals to request, or nil to request
+// the defaults of the CA.
+func (o Options) Principals() []string {
+	var principals []string
+
+	for _, principal := range o.CertPrincipals {
+		if principal = strings.TrimSpace(principal); principal != "" {
+			principals = append(principals, principal)
+		}
+	}
+
+	return principals
+}
+
+// ConfiguredUsers returns the distinct values of the user option in all
+// sections of the config files, sorted.
+func ConfiguredUsers() ([]string, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []string
+
+	for _, section := range cfg.Sections() {
+		user := strings.TrimSpace(section.Key(KEY_USER).String())
+		if user != "" && !slices.Contains(users, user) {
+			users = append(users, user)
+		}
+	}
+
+	sort.Strings(users)
+
+	return users, nil
+}
@@ -0,0 +1,75 @@
+package oinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLifetime(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected uint64
+		err      bool
+	}{
+		{"", 0, false},
+		{"900", 900, false},
+		{"15m", 900, false},
+		{"1h30m", 5400, false},
+		{"500ms", 0, true},
+		{"-5m", 0, true},
+		{"soon", 0, true},
+	}
+
+	for _, test := range tests {
+		lifetime, err := ParseLifetime(test.input)
+
+		assert.Equal(t, test.err, err != nil, test.input)
+		assert.Equal(t, test.expected, lifetime, test.input)
+	}
+}
+
+func TestPrincipals(t *testing.T) {
+	assert.Nil(t, Options{}.Principals())
+	assert.Nil(t, Options{CertPrincipals: []string{" ", ""}}.Principals())
+	assert.Equal(t, []string{"oinit", "alice"}, Options{CertPrincipals: []string{" oinit", "alice "}}.Principals())
+
+	// The user option does not restrict the principals
+	assert.Nil(t, Options{User: "alice"}.Principals())
+}
+
+func TestConfiguredUsers(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	users, err := ConfiguredUsers()
+	assert.NoError(t, err)
+	assert.Empty(t, users)
+
+	dir := filepath.Join(home, ".ssh")
+	assert.NoError(t, os.MkdirAll(dir, 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "oinit_config"), []byte(
+		"user = oinit\n"+
+			"[login.example.com:22]\n"+
+			"ca   = https://ca.example.com\n"+
+			"user = alice\n"+
+			"[*.example.org:22]\n"+
+			"user = alice\n"+
+			"[login.example.net:22]\n"+
+			"user = bob\n"), 0600))
+
+	users, err = ConfiguredUsers()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob", "oinit"}, users)
+
+	opts, err := GetOptions("login.example.com:22")
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", opts.User)
+
+	opts, err = GetOptions("other.example.com:22")
+	assert.NoError(t, err)
+	assert.Equal(t, "oinit", opts.User)
+}
@@ -2,122 +2,305 @@ package oinit
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"net"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/lbrocke/oinit/internal/sshutil"
 	"github.com/lbrocke/oinit/internal/util"
+
+	"gopkg.in/ini.v1"
 )
 
-// AddHostUser adds the given host/port and CA to the user's hosts file.
-func AddHostUser(hostport, ca string) error {
-	hostport = strings.ToLower(hostport)
-	ca = strings.ToLower(ca)
+const (
+	// Key of host sections in the config file that holds the CA. Sections
+	// with this key are managed hosts.
+	KEY_CA = "ca"
+
+	// Key of host sections that holds the host CA public keys confirmed by
+	// the user when the host was added, or updated by 'oinit sync'
+	KEY_CA_KEY = "ca-key"
+
+	// Key of the issuer option, see Options
+	KEY_ISSUER = "issuer"
+
+	// Key of the user option, see Options
+	KEY_USER = "user"
+
+	// Suffix appended to the hosts file after it was migrated
+	MIGRATED_SUFFIX = ".migrated"
+)
+
+// readHostsFile reads a hosts file of the format used before the config file
+// was introduced, which contains one "<host>:<port> <ca>" line per host.
+func readHostsFile(path string) ([][2]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts [][2]string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+
+		hostport, ca, found := strings.Cut(scanner.Text(), " ")
+		if !found || strings.Contains(ca, " ") {
+			return nil, errors.New("malformed hosts file")
+		}
+
+		hosts = append(hosts, [2]string{strings.ToLower(hostport), ca})
+	}
+
+	return hosts, scanner.Err()
+}
+
+// loadUserConfig loads the user's config file. An empty config is returned if
+// the file does not exist.
+func loadUserConfig() (*ini.File, string, error) {
+	paths, err := sshutil.PathsConfig()
+	if err != nil {
+		return nil, "", err
+	}
+
+	cfg, err := ini.LoadSources(ini.LoadOptions{Loose: true}, paths.User)
+
+	return cfg, paths.User, err
+}
+
+// saveUserConfig writes the given config to the user's config file.
+func saveUserConfig(cfg *ini.File, path string) error {
+	var buf bytes.Buffer
+
+	if _, err := cfg.WriteTo(&buf); err != nil {
+		return err
+	}
 
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// migrateHostsFile moves the hosts of the user's hosts file into the user's
+// config file and renames the hosts file afterwards. Hosts already present in
+// the config file are not overwritten.
+func migrateHostsFile() error {
 	paths, err := sshutil.PathsHosts()
 	if err != nil {
 		return err
 	}
 
-	f, err := os.OpenFile(paths.User, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	hosts, err := readHostsFile(paths.User)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cfg, path, err := loadUserConfig()
 	if err != nil {
 		return err
 	}
 
-	if _, err = f.Write([]byte(hostport + " " + ca + "\n")); err != nil {
-		f.Close()
+	for _, host := range hosts {
+		section := cfg.Section(host[0])
+		if !section.HasKey(KEY_CA) {
+			section.Key(KEY_CA).SetValue(host[1])
+		}
+	}
+
+	if err := saveUserConfig(cfg, path); err != nil {
 		return err
 	}
 
-	f.Close()
+	return os.Rename(paths.User, paths.User+MIGRATED_SUFFIX)
+}
+
+// AddHostUser adds the given host/port, the endpoints of its CA and the host
+// CA public keys to pin to the user's config file.
+func AddHostUser(hostport string, cas []string, caKeys []string) error {
+	hostport = strings.ToLower(hostport)
+	ca := strings.ToLower(strings.Join(cas, ", "))
+
+	if err := migrateHostsFile(); err != nil {
+		return err
+	}
 
-	return nil
+	cfg, path, err := loadUserConfig()
+	if err != nil {
+		return err
+	}
+
+	section := cfg.Section(hostport)
+	section.Key(KEY_CA).SetValue(ca)
+	section.Key(KEY_CA_KEY).SetValue(strings.Join(caKeys, ", "))
+
+	return saveUserConfig(cfg, path)
 }
 
-// DeleteHostUser deletes a given host/port from the user's hosts file.
+// DeleteHostUser deletes a given host/port and its options from the user's
+// config file.
 // An error is returned in case of file-handling related errors. nil is
 // returned when the host/port was successfully deleted or if it wasn't found
 // in the user's file.
 func DeleteHostUser(hostport string) (bool, error) {
 	hostport = strings.ToLower(hostport)
 
-	paths, err := sshutil.PathsHosts()
+	// Use port 22 if not specified
+	_, _, err := net.SplitHostPort(hostport)
 	if err != nil {
+		hostport = net.JoinHostPort(hostport, "22")
+	}
+
+	if err := migrateHostsFile(); err != nil {
 		return false, err
 	}
 
-	// Use port 22 if not specified
-	_, _, err = net.SplitHostPort(hostport)
+	cfg, path, err := loadUserConfig()
 	if err != nil {
-		hostport = net.JoinHostPort(hostport, "22")
+		return false, err
+	}
+
+	if section, err := cfg.GetSection(hostport); err != nil || !section.HasKey(KEY_CA) {
+		return false, nil
+	}
+
+	cfg.DeleteSection(hostport)
+
+	return true, saveUserConfig(cfg, path)
+}
+
+// IsManagedHost checks whether the given host/port is a managed ssh server,
+// meaning that it is present in either the system or user config file.
+func IsManagedHost(hostport string) (bool, error) {
+	cas, err := GetCA(hostport)
+
+	return len(cas) > 0, err
+}
+
+// GetCA returns the endpoints of the CA stored in the user's config file for a
+// given host/port. Several endpoints (replicas of the CA) are separated by
+// commas.
+func GetCA(hostport string) ([]string, error) {
+	_, ca, err := getManagedHost(hostport)
+
+	return SplitCA(ca), err
+}
+
+// SplitCA splits the comma-separated CA endpoints of a managed host.
+func SplitCA(ca string) []string {
+	var cas []string
+
+	for _, addr := range strings.Split(ca, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			cas = append(cas, addr)
+		}
 	}
 
-	content, err := os.ReadFile(paths.User)
+	return cas
+}
+
+// getManagedHost returns the managed host/port (which may contain wildcards)
+// matching the given host/port, as well as its CA. Empty strings are returned
+// if the host/port is not managed.
+func getManagedHost(hostport string) (string, string, error) {
+	hostport = strings.ToLower(hostport)
+
+	managedHosts, err := GetManagedHosts()
 	if err != nil {
-		return false, err
+		return "", "", err
 	}
 
-	foundIndex := -1
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return "", "", err
+	}
 
-	lines := strings.Split(string(content), "\n")
-	for i, line := range lines {
-		managedHostport, _, found := strings.Cut(line, " ")
-		if !found {
-			// malformed line, ignore
+	for managedHostport, ca := range managedHosts {
+		managedHost, managedPort, err := net.SplitHostPort(managedHostport)
+		if err != nil {
 			continue
 		}
 
-		if managedHostport == hostport {
-			foundIndex = i
-			break
+		if util.MatchesHost(host, port, managedHost, managedPort) {
+			return managedHostport, ca, nil
 		}
 	}
 
-	if foundIndex == -1 {
-		return false, nil
+	return "", "", nil
+}
+
+// setManagedHostKey sets a key of the section of the managed host matching
+// the given host/port in the user's config file. An empty value removes the
+// key.
+func setManagedHostKey(hostport, key, value string) error {
+	managedHostport, _, err := getManagedHost(hostport)
+	if err != nil {
+		return err
+	} else if managedHostport == "" {
+		return errors.New("host is not managed by oinit")
+	}
+
+	cfg, path, err := loadUserConfig()
+	if err != nil {
+		return err
 	}
 
-	// Remove index i and write back to file
-	lines = append(lines[:foundIndex], lines[foundIndex+1:]...)
-	if err := os.WriteFile(paths.User, []byte(strings.Join(lines, "\n")), 0644); err != nil {
-		return true, err
+	// The section may not exist yet for hosts managed system-wide
+	section := cfg.Section(managedHostport)
+
+	if value == "" {
+		section.DeleteKey(key)
+	} else {
+		section.Key(key).SetValue(value)
 	}
 
-	return true, nil
+	return saveUserConfig(cfg, path)
 }
 
-// IsManagedHost checks whether the given host/port is a managed ssh server,
-// meaning that it is present in either the system or user managed hosts file.
-func IsManagedHost(hostport string) (bool, error) {
-	ca, err := GetCA(hostport)
+// SetIssuerUser sets the issuer option of the managed host matching the
+// given host/port in the user's config file, which preselects the issuer. An
+// empty issuer removes the option.
+func SetIssuerUser(hostport, issuer string) error {
+	return setManagedHostKey(hostport, KEY_ISSUER, issuer)
+}
 
-	return ca != "", err
+// SetCAKeysUser sets the pinned host CA public keys of the managed host
+// matching the given host/port in the user's config file.
+func SetCAKeysUser(hostport string, caKeys []string) error {
+	return setManagedHostKey(hostport, KEY_CA_KEY, strings.Join(caKeys, ", "))
 }
 
-// GetCA returns the CA stored in the user's hosts file for a given host/port.
-func GetCA(hostport string) (string, error) {
-	hostport = strings.ToLower(hostport)
+// GetHostport returns the host/port of the first managed host matching the
+// given host on any port, as certificates are issued for hosts regardless of
+// the port. An empty string is returned if the host is not managed.
+func GetHostport(host string) (string, error) {
+	host = strings.ToLower(host)
 
 	managedHosts, err := GetManagedHosts()
 	if err != nil {
 		return "", err
 	}
 
-	host, port, err := net.SplitHostPort(hostport)
-	if err != nil {
-		return "", err
+	hostports := make([]string, 0, len(managedHosts))
+	for managedHostport := range managedHosts {
+		hostports = append(hostports, managedHostport)
 	}
+	sort.Strings(hostports)
 
-	for managedHostport, ca := range managedHosts {
+	for _, managedHostport := range hostports {
 		managedHost, managedPort, err := net.SplitHostPort(managedHostport)
 		if err != nil {
 			continue
 		}
 
-		if util.MatchesHost(host, port, managedHost, managedPort) {
-			return ca, nil
+		if util.MatchesHost(host, managedPort, strings.ToLower(managedHost), managedPort) {
+			return net.JoinHostPort(host, managedPort), nil
 		}
 	}
 
@@ -125,35 +308,52 @@ func GetCA(hostport string) (string, error) {
 }
 
 // GetManagedHosts returns all managed hosts (keys) and their respective CAs
-// (values) as a map.
+// (values) as a map. Hosts of the user's config file take precedence over
+// the ones of the system config file. The system-wide hosts file is still
+// read, as it cannot be migrated without root privileges.
 func GetManagedHosts() (map[string]string, error) {
-	paths, err := sshutil.PathsHosts()
+	if err := migrateHostsFile(); err != nil {
+		return nil, err
+	}
+
+	configPaths, err := sshutil.PathsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	hostsPaths, err := sshutil.PathsHosts()
 	if err != nil {
 		return nil, err
 	}
 
 	hosts := make(map[string]string)
 
-	for _, path := range []string{paths.User, paths.System} {
-		f, err := os.Open(path)
+	for _, path := range []string{configPaths.User, configPaths.System} {
+		cfg, err := ini.LoadSources(ini.LoadOptions{Loose: true}, path)
 		if err != nil {
-			continue
+			return nil, err
 		}
-		defer f.Close()
 
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			hostport, ca, found := strings.Cut(scanner.Text(), " ")
-			if !found || strings.Contains(ca, " ") {
-				return nil, errors.New("malformed hosts file")
-			}
+		for _, section := range cfg.Sections() {
+			hostport := strings.ToLower(section.Name())
 
-			if _, exists := hosts[hostport]; exists {
+			if _, exists := hosts[hostport]; exists || !section.HasKey(KEY_CA) {
 				// do not overwrite existing keys
 				continue
 			}
 
-			hosts[hostport] = ca
+			hosts[hostport] = section.Key(KEY_CA).String()
+		}
+	}
+
+	legacy, err := readHostsFile(hostsPaths.System)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, host := range legacy {
+		if _, exists := hosts[host[0]]; !exists {
+			hosts[host[0]] = host[1]
 		}
 	}
 
@@ -0,0 +1,79 @@
+package oinit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrateHostsFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("OIDC_ISS", "")
+	t.Setenv("OIDC_ISSUER", "")
+
+	dir := filepath.Join(home, ".ssh")
+	assert.NoError(t, os.MkdirAll(dir, 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "oinit_hosts"), []byte(
+		"login.example.com:22 https://ca.example.com\n"+
+			"*.example.org:2222 https://ca.example.org\n",
+	), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "oinit_config"), []byte(
+		"token-provider = oidc-agent\n\n"+
+			"[login.example.com:22]\n"+
+			"issuer = https://issuer.example.com\n",
+	), 0600))
+
+	hosts, err := GetManagedHosts()
+	assert.NoError(t, err)
+	assert.Equal(t, "https://ca.example.com", hosts["login.example.com:22"])
+	assert.Equal(t, "https://ca.example.org", hosts["*.example.org:2222"])
+
+	assert.NoFileExists(t, filepath.Join(dir, "oinit_hosts"))
+	assert.FileExists(t, filepath.Join(dir, "oinit_hosts"+MIGRATED_SUFFIX))
+
+	// Existing options are kept
+	opts, err := GetOptions("login.example.com:22")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"oidc-agent"}, opts.TokenProviders)
+	assert.Equal(t, "https://issuer.example.com", opts.Issuer)
+
+	cas, err := GetCA("sub.example.org:2222")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://ca.example.org"}, cas)
+
+	found, err := DeleteHostUser("login.example.com")
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	managed, err := IsManagedHost("login.example.com:22")
+	assert.NoError(t, err)
+	assert.False(t, managed)
+
+	assert.NoError(t, SetIssuerUser("sub.example.org:2222", "https://issuer.example.org"))
+
+	opts, err = GetOptions("other.example.org:2222")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://issuer.example.org", opts.Issuer)
+
+	assert.Error(t, SetIssuerUser("login.example.net:22", "https://issuer.example.org"))
+
+	assert.NoError(t, AddHostUser("login.example.com:2222", []string{"https://ca1.example.com", "https://ca2.example.com"}, []string{"ssh-ed25519 AAAA"}))
+
+	cas, err = GetCA("login.example.com:2222")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://ca1.example.com", "https://ca2.example.com"}, cas)
+
+	opts, err = GetOptions("login.example.com:2222")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ssh-ed25519 AAAA"}, opts.CAKeys)
+
+	assert.NoError(t, SetCAKeysUser("login.example.com:2222", []string{"ssh-ed25519 AAAA", "ssh-ed25519 BBBB"}))
+
+	opts, err = GetOptions("login.example.com:2222")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ssh-ed25519 AAAA", "ssh-ed25519 BBBB"}, opts.CAKeys)
+}
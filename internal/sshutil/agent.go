@@ -1,13 +1,14 @@
 package sshutil
 
 import (
+	"errors"
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/exp/slices"
 )
 
 type socket struct {
@@ -42,11 +43,12 @@ func GetAgent() (agent.ExtendedAgent, error) {
 }
 
 // agentGetOinitCertificates returns a slice of all certificates in the agent
-// that have been issued by oinit for the given host.
+// that have been issued by oinit for the given host, or for any host if host
+// is empty.
 //
-// The KeyId field, which is set to oinit@<host> by oinit-ca, as well as the
-// occurrences of "oinit" in the ValidPrincipals field are used to identify
-// certificates issued by oinit.
+// The KeyId field, which is set to oinit@<host> by oinit-ca, is used to
+// identify certificates issued by oinit. The principals cannot be used, as
+// clients may request certificates without the "oinit" principal.
 func agentGetOinitCertificates(agent agent.ExtendedAgent, host string) ([]ssh.Certificate, error) {
 	var certificates []ssh.Certificate
 
@@ -70,8 +72,11 @@ func agentGetOinitCertificates(agent agent.ExtendedAgent, host string) ([]ssh.Ce
 			continue
 		}
 
-		if cert.CertType == ssh.UserCert && cert.KeyId == keyId &&
-			slices.Contains(cert.ValidPrincipals, PRINCIPAL) {
+		if cert.CertType != ssh.UserCert {
+			continue
+		}
+
+		if (host == "" && strings.HasPrefix(cert.KeyId, keyId)) || cert.KeyId == keyId {
 			certificates = append(certificates, *cert)
 		}
 	}
@@ -79,14 +84,32 @@ func agentGetOinitCertificates(agent agent.ExtendedAgent, host string) ([]ssh.Ce
 	return certificates, nil
 }
 
+// AgentListCertificates returns all certificates issued by oinit-ca for the
+// given host that are currently present in the agent. If host is empty,
+// certificates for all hosts are returned.
+// An error is returned when communication with the agent is not possible, for
+// example if it isn't running.
+func AgentListCertificates(agent agent.ExtendedAgent, host string) ([]ssh.Certificate, error) {
+	return agentGetOinitCertificates(agent, host)
+}
+
 // AgentHasCertificate returns a bool indicating whether a certificate issued
-// by oinit-ca for the given host is currently present in the agent.
+// by oinit-ca for the given host is currently present in the agent, which is
+// still valid for at least the given duration.
 // An error is returned when communication with the agent is not possible, for
 // example if it isn't running.
-func AgentHasCertificate(agent agent.ExtendedAgent, host string) (bool, error) {
+func AgentHasCertificate(agent agent.ExtendedAgent, host string, validFor time.Duration) (bool, error) {
 	certificates, err := agentGetOinitCertificates(agent, host)
 
-	return len(certificates) != 0, err
+	deadline := uint64(time.Now().Add(validFor).Unix())
+
+	for _, cert := range certificates {
+		if cert.ValidBefore > deadline {
+			return true, err
+		}
+	}
+
+	return false, err
 }
 
 // AgentRemoveCertificates removes all certificates issued by oinit-ca for the
@@ -105,3 +128,31 @@ func AgentRemoveCertificates(agent agent.ExtendedAgent, host string) error {
 
 	return nil
 }
+
+// AgentGetKey returns the public key held in the agent with the given SHA256
+// fingerprint, as printed by 'ssh-add -l'. Certificates are ignored.
+// An error is returned if the key is not found or communication with the
+// agent is not possible.
+func AgentGetKey(agent agent.ExtendedAgent, fingerprint string) (ssh.PublicKey, error) {
+	keys, err := agent.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		pk, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			continue
+		}
+
+		if _, ok := pk.(*ssh.Certificate); ok {
+			continue
+		}
+
+		if ssh.FingerprintSHA256(pk) == fingerprint {
+			return pk, nil
+		}
+	}
+
+	return nil, errors.New("key " + fingerprint + " not found in ssh-agent")
+}
@@ -0,0 +1,57 @@
+package sshutil
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Prefix of the data signed by SignCAKey, so that these signatures cannot be
+// mistaken for signatures of other data, such as certificates.
+const CA_KEY_SIGNATURE_PREFIX = "oinit host CA key\x00"
+
+// SignCAKey signs the given host CA public key in authorized_keys format with
+// the given signer, which is the active host CA key. Clients that pinned the
+// active key can thereby trust the next key of a key rotation. The signature
+// is returned base64-encoded.
+func SignCAKey(signer ssh.Signer, pubkey string) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubkey))
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := signer.Sign(rand.Reader, append([]byte(CA_KEY_SIGNATURE_PREFIX), key.Marshal()...))
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(ssh.Marshal(sig)), nil
+}
+
+// VerifyCAKey returns whether the given signature of pubkey was created by
+// SignCAKey using the private key of signingKey. Both keys are given in
+// authorized_keys format.
+func VerifyCAKey(signingKey, pubkey, signature string) bool {
+	signer, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signingKey))
+	if err != nil {
+		return false
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubkey))
+	if err != nil {
+		return false
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	var sig ssh.Signature
+	if ssh.Unmarshal(blob, &sig) != nil {
+		return false
+	}
+
+	return signer.Verify(append([]byte(CA_KEY_SIGNATURE_PREFIX), key.Marshal()...), &sig) == nil
+}
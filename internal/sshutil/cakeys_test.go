@@ -0,0 +1,48 @@
+package sshutil
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newCAKey(t *testing.T) (ssh.Signer, string) {
+	_, privkey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(privkey)
+	assert.NoError(t, err)
+
+	return signer, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+}
+
+func TestSignCAKey(t *testing.T) {
+	active, activeKey := newCAKey(t)
+	_, nextKey := newCAKey(t)
+	other, otherKey := newCAKey(t)
+
+	sig, err := SignCAKey(active, nextKey)
+	assert.NoError(t, err)
+
+	assert.True(t, VerifyCAKey(activeKey, nextKey, sig))
+
+	// Signed by a different key, or for a different key
+	assert.False(t, VerifyCAKey(otherKey, nextKey, sig))
+	assert.False(t, VerifyCAKey(activeKey, otherKey, sig))
+
+	// Signatures of other data are not accepted
+	otherSig, err := other.Sign(rand.Reader, []byte(nextKey))
+	assert.NoError(t, err)
+	assert.False(t, VerifyCAKey(otherKey, nextKey, base64.StdEncoding.EncodeToString(ssh.Marshal(otherSig))))
+
+	assert.False(t, VerifyCAKey(activeKey, nextKey, ""))
+	assert.False(t, VerifyCAKey(activeKey, nextKey, "invalid"))
+
+	_, err = SignCAKey(active, "invalid")
+	assert.Error(t, err)
+}
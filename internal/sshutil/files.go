@@ -15,6 +15,9 @@ const (
 	SSH_KNOWN_HOSTS_SYSTEM = "ssh_known_hosts"
 	HOSTS_USER             = "oinit_hosts"
 	HOSTS_SYSTEM           = "ssh_oinit_hosts"
+	CONFIG_USER            = "oinit_config"
+	CONFIG_SYSTEM          = "ssh_oinit_config"
+	KEY_STORE_USER         = "oinit"
 )
 
 type FilePaths struct {
@@ -85,3 +88,30 @@ func PathsSSHKnownHosts() (FilePaths, error) {
 func PathsHosts() (FilePaths, error) {
 	return findPaths(HOSTS_USER, HOSTS_SYSTEM)
 }
+
+// PathsConfig returns the user and system oinit configuration file path.
+//
+// On Unix or macOS, it returns:
+//
+//	user:   $HOME/.ssh/oinit_config
+//	system: /etc/ssh/ssh_oinit_config
+//
+// On Windows, it returns:
+//
+//	user:   %userprofile%/.ssh/oinit_config
+//	system: %programdata%/ssh/ssh_oinit_config
+func PathsConfig() (FilePaths, error) {
+	return findPaths(CONFIG_USER, CONFIG_SYSTEM)
+}
+
+// PathKeyStore returns the directory in which private keys and certificates
+// are stored if ssh-agent is not used.
+//
+// On Unix or macOS, it returns $HOME/.ssh/oinit
+//
+// On Windows, it returns %userprofile%/.ssh/oinit
+func PathKeyStore() (string, error) {
+	paths, err := findPaths(KEY_STORE_USER, KEY_STORE_USER)
+
+	return paths.User, err
+}
@@ -6,6 +6,9 @@ import (
 	"os"
 	"strconv"
 	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slices"
 )
 
 const (
@@ -42,17 +45,29 @@ func GenerateKnownHosts(host, port, pubkey string) (string, error) {
 	return "@cert-authority " + combinedHost + " " + strings.Join(parts[0:2], " "), nil
 }
 
+// Fingerprint returns the SHA256 fingerprint of the given public key in
+// authorized_keys format, as printed by ssh-keygen -l.
+func Fingerprint(pubkey string) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubkey))
+	if err != nil {
+		return "", err
+	}
+
+	return ssh.FingerprintSHA256(key), nil
+}
+
 // AddSSHKnownHost adds a "@cert-authority <hostport> <public key>" to the users
 // known_hosts file if not already present there or system wide.
-func AddSSHKnownHost(host, port, pubkey string) error {
+// Returns boolean that indicates whether the line was added or not.
+func AddSSHKnownHost(host, port, pubkey string) (bool, error) {
 	paths, err := PathsSSHKnownHosts()
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	add, err := GenerateKnownHosts(host, port, pubkey)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	for _, path := range []string{paths.System, paths.User} {
@@ -65,28 +80,143 @@ func AddSSHKnownHost(host, port, pubkey string) error {
 		scanner := bufio.NewScanner(f)
 		for scanner.Scan() {
 			if strings.HasPrefix(scanner.Text(), add) {
-				return nil
+				return false, nil
 			}
 		}
 	}
 
 	f, err := os.OpenFile(paths.User, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	if _, err = f.Write([]byte(add + " " + KNOWN_HOSTS_COMMENT + "\n")); err != nil {
 		f.Close()
-		return err
+		return false, err
 	}
 
 	f.Close()
 
-	return nil
+	return true, nil
+}
+
+// KnownHost is a "@cert-authority" line of the user's known_hosts file that
+// was added by oinit.
+type KnownHost struct {
+	Host      string
+	Port      string
+	PublicKey string
+}
+
+// ListSSHKnownHosts returns all lines of the user's known_hosts file that were
+// added by AddSSHKnownHost, as recognized by KNOWN_HOSTS_COMMENT.
+func ListSSHKnownHosts() ([]KnownHost, error) {
+	paths, err := PathsSSHKnownHosts()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(paths.User)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var hosts []KnownHost
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, found := strings.CutSuffix(scanner.Text(), " "+KNOWN_HOSTS_COMMENT)
+		if !found {
+			continue
+		}
+
+		// @cert-authority <hostport> <type> <key>
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "@cert-authority" {
+			continue
+		}
+
+		host, port := fields[1], strconv.Itoa(DEFAULT_SSH_PORT)
+		if strings.HasPrefix(host, "[") {
+			bracketed, bracketPort, found := strings.Cut(host, "]:")
+			if !found {
+				continue
+			}
+
+			host, port = strings.TrimPrefix(bracketed, "["), bracketPort
+		}
+
+		hosts = append(hosts, KnownHost{
+			Host:      host,
+			Port:      port,
+			PublicKey: fields[2] + " " + fields[3],
+		})
+	}
+
+	return hosts, scanner.Err()
+}
+
+// RemoveSSHKnownHost removes the "@cert-authority <hostport> <public key>"
+// lines of the given key from the user's known_hosts file. The system-wide file
+// is not modified. Returns boolean that indicates whether lines were removed.
+func RemoveSSHKnownHost(host, port, pubkey string) (bool, error) {
+	paths, err := PathsSSHKnownHosts()
+	if err != nil {
+		return false, err
+	}
+
+	remove, err := GenerateKnownHosts(host, port, pubkey)
+	if err != nil {
+		return false, err
+	}
+
+	content, err := os.ReadFile(paths.User)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var kept []string
+	var removed bool
+
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		// Compare with trailing space or line break, as the key may be
+		// followed by a comment.
+		trimmed := strings.TrimSuffix(line, "\n")
+		if trimmed == remove || strings.HasPrefix(trimmed, remove+" ") {
+			removed = true
+			continue
+		}
+
+		kept = append(kept, line)
+	}
+
+	if !removed {
+		return false, nil
+	}
+
+	return true, os.WriteFile(paths.User, []byte(strings.Join(kept, "")), 0600)
 }
 
+// GenerateMatchBlock returns the 'Match' block that invokes oinit when
+// connecting to a host. The IdentityFile and CertificateFile directives refer
+// to the files written by StoreCertificate, which are used if ssh-agent is not
+// running. OpenSSH ignores them if they do not exist. As %h is expanded
+// differently there than in "Match exec", see storePaths() for how the files
+// are named. The addresses file (see writeAddressesFile()) refers to the
+// files of IPv6 addresses. The users file (see WriteUsersFile()) is included
+// before the default user, as the first value of an option takes precedence.
 func GenerateMatchBlock() string {
-	return "Match exec \"oinit match %h %p\"\n\tUser oinit"
+	return "Match exec \"oinit match %h %p\"\n" +
+		"\tInclude ~/.ssh/" + KEY_STORE_USER + "/" + USERS_FILE + "\n" +
+		"\tUser oinit\n" +
+		"\tIdentityFile ~/.ssh/" + KEY_STORE_USER + "/%h\n" +
+		"\tCertificateFile ~/.ssh/" + KEY_STORE_USER + "/%h" + CERT_SUFFIX + "\n" +
+		"\tInclude ~/.ssh/" + KEY_STORE_USER + "/" + ADDRESSES_FILE
 }
 
 func fileExists(path string) bool {
@@ -147,3 +277,134 @@ func AddSSHMatchBlock() (bool, error) {
 
 	return true, err
 }
+
+const (
+	MATCH_BLOCK_OK        = "ok"
+	MATCH_BLOCK_MISSING   = "missing"
+	MATCH_BLOCK_NOT_FIRST = "not first"
+	MATCH_BLOCK_OUTDATED  = "outdated"
+)
+
+// findMatchBlock returns the index of the first and the index after the last
+// line of the match block in the given lines, including the preceding
+// CONFIG_COMMENT and a following empty line. -1 is returned if there is no
+// match block.
+func findMatchBlock(lines []string) (int, int) {
+	search := strings.Split(GenerateMatchBlock(), "\n")[0]
+
+	for i, line := range lines {
+		if line != search {
+			continue
+		}
+
+		start, end := i, i+1
+
+		// The block ends at the first line that is not indented
+		for end < len(lines) && strings.TrimLeft(lines[end], " \t") != lines[end] {
+			end++
+		}
+
+		if end < len(lines) && lines[end] == "" {
+			end++
+		}
+
+		comment := strings.Split(CONFIG_COMMENT, "\n")
+		if start >= len(comment) && slices.Equal(lines[start-len(comment):start], comment) {
+			start -= len(comment)
+		}
+
+		return start, end
+	}
+
+	return -1, -1
+}
+
+// isBlockStart returns whether the given ssh config line starts a 'Host' or
+// 'Match' block.
+func isBlockStart(line string) bool {
+	keyword, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+	keyword = strings.ToLower(keyword)
+
+	return keyword == "host" || keyword == "match"
+}
+
+// CheckSSHMatchBlock checks whether the match block generated by
+// GenerateMatchBlock() is present in the user's or system-wide ssh config
+// file, whether it is the first 'Host' or 'Match' block of the user's file
+// and whether it is up to date. Blocks in the system-wide file are not
+// checked further, as they cannot be modified by the user.
+func CheckSSHMatchBlock() (string, error) {
+	paths, err := PathsSSHConfig()
+	if err != nil {
+		return "", err
+	}
+
+	if content, err := os.ReadFile(paths.System); err == nil {
+		if start, _ := findMatchBlock(strings.Split(string(content), "\n")); start >= 0 {
+			return MATCH_BLOCK_OK, nil
+		}
+	}
+
+	content, err := os.ReadFile(paths.User)
+	if errors.Is(err, os.ErrNotExist) {
+		return MATCH_BLOCK_MISSING, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(string(content), "\n")
+
+	start, _ := findMatchBlock(lines)
+	if start < 0 {
+		return MATCH_BLOCK_MISSING, nil
+	}
+
+	search := strings.Split(GenerateMatchBlock(), "\n")[0]
+	for _, line := range lines {
+		if line == search {
+			break
+		} else if isBlockStart(line) {
+			return MATCH_BLOCK_NOT_FIRST, nil
+		}
+	}
+
+	// Compare the block without comment and empty line
+	var block []string
+	for i := slices.Index(lines, search); i < len(lines); i++ {
+		if len(block) > 0 && strings.TrimLeft(lines[i], " \t") == lines[i] {
+			break
+		}
+
+		block = append(block, lines[i])
+	}
+
+	if strings.Join(block, "\n") != GenerateMatchBlock() {
+		return MATCH_BLOCK_OUTDATED, nil
+	}
+
+	return MATCH_BLOCK_OK, nil
+}
+
+// RepairSSHMatchBlock removes the match block from the user's ssh config file
+// and prepends the current one generated by GenerateMatchBlock().
+func RepairSSHMatchBlock() error {
+	paths, err := PathsSSHConfig()
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(paths.User)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	lines := strings.Split(string(content), "\n")
+
+	if start, end := findMatchBlock(lines); start >= 0 {
+		lines = append(lines[:start], lines[end:]...)
+	}
+
+	newContent := CONFIG_COMMENT + "\n" + GenerateMatchBlock() + "\n\n" + strings.Join(lines, "\n")
+
+	return os.WriteFile(paths.User, []byte(newContent), 0644)
+}
@@ -0,0 +1,98 @@
+package sshutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveSSHKnownHost(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	oldKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOldOldOldOldOldOldOldOldOldOldOldOldOldOldOl"
+	newKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAINewNewNewNewNewNewNewNewNewNewNewNewNewNewNe"
+
+	path := filepath.Join(home, ".ssh", "known_hosts")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	assert.NoError(t, os.WriteFile(path, []byte("other.example.com ssh-ed25519 AAAA\n"), 0600))
+
+	for _, port := range []string{"22", "2222"} {
+		added, err := AddSSHKnownHost("login.example.com", port, oldKey)
+		assert.NoError(t, err)
+		assert.True(t, added)
+	}
+
+	added, err := AddSSHKnownHost("login.example.com", "22", newKey)
+	assert.NoError(t, err)
+	assert.True(t, added)
+
+	added, err = AddSSHKnownHost("login.example.com", "22", newKey)
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	hosts, err := ListSSHKnownHosts()
+	assert.NoError(t, err)
+	assert.Equal(t, []KnownHost{
+		{Host: "login.example.com", Port: "22", PublicKey: oldKey},
+		{Host: "login.example.com", Port: "2222", PublicKey: oldKey},
+		{Host: "login.example.com", Port: "22", PublicKey: newKey},
+	}, hosts)
+
+	removed, err := RemoveSSHKnownHost("login.example.com", "22", oldKey+" comment")
+	assert.NoError(t, err)
+	assert.True(t, removed)
+
+	removed, err = RemoveSSHKnownHost("login.example.com", "22", oldKey)
+	assert.NoError(t, err)
+	assert.False(t, removed)
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "other.example.com ssh-ed25519 AAAA\n"+
+		"@cert-authority [login.example.com]:2222 "+oldKey+" "+KNOWN_HOSTS_COMMENT+"\n"+
+		"@cert-authority login.example.com "+newKey+" "+KNOWN_HOSTS_COMMENT+"\n", string(content))
+}
+
+func TestCheckSSHMatchBlock(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	path := filepath.Join(home, ".ssh", "config")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+
+	state, err := CheckSSHMatchBlock()
+	assert.NoError(t, err)
+	assert.Equal(t, MATCH_BLOCK_MISSING, state)
+
+	// Block of an earlier version, placed after another block
+	assert.NoError(t, os.WriteFile(path, []byte("Host example.com\n"+
+		"\tUser example\n\n"+
+		CONFIG_COMMENT+"\n"+
+		"Match exec \"oinit match %h %p\"\n"+
+		"\tUser oinit\n\n"+
+		"Host *\n"+
+		"\tForwardAgent no\n"), 0644))
+
+	state, err = CheckSSHMatchBlock()
+	assert.NoError(t, err)
+	assert.Equal(t, MATCH_BLOCK_NOT_FIRST, state)
+
+	assert.NoError(t, RepairSSHMatchBlock())
+
+	state, err = CheckSSHMatchBlock()
+	assert.NoError(t, err)
+	assert.Equal(t, MATCH_BLOCK_OK, state)
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, CONFIG_COMMENT+"\n"+GenerateMatchBlock()+"\n\n"+
+		"Host example.com\n"+
+		"\tUser example\n\n"+
+		"Host *\n"+
+		"\tForwardAgent no\n", string(content))
+}
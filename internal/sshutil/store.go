@@ -0,0 +1,277 @@
+package sshutil
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	CERT_SUFFIX = "-cert.pub"
+
+	// File in the key store directory that is included by the match block to
+	// refer to the files of hosts containing ':', see writeAddressesFile().
+	ADDRESSES_FILE = ".addresses"
+
+	ADDRESSES_COMMENT = "# Generated by oinit for the certificates of IPv6 addresses, do not edit."
+
+	// Replaces ':' in file names, which is not allowed on Windows. It is
+	// neither part of host names nor addresses.
+	ADDRESS_SEPARATOR = "!"
+)
+
+// Hosts written to the addresses file, which is an ssh config file
+var validAddress = regexp.MustCompile(`^[a-z0-9.:%_-]+$`)
+
+// symlink is replaced in tests
+var symlink = os.Symlink
+
+// storePaths returns the paths of the private key and certificate files for
+// the given host. These are named like the files created by ssh-keygen, so
+// that they can be referenced in the ssh config file using the %h token.
+//
+// ssh lowercases host names when expanding %h in IdentityFile and
+// CertificateFile, while %h is not modified in "Match exec". Hosts are
+// therefore lowercased here, and the host must be passed as given to ssh.
+// ssh keeps addresses as given however (e.g. "2001:DB8::1"), and ':' is not
+// allowed in file names on Windows. It is replaced by ADDRESS_SEPARATOR, and
+// the files of such hosts are referenced by the addresses file instead, see
+// writeAddressesFile().
+func storePaths(host string) (string, string, error) {
+	dir, err := PathKeyStore()
+	if err != nil {
+		return "", "", err
+	}
+
+	// The host is used as file name and must not escape the directory
+	if host == "" || strings.HasPrefix(host, ".") || strings.ContainsAny(host, `/\`+ADDRESS_SEPARATOR) {
+		return "", "", errors.New("invalid host name")
+	}
+
+	key := filepath.Join(dir, strings.ReplaceAll(strings.ToLower(host), ":", ADDRESS_SEPARATOR))
+
+	return key, key + CERT_SUFFIX, nil
+}
+
+// generateAddresses returns the content of the addresses file for the given
+// file names of the key store. For every file name containing
+// ADDRESS_SEPARATOR, a 'Match' block refers to its files for the host it was
+// stored for, as %h cannot be used, see storePaths(). Hosts that are not
+// safe to use in the ssh config file are skipped.
+func generateAddresses(names []string) string {
+	lines := []string{ADDRESSES_COMMENT}
+
+	for _, name := range names {
+		host := strings.ReplaceAll(name, ADDRESS_SEPARATOR, ":")
+		if host == name || !validAddress.MatchString(host) {
+			continue
+		}
+
+		// '%' starts a token in IdentityFile and CertificateFile
+		path := "~/.ssh/" + KEY_STORE_USER + "/" + strings.ReplaceAll(name, "%", "%%")
+
+		lines = append(lines,
+			"Match host "+host,
+			"\tIdentityFile "+path,
+			"\tCertificateFile "+path+CERT_SUFFIX)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// writeAddressesFile writes the addresses file included by the match block for
+// the certificates currently in the key store, see generateAddresses().
+func writeAddressesFile() error {
+	dir, err := PathKeyStore()
+	if err != nil {
+		return err
+	}
+
+	certPaths, err := filepath.Glob(filepath.Join(dir, "*"+CERT_SUFFIX))
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, certPath := range certPaths {
+		names = append(names, strings.TrimSuffix(filepath.Base(certPath), CERT_SUFFIX))
+	}
+
+	return writeStoreFile(ADDRESSES_FILE, generateAddresses(names))
+}
+
+// readCertificate reads the OpenSSH certificate stored at the given path.
+func readCertificate(path string) (*ssh.Certificate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("not a certificate")
+	}
+
+	return cert, nil
+}
+
+// StoreCertificate writes the given private key and certificate for the given
+// host to the key store directory, which is created if necessary. Both files
+// are only readable by the user, as required by OpenSSH for private keys.
+func StoreCertificate(host string, privkey crypto.PrivateKey, cert *ssh.Certificate) error {
+	keyPath, certPath, err := storePaths(host)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return err
+	}
+
+	block, err := ssh.MarshalPrivateKey(privkey, cert.KeyId)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		return err
+	}
+
+	return writeAddressesFile()
+}
+
+// StoreExternalCertificate writes the given certificate for the given host to
+// the key store. Its private key is not managed by oinit, but either held in
+// ssh-agent or stored in keyFile, to which a symbolic link is created. This
+// allows to use security keys or existing keys.
+//
+// If symbolic links cannot be created, which requires special privileges on
+// Windows, keyFile is copied instead.
+func StoreExternalCertificate(host string, cert *ssh.Certificate, keyFile string) error {
+	keyPath, certPath, err := storePaths(host)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return err
+	}
+
+	// Remove a previously generated key or link
+	if err := os.Remove(keyPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if keyFile != "" && symlink(keyFile, keyPath) != nil {
+		if err := copyKeyFile(keyFile, keyPath); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0600); err != nil {
+		return err
+	}
+
+	return writeAddressesFile()
+}
+
+// copyKeyFile copies the private key file src to dst, which is only readable
+// by the user.
+func copyKeyFile(src, dst string) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(dst, content, 0600)
+}
+
+// StoreHasCertificate returns a bool indicating whether a certificate for the
+// given host is present in the key store, which is still valid for at least
+// the given duration. If key is not nil, the certificate must certify this
+// key. Otherwise, the private key must be present in the key store.
+func StoreHasCertificate(host string, validFor time.Duration, key ssh.PublicKey) (bool, error) {
+	keyPath, certPath, err := storePaths(host)
+	if err != nil {
+		return false, err
+	}
+
+	if key == nil && !fileExists(keyPath) {
+		return false, nil
+	}
+
+	cert, err := readCertificate(certPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if key != nil && !bytes.Equal(cert.Key.Marshal(), key.Marshal()) {
+		return false, nil
+	}
+
+	return cert.ValidBefore > uint64(time.Now().Add(validFor).Unix()), nil
+}
+
+// StoreRemoveCertificate removes the private key and certificate for the
+// given host from the key store.
+func StoreRemoveCertificate(host string) error {
+	keyPath, certPath, err := storePaths(host)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range []string{certPath, keyPath} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return writeAddressesFile()
+}
+
+// StorePrune removes all expired certificates and their private keys from the
+// key store.
+func StorePrune() error {
+	dir, err := PathKeyStore()
+	if err != nil {
+		return err
+	}
+
+	certPaths, err := filepath.Glob(filepath.Join(dir, "*"+CERT_SUFFIX))
+	if err != nil {
+		return err
+	}
+
+	now := uint64(time.Now().Unix())
+
+	for _, certPath := range certPaths {
+		cert, err := readCertificate(certPath)
+		if err == nil && cert.ValidBefore > now {
+			continue
+		}
+
+		os.Remove(certPath)
+		os.Remove(strings.TrimSuffix(certPath, CERT_SUFFIX))
+	}
+
+	return writeAddressesFile()
+}
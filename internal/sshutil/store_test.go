@@ -0,0 +1,207 @@
+package sshutil
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newCertificate(t *testing.T, host string, validFor time.Duration) (ed25519.PrivateKey, *ssh.Certificate) {
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(caKey)
+
+	pk, privkey, _ := ed25519.GenerateKey(rand.Reader)
+	pubkey, _ := ssh.NewPublicKey(pk)
+
+	cert := &ssh.Certificate{
+		Key:             pubkey,
+		CertType:        ssh.UserCert,
+		KeyId:           PRINCIPAL + "@" + host,
+		ValidPrincipals: []string{PRINCIPAL},
+		ValidBefore:     uint64(time.Now().Add(validFor).Unix()),
+	}
+	assert.NoError(t, cert.SignCert(rand.Reader, signer))
+
+	return privkey, cert
+}
+
+func TestStoreCertificate(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	privkey, cert := newCertificate(t, "login.example.com", time.Hour)
+	assert.NoError(t, StoreCertificate("login.example.com", privkey, cert))
+
+	info, err := os.Stat(filepath.Join(home, ".ssh", KEY_STORE_USER, "login.example.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	exists, err := StoreHasCertificate("login.example.com", time.Minute, nil)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	// Certificate expires within the renewal window
+	exists, _ = StoreHasCertificate("login.example.com", 2*time.Hour, nil)
+	assert.False(t, exists)
+
+	exists, _ = StoreHasCertificate("other.example.com", time.Minute, nil)
+	assert.False(t, exists)
+
+	assert.Error(t, StoreCertificate("../config", privkey, cert))
+}
+
+func TestStoreExternalCertificate(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	keyFile := filepath.Join(home, "id_ecdsa")
+	assert.NoError(t, os.WriteFile(keyFile, []byte("key"), 0600))
+
+	_, cert := newCertificate(t, "login.example.com", time.Hour)
+	assert.NoError(t, StoreExternalCertificate("login.example.com", cert, keyFile))
+
+	target, err := os.Readlink(filepath.Join(home, ".ssh", KEY_STORE_USER, "login.example.com"))
+	assert.NoError(t, err)
+	assert.Equal(t, keyFile, target)
+
+	exists, _ := StoreHasCertificate("login.example.com", time.Minute, cert.Key)
+	assert.True(t, exists)
+
+	// Certificate was issued for a different key
+	_, other := newCertificate(t, "login.example.com", time.Hour)
+	exists, _ = StoreHasCertificate("login.example.com", time.Minute, other.Key)
+	assert.False(t, exists)
+
+	// The key file is copied if symbolic links are not supported
+	symlink = func(string, string) error { return &os.LinkError{Op: "symlink", Err: os.ErrPermission} }
+	t.Cleanup(func() { symlink = os.Symlink })
+
+	assert.NoError(t, StoreExternalCertificate("login.example.com", cert, keyFile))
+
+	keyPath := filepath.Join(home, ".ssh", KEY_STORE_USER, "login.example.com")
+
+	info, err := os.Lstat(keyPath)
+	assert.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular())
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	content, err := os.ReadFile(keyPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "key", string(content))
+
+	exists, _ = StoreHasCertificate("login.example.com", time.Minute, cert.Key)
+	assert.True(t, exists)
+
+	assert.Error(t, StoreExternalCertificate("login.example.com", cert, filepath.Join(home, "missing")))
+}
+
+func TestStorePrune(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	privkey, cert := newCertificate(t, "valid.example.com", time.Hour)
+	assert.NoError(t, StoreCertificate("valid.example.com", privkey, cert))
+
+	privkey, cert = newCertificate(t, "expired.example.com", -time.Hour)
+	assert.NoError(t, StoreCertificate("expired.example.com", privkey, cert))
+
+	assert.NoError(t, StorePrune())
+
+	dir := filepath.Join(home, ".ssh", KEY_STORE_USER)
+	assert.FileExists(t, filepath.Join(dir, "valid.example.com"))
+	assert.FileExists(t, filepath.Join(dir, "valid.example.com"+CERT_SUFFIX))
+	assert.NoFileExists(t, filepath.Join(dir, "expired.example.com"))
+	assert.NoFileExists(t, filepath.Join(dir, "expired.example.com"+CERT_SUFFIX))
+}
+
+func TestStorePathsCase(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	dir := filepath.Join(home, ".ssh", KEY_STORE_USER)
+
+	// ssh lowercases names when expanding %h in IdentityFile. ':' is not
+	// allowed in file names on Windows.
+	tests := []struct {
+		host string
+		file string
+	}{
+		{"Login.Example.COM", "login.example.com"},
+		{"login.example.com", "login.example.com"},
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:DB8::1", "2001!db8!!1"},
+		{"2001:db8::1", "2001!db8!!1"},
+		{"fe80::1%eth0", "fe80!!1%eth0"},
+	}
+
+	for _, test := range tests {
+		keyPath, certPath, err := storePaths(test.host)
+
+		assert.NoError(t, err, test.host)
+		assert.Equal(t, filepath.Join(dir, test.file), keyPath, test.host)
+		assert.Equal(t, filepath.Join(dir, test.file+CERT_SUFFIX), certPath, test.host)
+	}
+
+	privkey, cert := newCertificate(t, "login.example.com", time.Hour)
+	assert.NoError(t, StoreCertificate("Login.Example.COM", privkey, cert))
+
+	exists, err := StoreHasCertificate("login.example.com", time.Minute, nil)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	for _, host := range []string{"", ".users", "../config", `..\config`, "2001!db8!!1"} {
+		_, _, err := storePaths(host)
+		assert.Error(t, err, host)
+	}
+}
+
+func TestStoreAddresses(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	path := filepath.Join(home, ".ssh", KEY_STORE_USER, ADDRESSES_FILE)
+
+	privkey, cert := newCertificate(t, "2001:db8::1", time.Hour)
+	assert.NoError(t, StoreCertificate("2001:DB8::1", privkey, cert))
+
+	privkey, cert = newCertificate(t, "login.example.com", time.Hour)
+	assert.NoError(t, StoreCertificate("login.example.com", privkey, cert))
+
+	privkey, cert = newCertificate(t, "fe80::1%eth0", time.Hour)
+	assert.NoError(t, StoreCertificate("fe80::1%eth0", privkey, cert))
+
+	exists, err := StoreHasCertificate("2001:DB8::1", time.Minute, nil)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, ADDRESSES_COMMENT+"\n"+
+		"Match host 2001:db8::1\n"+
+		"\tIdentityFile ~/.ssh/oinit/2001!db8!!1\n"+
+		"\tCertificateFile ~/.ssh/oinit/2001!db8!!1-cert.pub\n"+
+		"Match host fe80::1%eth0\n"+
+		"\tIdentityFile ~/.ssh/oinit/fe80!!1%%eth0\n"+
+		"\tCertificateFile ~/.ssh/oinit/fe80!!1%%eth0-cert.pub\n", string(content))
+
+	assert.NoError(t, StoreRemoveCertificate("2001:db8::1"))
+	assert.NoError(t, StoreRemoveCertificate("fe80::1%eth0"))
+
+	content, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, ADDRESSES_COMMENT+"\n", string(content))
+
+	// Hosts that would break the ssh config file are skipped
+	assert.Equal(t, ADDRESSES_COMMENT+"\n", generateAddresses([]string{"x!\n\tProxyCommand sh", "x! y", "login.example.com"}))
+}
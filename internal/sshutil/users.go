@@ -0,0 +1,94 @@
+package sshutil
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// File in the key store directory that is included by the match block to
+	// set the user to log in as, see WriteUsersFile(). Host names never start
+	// with a dot, so that it cannot clash with the files of a host.
+	USERS_FILE = ".users"
+
+	USERS_COMMENT = "# Generated by oinit from the user option of its config file, do not edit."
+)
+
+// Allowed user names, which are used in the ssh config file unquoted
+var validUser = regexp.MustCompile(`^[a-zA-Z0-9._][a-zA-Z0-9._@-]*$`)
+
+// generateUsers returns the content of the users file for the given users.
+// For every user, a 'Match' block asks oinit whether it is configured for
+// the host and port, as the options of oinit cannot be expressed as ssh
+// config patterns.
+func generateUsers(users []string) (string, error) {
+	lines := []string{USERS_COMMENT}
+
+	for _, user := range users {
+		if !validUser.MatchString(user) {
+			return "", errors.New("invalid user name '" + user + "'")
+		}
+
+		lines = append(lines,
+			"Match exec \"oinit match --user "+user+" %h %p\"",
+			"\tUser "+user)
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// WriteUsersFile writes the users file included by the match block, which sets
+// the user to log in as for hosts with a configured user (see the user option
+// of oinit).
+func WriteUsersFile(users []string) error {
+	content, err := generateUsers(users)
+	if err != nil {
+		return err
+	}
+
+	return writeStoreFile(USERS_FILE, content)
+}
+
+// writeStoreFile writes the given content to the file with the given name in
+// the key store directory. It is only written if its content changed, and
+// replaced atomically, as it may be read by ssh at the same time.
+func writeStoreFile(name, content string) error {
+	dir, err := PathKeyStore()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, name)
+
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, []byte(content)) {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, name+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteString(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
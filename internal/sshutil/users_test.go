@@ -0,0 +1,43 @@
+package sshutil
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteUsersFile(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	path := filepath.Join(home, ".ssh", KEY_STORE_USER, USERS_FILE)
+
+	assert.NoError(t, WriteUsersFile([]string{"alice", "oinit"}))
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, USERS_COMMENT+"\n"+
+		"Match exec \"oinit match --user alice %h %p\"\n"+
+		"\tUser alice\n"+
+		"Match exec \"oinit match --user oinit %h %p\"\n"+
+		"\tUser oinit\n", string(content))
+
+	assert.NoError(t, WriteUsersFile(nil))
+
+	content, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, USERS_COMMENT+"\n", string(content))
+
+	// User names must not break the ssh config file
+	for _, user := range []string{"", "alice bob", "alice\"", "-oProxyCommand=x", "alice\n"} {
+		assert.Error(t, WriteUsersFile([]string{user}), user)
+	}
+
+	// No temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -1,6 +1,8 @@
 package util
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,8 +25,13 @@ func NewTimedCache[K comparable, E any]() *TimedCache[K, E] {
 	}
 }
 
+// TimedCache is safe for concurrent use.
 type TimedCache[K comparable, E any] struct {
+	mu      sync.Mutex
 	entries map[K]timedCacheEntry[E]
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
 }
 
 type timedCacheEntry[E any] struct {
@@ -48,23 +55,37 @@ type timedCacheEntry[E any] struct {
 //	// 'value' will be 42, and 'exists' will be 'true' within the specified
 //	// duration of 10 seconds, otherwise 'value' will be the zero value of int
 //	// (0) and 'exists' will be 'false'.
-func (c TimedCache[K, E]) Get(key K) (E, bool) {
+func (c *TimedCache[K, E]) Get(key K) (E, bool) {
 	var content E
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	entry, ok := c.entries[key]
 	if !ok {
+		c.misses.Add(1)
+
 		return content, false
 	}
 
 	if time.Now().After(entry.expires) {
 		delete(c.entries, key)
+		c.misses.Add(1)
 
 		return content, false
 	}
 
+	c.hits.Add(1)
+
 	return entry.content, true
 }
 
+// Stats returns the number of calls to Get that found a valid entry (hits)
+// and that did not (misses).
+func (c *TimedCache[K, E]) Stats() (uint64, uint64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
 // Set adds a key-value pair to the TimedCache with a specified expiration time.
 //
 // It associates the given key of type K with the provided value of type E and
@@ -78,7 +99,10 @@ func (c TimedCache[K, E]) Get(key K) (E, bool) {
 //	cache.Set("key1", 42, 10*time.Second)
 //	// The value 42 is associated with "key1" and will be valid for 10 seconds.
 //	// After that, using 'cache.Get("key1")' will return 'false'.
-func (c TimedCache[K, E]) Set(key K, content E, duration time.Duration) {
+func (c *TimedCache[K, E]) Set(key K, content E, duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.entries[key] = timedCacheEntry[E]{
 		content: content,
 		expires: time.Now().Add(duration * time.Second),
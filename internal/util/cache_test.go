@@ -41,6 +41,13 @@ func TestTimedCache_Get(t *testing.T) {
 			t.Errorf("Expected value to be 0, but got %d", value)
 		}
 	})
+
+	t.Run("Stats", func(t *testing.T) {
+		hits, misses := cache.Stats()
+		if hits != 1 || misses != 2 {
+			t.Errorf("Expected 1 hit and 2 misses, but got %d and %d", hits, misses)
+		}
+	})
 }
 
 func TestTimedCache_Set(t *testing.T) {
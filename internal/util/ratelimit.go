@@ -0,0 +1,95 @@
+package util
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Interval in which buckets that are full again are removed
+const RATE_LIMITER_SWEEP_INTERVAL = time.Minute
+
+// NewRateLimiter creates a new, empty RateLimiter and returns a pointer to it.
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*rateLimitBucket),
+		now:     time.Now,
+	}
+}
+
+// RateLimiter limits the number of events per key using token buckets. Every
+// bucket holds up to limit tokens and is refilled at limit tokens per period,
+// so that bursts of up to limit events are allowed. RateLimiter is safe for
+// concurrent use.
+type RateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*rateLimitBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type rateLimitBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time
+}
+
+// Allow consumes a token from the bucket of the given key and returns whether
+// the event is allowed. If it is not, the duration until a token is available
+// again is returned as well. Limits are passed on every call, so that they can
+// be changed at runtime. A limit or period of zero disables the limit.
+//
+// Example:
+//
+//	limiter := NewRateLimiter()
+//	ok, retryAfter := limiter.Allow("192.0.2.1", 10, time.Minute)
+//	// 'ok' is 'true' for the first 10 calls within a minute, after that
+//	// 'retryAfter' is the time until the next call is allowed (6 seconds at
+//	// most).
+func (l *RateLimiter) Allow(key string, limit int, period time.Duration) (bool, time.Duration) {
+	if limit <= 0 || period <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	// tokens per second
+	rate := float64(limit) / period.Seconds()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &rateLimitBucket{tokens: float64(limit), last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(float64(limit), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+
+	bucket.tokens--
+	bucket.full = now.Add(time.Duration((float64(limit) - bucket.tokens) / rate * float64(time.Second)))
+
+	return true, 0
+}
+
+// sweep removes buckets that are full again, which behave like missing ones.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < RATE_LIMITER_SWEEP_INTERVAL {
+		return
+	}
+
+	for key, bucket := range l.buckets {
+		if !now.Before(bucket.full) {
+			delete(l.buckets, key)
+		}
+	}
+
+	l.lastSweep = now
+}
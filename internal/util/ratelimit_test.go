@@ -0,0 +1,61 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Allow(t *testing.T) {
+	now := time.Unix(0, 0)
+
+	limiter := NewRateLimiter()
+	limiter.now = func() time.Time { return now }
+
+	t.Run("Burst", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if ok, _ := limiter.Allow("key1", 3, time.Minute); !ok {
+				t.Errorf("Expected call %d to be allowed", i+1)
+			}
+		}
+
+		ok, retryAfter := limiter.Allow("key1", 3, time.Minute)
+		if ok {
+			t.Errorf("Expected call 4 to be denied")
+		}
+		if retryAfter != 20*time.Second {
+			t.Errorf("Expected retry after 20s, but got %s", retryAfter)
+		}
+	})
+
+	t.Run("Other key", func(t *testing.T) {
+		if ok, _ := limiter.Allow("key2", 3, time.Minute); !ok {
+			t.Errorf("Expected call with other key to be allowed")
+		}
+	})
+
+	t.Run("Refill", func(t *testing.T) {
+		now = now.Add(20 * time.Second)
+
+		if ok, _ := limiter.Allow("key1", 3, time.Minute); !ok {
+			t.Errorf("Expected call to be allowed after refill")
+		}
+		if ok, _ := limiter.Allow("key1", 3, time.Minute); ok {
+			t.Errorf("Expected call to be denied again")
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		if ok, _ := limiter.Allow("key1", 0, time.Minute); !ok {
+			t.Errorf("Expected call to be allowed without limit")
+		}
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		limiter.Allow("key3", 3, time.Minute)
+
+		if len(limiter.buckets) != 1 {
+			t.Errorf("Expected 1 bucket after sweep, but got %d", len(limiter.buckets))
+		}
+	})
+}
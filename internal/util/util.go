@@ -3,6 +3,7 @@ package util
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -47,3 +48,24 @@ func Getenvs(keys ...string) string {
 
 	return ""
 }
+
+// ExpandHome replaces a leading ~ in the given path with the home directory of
+// the user.
+//
+// Example usage:
+//
+//	path, err := ExpandHome("~/.ssh/id_ed25519")
+//	// path will be "/home/user/.ssh/id_ed25519"
+func ExpandHome(path string) (string, error) {
+	rest, found := strings.CutPrefix(path, "~")
+	if !found {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, rest), nil
+}
@@ -2,6 +2,7 @@ package util
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -95,3 +96,15 @@ func TestGetenvs(t *testing.T) {
 	os.Setenv(keys[0], keys[0])
 	assert.Equal(t, Getenvs(keys...), keys[0])
 }
+
+func TestExpandHome(t *testing.T) {
+	t.Setenv("HOME", "/home/user")
+
+	path, err := ExpandHome("~/.ssh/id_ed25519")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join("/home/user", ".ssh", "id_ed25519"), path)
+
+	path, err = ExpandHome("/etc/ssh/ssh_config")
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/ssh/ssh_config", path)
+}
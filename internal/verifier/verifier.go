@@ -0,0 +1,329 @@
+// Package verifier verifies JWT access tokens against the keys published by
+// their OpenID Connect issuer.
+package verifier
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lbrocke/oinit/internal/util"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	DISCOVERY_PATH = "/.well-known/openid-configuration"
+
+	// Clock skew that is tolerated when validating exp and nbf claims
+	LEEWAY = 10 * time.Second
+
+	// Minimum interval (in seconds) in which a cached key set is retrieved
+	// again because of a token signed by an unknown key
+	REFETCH_INTERVAL = 60
+
+	ERR_UNTRUSTED_ISSUER = "token issuer is not trusted"
+	ERR_DISCOVERY        = "cannot retrieve discovery document"
+	ERR_JWKS             = "cannot retrieve key set"
+	ERR_UNKNOWN_KEY      = "token signed by unknown key"
+)
+
+var validMethods = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+	"EdDSA",
+}
+
+type discoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// Verifier verifies access tokens. Discovery documents and key sets are
+// cached for the given duration (in seconds), so that tokens can be verified
+// without contacting the issuer each time.
+type Verifier struct {
+	client        *http.Client
+	cacheDuration int
+	discovery     *util.TimedCache[string, discoveryDocument]
+	keys          *util.TimedCache[string, map[string]interface{}]
+	fetched       *util.TimedCache[string, struct{}]
+}
+
+// NewVerifier creates a new Verifier, which caches discovery documents and
+// key sets for cacheDuration seconds.
+func NewVerifier(cacheDuration int) *Verifier {
+	return &Verifier{
+		client:        &http.Client{Timeout: 10 * time.Second},
+		cacheDuration: cacheDuration,
+		discovery:     util.NewTimedCache[string, discoveryDocument](),
+		keys:          util.NewTimedCache[string, map[string]interface{}](),
+		fetched:       util.NewTimedCache[string, struct{}](),
+	}
+}
+
+// CacheStats returns the combined hits and misses of the discovery document
+// and key set caches.
+func (v *Verifier) CacheStats() (uint64, uint64) {
+	discoveryHits, discoveryMisses := v.discovery.Stats()
+	keysHits, keysMisses := v.keys.Stats()
+
+	return discoveryHits + keysHits, discoveryMisses + keysMisses
+}
+
+// Verify verifies the signature of the given JWT using the keys published by
+// its issuer and validates the iss, exp and nbf claims. The token must be
+// issued by one of the given issuers. If audience is not empty, the aud claim
+// must contain it.
+//
+// The claims of the token are returned if it is valid.
+func (v *Verifier) Verify(token string, issuers []string, audience string) (jwt.MapClaims, error) {
+	unverified, _, err := jwt.NewParser().ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		return nil, err
+	}
+
+	issuer, err := unverified.Claims.GetIssuer()
+	if err != nil || !slices.Contains(issuers, issuer) {
+		return nil, errors.New(ERR_UNTRUSTED_ISSUER)
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(validMethods),
+		jwt.WithIssuer(issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(LEEWAY),
+	}
+	if audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+
+	claims := jwt.MapClaims{}
+
+	_, err = jwt.NewParser(opts...).ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+
+		return v.getKey(issuer, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// getKey returns the public key with the given key id of the given issuer.
+// If the key is unknown, the key set is retrieved again once, as the issuer
+// might have rotated its keys. This happens at most once per
+// REFETCH_INTERVAL, so that tokens with made-up key ids cannot make the CA
+// flood the issuer with requests. Unknown keys are rejected in the meantime.
+func (v *Verifier) getKey(issuer string, kid string) (interface{}, error) {
+	doc, err := v.getDiscoveryDocument(issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, cached := v.keys.Get(doc.JWKSURI)
+	if !cached {
+		if keys, err = v.fetchKeys(doc.JWKSURI); err != nil {
+			return nil, err
+		}
+	}
+
+	if key := findKey(keys, kid); key != nil {
+		return key, nil
+	}
+
+	if _, recent := v.fetched.Get(doc.JWKSURI); cached && !recent {
+		if keys, err = v.fetchKeys(doc.JWKSURI); err != nil {
+			return nil, err
+		}
+
+		if key := findKey(keys, kid); key != nil {
+			return key, nil
+		}
+	}
+
+	return nil, errors.New(ERR_UNKNOWN_KEY)
+}
+
+// findKey returns the key with the given key id. Tokens without key id are
+// only accepted if the key set contains exactly one key.
+func findKey(keys map[string]interface{}, kid string) interface{} {
+	if key, ok := keys[kid]; ok {
+		return key
+	}
+
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+
+	return nil
+}
+
+func (v *Verifier) getDiscoveryDocument(issuer string) (discoveryDocument, error) {
+	if doc, ok := v.discovery.Get(issuer); ok {
+		return doc, nil
+	}
+
+	var doc discoveryDocument
+
+	if err := v.getJSON(strings.TrimSuffix(issuer, "/")+DISCOVERY_PATH, &doc); err != nil {
+		return doc, errors.New(ERR_DISCOVERY)
+	}
+
+	// From OpenID Connect Discovery 1.0, section 4.3:
+	//   The issuer value returned MUST be identical to the Issuer URL that was
+	//   directly used to retrieve the configuration information.
+	if doc.Issuer != issuer || doc.JWKSURI == "" {
+		return doc, errors.New(ERR_DISCOVERY)
+	}
+
+	v.discovery.Set(issuer, doc, time.Duration(v.cacheDuration))
+
+	return doc, nil
+}
+
+func (v *Verifier) fetchKeys(uri string) (map[string]interface{}, error) {
+	var set jsonWebKeySet
+
+	if err := v.getJSON(uri, &set); err != nil {
+		return nil, errors.New(ERR_JWKS)
+	}
+
+	keys := make(map[string]interface{})
+
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		// Ignore keys of unsupported types
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+
+	v.keys.Set(uri, keys, time.Duration(v.cacheDuration))
+	v.fetched.Set(uri, struct{}{}, REFETCH_INTERVAL)
+
+	return keys, nil
+}
+
+func (v *Verifier) getJSON(url string, into interface{}) error {
+	res, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New("unexpected status code")
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, into)
+}
+
+// publicKey converts the JSON web key into a public key as expected by the
+// jwt package.
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve")
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid point")
+		}
+
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, errors.New("unsupported curve")
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid key")
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, errors.New("unsupported key type")
+	}
+}
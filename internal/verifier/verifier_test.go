@@ -0,0 +1,209 @@
+package verifier
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lbrocke/oinit/internal/util"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// newIssuer starts a test server acting as OpenID Connect provider that
+// publishes the given keys. Requests of the key set are counted in
+// jwksRequests, if not nil.
+func newIssuer(t *testing.T, jwksRequests *atomic.Int32, keys ...jsonWebKey) *httptest.Server {
+	var srv *httptest.Server
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(DISCOVERY_PATH, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(discoveryDocument{
+			Issuer:  srv.URL,
+			JWKSURI: srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		if jwksRequests != nil {
+			jwksRequests.Add(1)
+		}
+
+		json.NewEncoder(w).Encode(jsonWebKeySet{Keys: keys})
+	})
+
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	srv := newIssuer(t, nil,
+		jsonWebKey{
+			Kty: "RSA",
+			Kid: "rsa",
+			N:   b64(rsaKey.N.Bytes()),
+			E:   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+		},
+		jsonWebKey{
+			Kty: "EC",
+			Kid: "ec",
+			Crv: "P-256",
+			X:   b64(ecKey.X.FillBytes(make([]byte, 32))),
+			Y:   b64(ecKey.Y.FillBytes(make([]byte, 32))),
+		},
+	)
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = kid
+
+		str, err := token.SignedString(key)
+		assert.NoError(t, err)
+
+		return str
+	}
+
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": srv.URL,
+			"sub": "user",
+			"aud": "oinit",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	v := NewVerifier(60)
+
+	t.Run("Valid RSA token", func(t *testing.T) {
+		claims, err := v.Verify(sign(jwt.SigningMethodRS256, "rsa", rsaKey, valid()), []string{srv.URL}, "oinit")
+		assert.NoError(t, err)
+
+		sub, _ := claims.GetSubject()
+		assert.Equal(t, "user", sub)
+	})
+
+	t.Run("Valid EC token", func(t *testing.T) {
+		_, err := v.Verify(sign(jwt.SigningMethodES256, "ec", ecKey, valid()), []string{srv.URL}, "")
+		assert.NoError(t, err)
+	})
+
+	t.Run("Untrusted issuer", func(t *testing.T) {
+		_, err := v.Verify(sign(jwt.SigningMethodRS256, "rsa", rsaKey, valid()), []string{"https://example.com"}, "")
+		assert.EqualError(t, err, ERR_UNTRUSTED_ISSUER)
+	})
+
+	t.Run("Wrong audience", func(t *testing.T) {
+		_, err := v.Verify(sign(jwt.SigningMethodRS256, "rsa", rsaKey, valid()), []string{srv.URL}, "other")
+		assert.Error(t, err)
+	})
+
+	t.Run("Expired token", func(t *testing.T) {
+		claims := valid()
+		claims["exp"] = time.Now().Add(-time.Hour).Unix()
+
+		_, err := v.Verify(sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims), []string{srv.URL}, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("Token not yet valid", func(t *testing.T) {
+		claims := valid()
+		claims["nbf"] = time.Now().Add(time.Hour).Unix()
+
+		_, err := v.Verify(sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims), []string{srv.URL}, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("Token without expiry", func(t *testing.T) {
+		claims := valid()
+		delete(claims, "exp")
+
+		_, err := v.Verify(sign(jwt.SigningMethodRS256, "rsa", rsaKey, claims), []string{srv.URL}, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("Invalid signature", func(t *testing.T) {
+		_, err := v.Verify(sign(jwt.SigningMethodRS256, "rsa", otherKey, valid()), []string{srv.URL}, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("Unknown key", func(t *testing.T) {
+		_, err := v.Verify(sign(jwt.SigningMethodRS256, "unknown", rsaKey, valid()), []string{srv.URL}, "")
+		assert.Error(t, err)
+	})
+
+	t.Run("Opaque token", func(t *testing.T) {
+		_, err := v.Verify("opaque", []string{srv.URL}, "")
+		assert.Error(t, err)
+	})
+}
+
+func TestVerifier_UnknownKeyRefetch(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	var jwksRequests atomic.Int32
+	srv := newIssuer(t, &jwksRequests, jsonWebKey{
+		Kty: "RSA",
+		Kid: "rsa",
+		N:   b64(rsaKey.N.Bytes()),
+		E:   b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+	})
+
+	sign := func(kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss": srv.URL,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = kid
+
+		str, err := token.SignedString(rsaKey)
+		assert.NoError(t, err)
+
+		return str
+	}
+
+	v := NewVerifier(3600)
+
+	_, err := v.Verify(sign("rsa"), []string{srv.URL}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), jwksRequests.Load())
+
+	// The key set was just retrieved, so unknown keys are rejected without
+	// retrieving it again
+	for _, kid := range []string{"unknown-1", "unknown-2", "unknown-3"} {
+		_, err = v.Verify(sign(kid), []string{srv.URL}, "")
+		assert.ErrorContains(t, err, ERR_UNKNOWN_KEY)
+	}
+	assert.Equal(t, int32(1), jwksRequests.Load())
+
+	// Once the interval passed, the key set is retrieved again only once
+	v.fetched = util.NewTimedCache[string, struct{}]()
+
+	for _, kid := range []string{"unknown-1", "unknown-2", "unknown-3"} {
+		_, err = v.Verify(sign(kid), []string{srv.URL}, "")
+		assert.ErrorContains(t, err, ERR_UNKNOWN_KEY)
+	}
+	assert.Equal(t, int32(2), jwksRequests.Load())
+
+	_, err = v.Verify(sign("rsa"), []string{srv.URL}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), jwksRequests.Load())
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"net/http"
 	"strings"
+	"time"
 )
 
 const (
@@ -67,8 +68,14 @@ type ApiResponseUserStatus struct {
 	Credentials Credentials     `json:"credentials"`
 }
 
+// Observer is called after every request to motley_cue with the requested
+// path, the duration of the request, the response status code (0 if no
+// response was received) and the error returned to the caller, if any.
+type Observer func(path string, duration time.Duration, statusCode int, err error)
+
 type Client struct {
-	addr string
+	addr     string
+	observer Observer
 }
 
 // parseError tries to unmarshal the given response body into
@@ -111,6 +118,28 @@ func NewClient(addr string) Client {
 	}
 }
 
+// WithObserver returns a copy of the client that reports every request to the
+// given observer, e.g. to collect metrics.
+func (c Client) WithObserver(observer Observer) Client {
+	c.observer = observer
+
+	return c
+}
+
+// observe reports a finished request to the observer, if any.
+func (c Client) observe(path string, start time.Time, res *http.Response, err error) {
+	if c.observer == nil {
+		return
+	}
+
+	statusCode := 0
+	if res != nil {
+		statusCode = res.StatusCode
+	}
+
+	c.observer(path, time.Since(start), statusCode, err)
+}
+
 // GetInfo calls GET /info.
 //
 // Retrieve service-specific information:
@@ -121,19 +150,28 @@ func NewClient(addr string) Client {
 func (c Client) GetInfo() (ApiResponseInfo, error) {
 	var response ApiResponseInfo
 
+	start := time.Now()
+
 	res, err := http.Get(c.addr + "/info")
 	if err != nil {
-		return response, errors.New(ERR_REQUEST)
+		err = errors.New(ERR_REQUEST)
+		c.observe("/info", start, nil, err)
+
+		return response, err
 	}
 
 	defer res.Body.Close()
 
 	switch res.StatusCode {
 	case http.StatusOK:
-		return response, parseResponse(res.Body, &response)
+		err = parseResponse(res.Body, &response)
 	default:
-		return response, fmt.Errorf(ERR_SERVER_RESPONSE_CODE, res.StatusCode)
+		err = fmt.Errorf(ERR_SERVER_RESPONSE_CODE, res.StatusCode)
 	}
+
+	c.observe("/info", start, res, err)
+
+	return response, err
 }
 
 // getUser is the implementation of both GET /user/get_status and GET
@@ -148,31 +186,40 @@ func (c Client) getUser(path string, token string) (ApiResponseUserStatus, error
 
 	req.Header.Set("Authorization", "Bearer "+token)
 
+	start := time.Now()
+
 	client := http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
-		return response, errors.New(ERR_REQUEST)
+		err = errors.New(ERR_REQUEST)
+		c.observe(path, start, nil, err)
+
+		return response, err
 	}
 
 	defer res.Body.Close()
 
 	switch res.StatusCode {
 	case http.StatusOK:
-		return response, parseResponse(res.Body, &response)
+		err = parseResponse(res.Body, &response)
 	case http.StatusUnauthorized:
 		fallthrough
 	case http.StatusForbidden:
 		fallthrough
 	case http.StatusNotFound:
-		return response, parseError(res.Body)
+		err = parseError(res.Body)
 	case http.StatusUnprocessableEntity:
 		// In this case, the response body has a different structure and cannot
 		// be parsed easily into a ApiResponseDetail struct, therefore return
 		// custom error.
 		fallthrough
 	default:
-		return response, fmt.Errorf(ERR_SERVER_RESPONSE_CODE, res.StatusCode)
+		err = fmt.Errorf(ERR_SERVER_RESPONSE_CODE, res.StatusCode)
 	}
+
+	c.observe(path, start, res, err)
+
+	return response, err
 }
 
 // GetUserStatus calls GET /user/status.
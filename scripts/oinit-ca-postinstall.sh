@@ -7,6 +7,6 @@ if command -v systemctl > /dev/null && [ "$(systemctl is-system-running)" != "of
     systemctl daemon-reload
 fi
 
-mkdir -p /etc/oinit-ca/
+mkdir -p /etc/oinit-ca/ /var/lib/oinit-ca/
 ssh-keygen -t ed25519 -f /etc/oinit-ca/user-ca -N "" > /dev/null
 ssh-keygen -t ed25519 -f /etc/oinit-ca/host-ca -N "" > /dev/null
@@ -21,9 +21,14 @@ echo ""
 echo ""
 
 echo "2. Please request an OpenSSH certificate from the oinit CA administrator by"
-echo "   sending him/her the file '/etc/ssh/host-key.pub'."
+echo "   sending him/her the file '/etc/ssh/host-key.pub'. If the administrator"
+echo "   enabled host enrollment, you can instead request the certificate yourself"
+echo "   by sending '/etc/ssh/host-key.pub' to the CA's host-certificate route:"
 echo ""
-echo "   You'll get two files in return:"
+echo "    POST https://<ca>/api/v1/<host>/host-certificate"
+echo "    {\"publickey\": \"<content of host-key.pub>\", \"secret\": \"<secret>\"}"
+echo ""
+echo "   You'll need two files:"
 echo "    - host-key-cert.pub"
 echo "    - user-ca.pub"
 echo ""